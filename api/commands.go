@@ -1,10 +1,15 @@
 package api
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -12,7 +17,15 @@ import (
 	"github.com/danielpaulus/app-signer/codesign"
 )
 
+//PrepareSigningWorkspace creates a SigningWorkspace in workdir that signs with the codesign command.
+//It parses all profiles in profilesDir and installs their certificates into a new keychain.
 func PrepareSigningWorkspace(workdir string, profilePassword string, profilesDir string) (SigningWorkspace, error) {
+	return PrepareSigningWorkspaceWithOptions(workdir, profilePassword, profilesDir, WorkspaceOptions{})
+}
+
+//PrepareSigningWorkspaceWithOptions works like PrepareSigningWorkspace with a configurable signing backend.
+//The keychain is only set up for backends that need it.
+func PrepareSigningWorkspaceWithOptions(workdir string, profilePassword string, profilesDir string, options WorkspaceOptions) (SigningWorkspace, error) {
 	workDirPath, err := filepath.Abs(workdir)
 	if err != nil {
 		log.WithFields(log.Fields{"err": err}).Error("workdir path Abs failed")
@@ -30,13 +43,20 @@ func PrepareSigningWorkspace(workdir string, profilePassword string, profilesDir
 		return SigningWorkspace{}, err
 	}
 
-	signingWorkspace := NewSigningWorkspace(workDirPath, profilePassword)
+	signingWorkspace, err := NewSigningWorkspaceWithOptions(workDirPath, profilePassword, options)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("invalid workspace options")
+		return SigningWorkspace{}, err
+	}
 
 	err = signingWorkspace.PrepareProfiles(profilesDir)
 	if err != nil {
 		log.Error("appsigner failed to start")
 		return SigningWorkspace{}, err
 	}
+	if !signingWorkspace.UsesKeychain() {
+		return signingWorkspace, nil
+	}
 
 	err = signingWorkspace.PrepareKeychain("appsigner.keychain")
 	if err != nil {
@@ -50,70 +70,284 @@ func PrepareSigningWorkspace(workdir string, profilePassword string, profilesDir
 	return signingWorkspace, nil
 }
 
+//Entitlement modes of ResignOptions.
+//EntitlementsProfile signs every bundle with all entitlements of its profile.
+//EntitlementsMerge keeps the entitlements each binary was signed with as far as its profile grants them,
+//see codesign.MergeEntitlements.
+const (
+	EntitlementsProfile = "profile"
+	EntitlementsMerge   = "merge"
+)
+
+//ResignOptions contains optional settings for ResignIPAWithOptions.
+//Logger receives the progress messages, it defaults to the standard logger.
+//BundleID is the new bundle identifier of the app, nested bundles sharing the old one as prefix are renamed too.
+//If it is empty, the app keeps its identifiers.
+//Entitlements is one of the Entitlements* modes and defaults to EntitlementsProfile.
+//Expired profiles are never used. ExpiryWarning is how long before the chosen profile or its certificate expires
+//a warning is logged and returned with the result, it defaults to codesign.DefaultExpiryWarning and a negative value
+//disables the warnings. With StrictExpiry signing fails instead of warning.
+//Context cancels signing, it is checked between the steps of signing and before each bundle.
+type ResignOptions struct {
+	Context       context.Context
+	Logger        log.FieldLogger
+	BundleID      string
+	Entitlements  string
+	ExpiryWarning time.Duration
+	StrictExpiry  bool
+}
+
+//ResignIPA signs the ipa at ipafilePath with the profile containing udid and writes the result to outputFileName.
+//Errors wrap one of the Err* values of this package, so callers can tell bad input from signing failures.
 func ResignIPA(s SigningWorkspace, udid string, ipafilePath string, outputFileName string) (string, error) {
+	return ResignIPAWithOptions(s, udid, ipafilePath, outputFileName, ResignOptions{})
+}
+
+//ResignIPAWithOptions works like ResignIPA with the given options
+func ResignIPAWithOptions(s SigningWorkspace, udid string, ipafilePath string, outputFileName string, options ResignOptions) (string, error) {
+	result, err := ResignIPAWithResult(s, udid, ipafilePath, outputFileName, options)
+	return result.OutputPath, err
+}
+
+//ResignResult contains the path of the signed ipa, the name of the profile the app was signed with and warnings
+//about problems that did not prevent signing, like profiles or certificates that expire soon.
+type ResignResult struct {
+	OutputPath string
+	Profile    string
+	Warnings   []string
+}
+
+//ResignIPAWithResult works like ResignIPAWithOptions and also returns the warnings that came up during signing.
+//If signing fails, the result contains the warnings up to that point.
+func ResignIPAWithResult(s SigningWorkspace, udid string, ipafilePath string, outputFileName string, options ResignOptions) (ResignResult, error) {
 	if udid == "" {
-		return "", fmt.Errorf("udid was empty")
+		return ResignResult{Warnings: []string{}}, ErrMissingUDID
 	}
+	return resignIPA(s, []string{udid}, ipafilePath, outputFileName, options, nil)
+}
 
-	index := codesign.FindProfileForDevice(udid, s.profiles)
+//resignIPA signs the ipa for all devices with the same profiles. If appProfile is set, the app itself is signed with
+//it instead of the best profile for its bundle id.
+func resignIPA(s SigningWorkspace, udids []string, ipafilePath string, outputFileName string, options ResignOptions, appProfile *codesign.ProfileCandidate) (ResignResult, error) {
+	result := ResignResult{Warnings: []string{}}
+	logger := options.Logger
+	if logger == nil {
+		logger = log.StandardLogger()
+	}
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx = codesign.WithLogger(ctx, logger)
+	err := validateOptions(options)
+	if err != nil {
+		return result, err
+	}
 
-	if index == -1 {
-		return "", fmt.Errorf("the device '%s' is not contained in any profile", udid)
+	//fail early before extracting the ipa, the bundle id is checked once it is known
+	if !s.selectProfiles(udids, "").DeviceProvisioned() {
+		return result, fmt.Errorf("%w: the device '%s' is not contained in any profile", ErrDeviceNotProvisioned, strings.Join(udids, "', '"))
 	}
 
 	ipafile, err := os.Open(ipafilePath)
 	if err != nil {
-		return "", fmt.Errorf("could not open file: %s with err: %v", ipafilePath, err)
+		return result, fmt.Errorf("could not open file: %s with err: %v", ipafilePath, err)
 	}
+	defer ipafile.Close()
 	info, err := ipafile.Stat()
 	if err != nil {
-		return "", fmt.Errorf("failed getting file info for %+v err: %v", ipafile, err)
+		return result, fmt.Errorf("failed getting file info for %+v err: %v", ipafile, err)
 	}
 
 	_, directory, err := codesign.ExtractZip(ipafile, info.Size())
 	if err != nil {
-		return "", fmt.Errorf("failed extracting ipafile")
+		return result, fmt.Errorf("%w: failed extracting ipafile: %v", ErrInvalidIPA, err)
 	}
 	defer os.RemoveAll(directory)
 
 	if codesign.ContainsAppstoreApp(directory) {
-		log.Warn("this is a appstore build, are you sure it should be resigned?")
+		logger.Warn("this is a appstore build, are you sure it should be resigned?")
 	}
 
 	appFolder, err := codesign.FindAppFolder(directory)
 	if err != nil {
-		fmt.Errorf("could not find .app folder in extracted ipa payload folder")
+		return result, fmt.Errorf("%w: could not find .app folder in extracted ipa payload folder", ErrInvalidIPA)
 	}
 
 	//if the appstore build check suceeds, the app is guaranteed to have a embedded.mobileprovision
 	//profile
-	if codesign.IsEnterpriseProfile(path.Join(appFolder, "embedded.mobileprovision")) {
-		log.Warn("this app was signed with an enterprise certificate, resigning makes no sense")
+	if codesign.IsEnterpriseProfileWithTrust(path.Join(appFolder, "embedded.mobileprovision"), s.profileTrust) {
+		logger.Warn("this app was signed with an enterprise certificate, resigning makes no sense")
 	}
 
-	archs, err := architecturecheck.ExtractArchitectures(appFolder)
+	slices, err := architecturecheck.ExtractSlices(appFolder)
 	if err != nil {
-		return "", fmt.Errorf("could not determine build architecture of build, run 'lipo -info appDir/appExecutable' to debug %+v", err)
+		return result, fmt.Errorf("%w: could not determine build architecture of build, the main executable is not a valid mach-o binary %+v", ErrInvalidIPA, err)
 	}
-	if architecturecheck.IsSimulatorApp(archs) {
-		return "", fmt.Errorf("invalid build architectures: %v, was this build for a simulator?", archs)
+	if architecturecheck.IsSimulatorBuild(slices) {
+		return result, fmt.Errorf("%w: invalid build platforms: %v, was this build for a simulator?", ErrSimulatorBuild, slices)
 	}
 
-	err = codesign.Sign(directory, s.GetConfig(index))
-	if err != nil {
-		return "", fmt.Errorf("failed signing app: %v", err)
+	if options.BundleID != "" {
+		changes, err := codesign.RewriteBundleIdentifiers(appFolder, options.BundleID)
+		if err != nil {
+			return result, fmt.Errorf("%w: failed changing bundle identifier: %v", ErrInvalidIPA, err)
+		}
+		logger.WithFields(log.Fields{"identifiers": changes}).Info("changed bundle identifiers")
 	}
 
+	entitlementsDir, err := ioutil.TempDir("", "entitlements")
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(entitlementsDir)
+	configs, config, err := selectBundleConfigs(s, udids, appFolder, options, appProfile, entitlementsDir, &result, logger)
+	if err != nil {
+		return result, err
+	}
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	logger.WithFields(log.Fields{"bundles": len(configs), "udids": udids}).Info("signing app")
+	err = codesign.SignBundlesContext(ctx, directory, configs, s.signer)
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	if err != nil {
+		return result, fmt.Errorf("%w: failed signing app: %v", ErrSigningFailed, err)
+	}
+	//only native signatures are checked, codesign seals resources in ways the native verifier does not reproduce
+	if s.backend == codesign.BackendNative {
+		for _, bundleConfig := range configs {
+			if bundleConfig.SigningCert == nil || !bundleConfig.SigningCert.Equal(config.SigningCert) {
+				//extensions signed with other certificates, only check the signatures are valid
+				config.SigningCert = nil
+			}
+		}
+		err = codesign.VerifyApp(directory, codesign.VerifyOptions{Certificate: config.SigningCert})
+		if err != nil {
+			return result, fmt.Errorf("%w: signature verification failed after signing: %v", ErrVerificationFailed, err)
+		}
+	}
 
 	f, err := os.OpenFile(outputFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
 	if err != nil {
-		log.Fatal(err)
+		return result, fmt.Errorf("failed creating output file: %w", err)
 	}
+	defer f.Close()
 	err = codesign.CompressToZip(directory, f)
 	if err != nil {
-		return "", fmt.Errorf("failed zipping app: %v", err)
+		return result, fmt.Errorf("failed zipping app: %v", err)
+	}
+	logger.Info("succeeded signing")
+	logger.Info(outputFileName)
+	result.OutputPath = outputFileName
+	return result, nil
+}
+
+func validateOptions(options ResignOptions) error {
+	switch options.Entitlements {
+	case "", EntitlementsProfile, EntitlementsMerge:
+		return nil
+	}
+	return fmt.Errorf("%w: unknown entitlements mode '%s'", ErrInvalidOptions, options.Entitlements)
+}
+
+//selectBundleConfigs picks the best profile for the app and each of its extensions and watch apps. It returns
+//the config of every bundle and the one of the app itself. If a bundle is not covered by any profile, the error
+//wraps ErrNoMatchingProfile and explains why each profile was rejected.
+//The entitlements of every bundle are written to entitlementsDir, with wildcards replaced by the bundle's identifier.
+//Profiles and certificates expiring within the warning window are added to the result's warnings, in strict mode
+//they are an error wrapping ErrProfileExpiring. A non nil appProfile is used for the app instead of the best profile.
+func selectBundleConfigs(s SigningWorkspace, udids []string, appFolder string, options ResignOptions, appProfile *codesign.ProfileCandidate, entitlementsDir string, result *ResignResult, logger log.FieldLogger) (codesign.BundleConfigs, codesign.SigningConfig, error) {
+	window := options.ExpiryWarning
+	if window == 0 {
+		window = codesign.DefaultExpiryWarning
+	}
+	now := time.Now()
+	bundles, err := codesign.ProfileBundles(appFolder)
+	if err != nil {
+		return nil, codesign.SigningConfig{}, fmt.Errorf("%w: could not read bundle identifiers: %v", ErrInvalidIPA, err)
+	}
+	paths := make([]string, 0, len(bundles))
+	for bundlePath := range bundles {
+		paths = append(paths, bundlePath)
 	}
-	log.Info("succeeded signing")
-	log.Info(outputFileName)
-	return outputFileName, nil
+	sort.Strings(paths)
+
+	configs := codesign.BundleConfigs{}
+	for _, bundlePath := range paths {
+		bundleID := bundles[bundlePath]
+		selection := s.selectProfiles(udids, bundleID)
+		candidate, ok := selection.Best()
+		if bundlePath == appFolder && appProfile != nil {
+			candidate, ok = *appProfile, true
+		}
+		if !ok {
+			devices := strings.Join(udids, "', '")
+			if bundlePath == appFolder {
+				return nil, codesign.SigningConfig{}, fmt.Errorf("%w: no profile for device '%s' covers bundle id '%s':\n%s", ErrNoMatchingProfile, devices, bundleID, selection.Explain())
+			}
+			relative, _ := filepath.Rel(appFolder, bundlePath)
+			return nil, codesign.SigningConfig{}, fmt.Errorf("%w: no profile for device '%s' covers bundle id '%s' of the nested bundle %s:\n%s", ErrNoMatchingProfile, devices, bundleID, relative, selection.Explain())
+		}
+		logger.WithFields(log.Fields{"bundleid": bundleID, "profile": candidate.Name, "reasons": candidate.Reasons, "candidates": len(selection.Candidates)}).Info("selected profile")
+		if bundlePath == appFolder {
+			result.Profile = candidate.Name
+		}
+		_, expiring := s.profiles[candidate.Index].CheckExpiry(now, window)
+		for _, warning := range expiring {
+			if options.StrictExpiry {
+				return nil, codesign.SigningConfig{}, fmt.Errorf("%w: %s, needed for '%s'", ErrProfileExpiring, warning, bundleID)
+			}
+			logger.WithFields(log.Fields{"bundleid": bundleID}).Warn(warning)
+			result.Warnings = append(result.Warnings, warning)
+		}
+
+		config := s.GetConfig(candidate.Index)
+		profile := s.profiles[candidate.Index].MobileProvisioningProfile
+		entitlements := profile.Entitlements
+		if options.Entitlements == EntitlementsMerge {
+			signed, err := codesign.ReadBundleEntitlements(bundlePath)
+			if err != nil {
+				return nil, codesign.SigningConfig{}, fmt.Errorf("%w: failed merging entitlements of '%s': %v", ErrInvalidIPA, bundleID, err)
+			}
+			var removed []string
+			entitlements, removed = codesign.MergeEntitlements(signed, profile.Entitlements, codesign.ProfileTeamID(profile))
+			logger.WithFields(log.Fields{"bundleid": bundleID, "removed": removed}).Info("merged entitlements")
+		}
+		config.EntitlementsFilePath = path.Join(entitlementsDir, bundleID+"-entitlements.plist")
+		err = codesign.WriteEntitlements(config.EntitlementsFilePath, codesign.ConcretiseEntitlements(entitlements, bundleID))
+		if err != nil {
+			return nil, codesign.SigningConfig{}, err
+		}
+		configs[bundleID] = config
+	}
+	return configs, configs[bundles[appFolder]], nil
+}
+
+//VerifyIPA checks the code signatures of the ipa file, or of an already extracted .app or Payload directory,
+//with the native verifier. It does not need macOS or the codesign command.
+func VerifyIPA(ipaPath string, options codesign.VerifyOptions) error {
+	info, err := os.Stat(ipaPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if strings.HasSuffix(ipaPath, ".app") {
+			return codesign.VerifyBundle(ipaPath, options)
+		}
+		return codesign.VerifyApp(ipaPath, options)
+	}
+	ipafile, err := os.Open(ipaPath)
+	if err != nil {
+		return fmt.Errorf("could not open file: %s with err: %v", ipaPath, err)
+	}
+	defer ipafile.Close()
+	_, directory, err := codesign.ExtractZip(ipafile, info.Size())
+	if err != nil {
+		return fmt.Errorf("failed extracting ipafile: %w", err)
+	}
+	defer os.RemoveAll(directory)
+	return codesign.VerifyApp(directory, options)
 }
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/danielpaulus/app-signer/codesign"
+	log "github.com/sirupsen/logrus"
+)
+
+//SignedOutput is one ipa signed by ResignIPAForDevices with the profile of the given name for the devices in UDIDs
+type SignedOutput struct {
+	OutputPath string   `json:"outputPath"`
+	Profile    string   `json:"profile"`
+	UDIDs      []string `json:"udids"`
+}
+
+//DevicesResult contains the signed ipas of ResignIPAForDevices, Devices maps every udid to the ipa that installs on it.
+type DevicesResult struct {
+	Outputs  []SignedOutput    `json:"outputs"`
+	Devices  map[string]string `json:"devices"`
+	Warnings []string          `json:"warnings"`
+}
+
+//ResignIPAForDevices signs the ipa once for a set of devices. If one profile covers all devices, there is a single
+//output. Otherwise the devices are split over the smallest set of profiles, see codesign.CoverDevices, and the ipa is
+//signed once per profile. The outputs are written to outputDir, named like the ipa with a number appended.
+//Each group's app is signed with the profile of the group, its extensions and watch apps with the best profile for
+//their bundle ids. If any device or bundle is not covered by a profile, nothing is signed and the error wraps
+//ErrNoMatchingProfile.
+func ResignIPAForDevices(s SigningWorkspace, udids []string, ipafilePath string, outputDir string, options ResignOptions) (DevicesResult, error) {
+	result := DevicesResult{Outputs: []SignedOutput{}, Devices: map[string]string{}, Warnings: []string{}}
+	logger := options.Logger
+	if logger == nil {
+		logger = log.StandardLogger()
+	}
+	udids = uniqueUDIDs(udids)
+	if len(udids) == 0 {
+		return result, ErrMissingUDID
+	}
+	err := validateOptions(options)
+	if err != nil {
+		return result, err
+	}
+
+	//without a new bundle id the app has to be opened to find it, with one coverage is checked before opening it
+	var bundleIDs []string
+	bundleID := options.BundleID
+	if bundleID == "" {
+		bundleIDs, err = readBundleIDs(ipafilePath, "")
+		if err != nil {
+			return result, err
+		}
+		bundleID = bundleIDs[0]
+	}
+	cover := codesign.CoverDevices(udids, bundleID, s.profiles)
+	if len(cover.Uncovered) > 0 {
+		return result, fmt.Errorf("%w: no profile covers bundle id '%s' for the devices '%s'", ErrNoMatchingProfile, bundleID, strings.Join(cover.Uncovered, "', '"))
+	}
+	if bundleIDs == nil {
+		bundleIDs, err = readBundleIDs(ipafilePath, options.BundleID)
+		if err != nil {
+			return result, err
+		}
+	}
+	//check the extensions and watch apps of every group before signing, so a failing group leaves no outputs behind
+	for _, group := range cover.Groups {
+		if uncovered := group.UncoveredBundles(bundleIDs, s.profiles); len(uncovered) > 0 {
+			return result, fmt.Errorf("%w: no profile covers the bundle ids '%s' for the devices '%s'", ErrNoMatchingProfile, strings.Join(uncovered, "', '"), strings.Join(group.UDIDs, "', '"))
+		}
+	}
+	logger.WithFields(log.Fields{"devices": len(udids), "profiles": len(cover.Groups)}).Info("grouped devices by profile")
+
+	err = os.MkdirAll(outputDir, 0755)
+	if err != nil {
+		return result, fmt.Errorf("failed creating output dir: %w", err)
+	}
+	base := strings.TrimSuffix(path.Base(ipafilePath), ".ipa")
+	for i, group := range cover.Groups {
+		outputPath := path.Join(outputDir, fmt.Sprintf("%s-%d.ipa", base, i+1))
+		logger.WithFields(log.Fields{"profile": group.Candidate.Name, "udids": group.UDIDs, "output": outputPath}).Info("signing for device group")
+		candidate := group.Candidate
+		signed, err := resignIPA(s, group.UDIDs, ipafilePath, outputPath, options, &candidate)
+		result.Warnings = append(result.Warnings, signed.Warnings...)
+		if err != nil {
+			return result, err
+		}
+		result.Outputs = append(result.Outputs, SignedOutput{OutputPath: outputPath, Profile: signed.Profile, UDIDs: group.UDIDs})
+		for _, udid := range group.UDIDs {
+			result.Devices[udid] = outputPath
+		}
+	}
+	return result, nil
+}
+
+//readBundleIDs returns the bundle identifiers of the app in the ipa and all its bundles that embed a profile, the app's
+//own identifier first. If newBundleID is set, the identifiers are the ones the bundles get when the app is renamed.
+func readBundleIDs(ipafilePath string, newBundleID string) ([]string, error) {
+	appFolder, cleanup, err := openApp(ipafilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	bundles, err := codesign.ProfileBundles(appFolder)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not read bundle identifiers: %v", ErrInvalidIPA, err)
+	}
+	appID := bundles[appFolder]
+	bundleIDs := []string{}
+	for bundlePath, bundleID := range bundles {
+		if bundlePath != appFolder {
+			bundleIDs = append(bundleIDs, bundleID)
+		}
+	}
+	sort.Strings(bundleIDs)
+	bundleIDs = append([]string{appID}, bundleIDs...)
+	if newBundleID != "" {
+		for i, bundleID := range bundleIDs {
+			bundleIDs[i] = codesign.RewrittenBundleIdentifier(bundleID, appID, newBundleID)
+		}
+	}
+	return bundleIDs, nil
+}
+
+func uniqueUDIDs(udids []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, udid := range udids {
+		udid = strings.TrimSpace(udid)
+		if udid == "" || seen[udid] {
+			continue
+		}
+		seen[udid] = true
+		result = append(result, udid)
+	}
+	return result
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/danielpaulus/app-signer/codesign"
+)
+
+//EntitlementsReport compares the entitlements the app in the ipa and each of its extensions and watch apps are
+//currently signed with against the profile ResignIPA would pick for them on the device udid.
+//ipaPath can also be an extracted .app or a directory containing the Payload directory.
+//Bundles are reported in the order of their paths, starting with the app itself.
+func EntitlementsReport(s SigningWorkspace, udid string, ipaPath string) ([]codesign.EntitlementsDiff, error) {
+	appFolder, cleanup, err := openApp(ipaPath)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	bundles, err := codesign.ProfileBundles(appFolder)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not read bundle identifiers: %v", ErrInvalidIPA, err)
+	}
+	paths := make([]string, 0, len(bundles))
+	for bundlePath := range bundles {
+		paths = append(paths, bundlePath)
+	}
+	sort.Strings(paths)
+
+	report := make([]codesign.EntitlementsDiff, 0, len(paths))
+	for _, bundlePath := range paths {
+		bundleID := bundles[bundlePath]
+		selection := s.SelectProfiles(udid, bundleID)
+		candidate, ok := selection.Best()
+		if !ok {
+			return nil, fmt.Errorf("%w: no profile for device '%s' covers bundle id '%s':\n%s", ErrNoMatchingProfile, udid, bundleID, selection.Explain())
+		}
+		entitlements, err := codesign.ReadBundleEntitlements(bundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidIPA, err)
+		}
+		profile := s.profiles[candidate.Index].MobileProvisioningProfile
+		diff := codesign.DiffEntitlements(entitlements, profile.Entitlements, codesign.ProfileTeamID(profile))
+		diff.BundleID = bundleID
+		diff.Path, _ = filepath.Rel(filepath.Dir(appFolder), bundlePath)
+		diff.Profile = candidate.Name
+		report = append(report, diff)
+	}
+	return report, nil
+}
+
+//openApp returns the .app directory of the ipa, .app or Payload parent directory at ipaPath.
+//Ipa files are extracted to a temporary directory that is removed by the returned cleanup func.
+func openApp(ipaPath string) (string, func(), error) {
+	noop := func() {}
+	info, err := os.Stat(ipaPath)
+	if err != nil {
+		return "", noop, err
+	}
+	if info.IsDir() {
+		if strings.HasSuffix(ipaPath, ".app") {
+			return ipaPath, noop, nil
+		}
+		appFolder, err := codesign.FindAppFolder(ipaPath)
+		if err != nil {
+			return "", noop, fmt.Errorf("%w: %v", ErrInvalidIPA, err)
+		}
+		return appFolder, noop, nil
+	}
+	ipafile, err := os.Open(ipaPath)
+	if err != nil {
+		return "", noop, fmt.Errorf("could not open file: %s with err: %v", ipaPath, err)
+	}
+	defer ipafile.Close()
+	_, directory, err := codesign.ExtractZip(ipafile, info.Size())
+	if err != nil {
+		return "", noop, fmt.Errorf("%w: failed extracting ipafile: %v", ErrInvalidIPA, err)
+	}
+	cleanup := func() { os.RemoveAll(directory) }
+	appFolder, err := codesign.FindAppFolder(directory)
+	if err != nil {
+		cleanup()
+		return "", noop, fmt.Errorf("%w: could not find .app folder in extracted ipa payload folder", ErrInvalidIPA)
+	}
+	return appFolder, cleanup, nil
+}
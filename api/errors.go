@@ -0,0 +1,27 @@
+package api
+
+import "errors"
+
+//Errors returned by ResignIPA, wrapped with details about what exactly failed.
+//Use errors.Is to check for them.
+var (
+	//ErrInvalidOptions means the ResignOptions contain an unknown value
+	ErrInvalidOptions = errors.New("invalid options")
+	//ErrMissingUDID means no device udid was given
+	ErrMissingUDID = errors.New("udid was empty")
+	//ErrDeviceNotProvisioned means none of the workspace's profiles contains the device
+	ErrDeviceNotProvisioned = errors.New("device not provisioned")
+	//ErrNoMatchingProfile means profiles contain the device, but none has an App ID covering the app's bundle id
+	//or all of them expired
+	ErrNoMatchingProfile = errors.New("no matching profile")
+	//ErrProfileExpiring means the profile or certificate expires within the warning window and StrictExpiry is set
+	ErrProfileExpiring = errors.New("profile expiring")
+	//ErrInvalidIPA means the file could not be extracted or does not contain a valid app
+	ErrInvalidIPA = errors.New("invalid ipa")
+	//ErrSimulatorBuild means the app was built for the simulator and can not be signed for devices
+	ErrSimulatorBuild = errors.New("simulator build")
+	//ErrSigningFailed means the signing backend failed
+	ErrSigningFailed = errors.New("signing failed")
+	//ErrVerificationFailed means the app was signed, but the signature did not pass verification
+	ErrVerificationFailed = errors.New("verification failed")
+)
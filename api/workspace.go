@@ -1,9 +1,9 @@
 package api
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"strings"
 
@@ -16,27 +16,81 @@ type certAndEntitlement struct {
 	certPath        string
 	entitlementPath string
 	certsha1        string
+	password        string
 }
 
 //SigningWorkspace contains the workdir and allows for parsing provisioning profiles.
 //It also keeps which certificates are stored where in the workspace dir and knows where the keychain is.
 type SigningWorkspace struct {
-	workdir         string
-	profiles        []codesign.ProfileAndCertificate
-	extractedFiles  []certAndEntitlement
-	keychainPath    string
-	profilePassword string
+	workdir          string
+	profiles         []codesign.ProfileAndCertificate
+	extractedFiles   []certAndEntitlement
+	keychainPath     string
+	profilePassword  string
+	passwordManifest string
+	profileTrust     codesign.ProfileTrust
+	backend          string
+	signer           codesign.Signer
+}
+
+//WorkspaceOptions contains optional settings for a SigningWorkspace.
+//Backend selects the signing backend by name, see codesign.NewSigner. It defaults to codesign.BackendCodesign.
+//PasswordManifest is a JSON file mapping profile UUIDs or names to the passwords of their p12 files,
+//see codesign.LoadP12Passwords. The profile password is used for all other p12 files.
+//ProfileRoots is a PEM file with roots that are trusted to sign profiles in addition to Apple's,
+//SkipProfileVerification loads profiles without checking their signature, see codesign.ProfileTrust.
+type WorkspaceOptions struct {
+	Backend                 string
+	PasswordManifest        string
+	ProfileRoots            string
+	SkipProfileVerification bool
 }
 
 //NewSigningWorkspace set up a new Workspace with a new workdir
 func NewSigningWorkspace(workdir string, profilePassword string) SigningWorkspace {
-	return SigningWorkspace{workdir: workdir, profilePassword: profilePassword}
+	return SigningWorkspace{workdir: workdir, profilePassword: profilePassword, backend: codesign.BackendCodesign, signer: codesign.CodesignSigner{}}
+}
+
+//NewSigningWorkspaceWithOptions works like NewSigningWorkspace but uses the signing backend from the options.
+//It returns an error if the backend does not exist.
+func NewSigningWorkspaceWithOptions(workdir string, profilePassword string, options WorkspaceOptions) (SigningWorkspace, error) {
+	s := NewSigningWorkspace(workdir, profilePassword)
+	s.passwordManifest = options.PasswordManifest
+	trust, err := codesign.LoadProfileTrust(options.ProfileRoots)
+	if err != nil {
+		return SigningWorkspace{}, err
+	}
+	trust.Skip = options.SkipProfileVerification
+	s.profileTrust = trust
+	if options.Backend == "" {
+		return s, nil
+	}
+	signer, err := codesign.NewSigner(options.Backend)
+	if err != nil {
+		return SigningWorkspace{}, err
+	}
+	s.backend = options.Backend
+	s.signer = signer
+	return s, nil
+}
+
+//UsesKeychain returns true if the workspace signs with the codesign command and therefore needs
+//a keychain with all certificates installed.
+func (s *SigningWorkspace) UsesKeychain() bool {
+	return s.backend == codesign.BackendCodesign
 }
 
 //PrepareProfiles parses the mobileprovisioning profiles in the given profilesDir.
 //It extracts entitlements and stores P12 files, as well associating the correct sha1 fingerprints.
+//The password of each p12 file is resolved with codesign.P12Passwords and kept for the keychain import.
+//Profiles that are not signed by Apple are rejected, so they never reach the keychain.
 func (s *SigningWorkspace) PrepareProfiles(profilesDir string) error {
-	profiles, err := codesign.ParseProfiles(profilesDir, s.profilePassword)
+	passwords, err := codesign.LoadP12Passwords(profilesDir, s.profilePassword, s.passwordManifest)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("loading p12 passwords failed")
+		return err
+	}
+	profiles, err := codesign.ParseProfilesWithPasswords(profilesDir, passwords, s.profileTrust)
 	if err != nil {
 		log.WithFields(log.Fields{"err": err}).Error("loading profiles failed")
 		return err
@@ -62,23 +116,30 @@ func (s *SigningWorkspace) PrepareProfiles(profilesDir string) error {
 			log.WithFields(log.Fields{"err": err}).Error("failed converting to plist")
 			return err
 		}
-		entitlementName := path.Join(s.workdir, profile.MobileProvisioningProfile.Name+"-entitlements.plist")
+		//profile names are not unique and can contain path separators, the index is both unique and safe
+		fileName := fmt.Sprintf("profile-%d", i)
+		entitlementName := path.Join(s.workdir, fileName+"-entitlements.plist")
 		log.Infof("extracting entitlements to: '%s'", entitlementName)
 		err = ioutil.WriteFile(entitlementName, bytes, 0644)
 		if err != nil {
 			log.WithFields(log.Fields{"err": err}).Error("writing entitlements failed")
 			return err
 		}
-		certfile := path.Join(s.workdir, profile.MobileProvisioningProfile.Name+"-signingcert.p12")
+		certfile := path.Join(s.workdir, fileName+"-signingcert.p12")
+		certBytes := profile.P12Bytes
+		if len(certBytes) == 0 {
+			certfile = path.Join(s.workdir, fileName+"-signingcert.pem")
+			certBytes = profile.PEMBytes
+		}
 
 		log.Infof("extracting signing certificate %s to: '%s'", profile.CertificateSha1, certfile)
-		err = ioutil.WriteFile(certfile, profile.P12Bytes, 0644)
+		err = ioutil.WriteFile(certfile, certBytes, 0600)
 		if err != nil {
 			log.WithFields(log.Fields{"err": err}).Error("writing certificate failed")
 			return err
 		}
 
-		s.extractedFiles[i] = certAndEntitlement{certPath: certfile, certsha1: profile.CertificateSha1, entitlementPath: entitlementName}
+		s.extractedFiles[i] = certAndEntitlement{certPath: certfile, certsha1: profile.CertificateSha1, entitlementPath: entitlementName, password: profile.P12Password}
 
 	}
 	return nil
@@ -86,6 +147,7 @@ func (s *SigningWorkspace) PrepareProfiles(profilesDir string) error {
 
 //PrepareKeychain creates a new Keychain, unlocks it, disables the timeout
 //installs the certificates we found and adds the new keychain to the keychain search list.
+//Certificates shared by several profiles are installed once.
 func (s *SigningWorkspace) PrepareKeychain(keychainName string) error {
 	keychain := path.Join(s.workdir, keychainName)
 	err := codesign.CreateKeychain(keychain)
@@ -106,9 +168,18 @@ func (s *SigningWorkspace) PrepareKeychain(keychainName string) error {
 		return err
 	}
 
+	installed := map[string]bool{}
 	for _, cert := range s.extractedFiles {
+		if installed[cert.certsha1] {
+			continue
+		}
+		installed[cert.certsha1] = true
 		log.Infof("installing %s to keychain", cert.certPath)
-		err = codesign.AddX509CertificateToKeychain(keychain, cert.certPath, s.profilePassword)
+		if strings.HasSuffix(cert.certPath, ".pem") {
+			err = codesign.AddPEMToKeychain(keychain, cert.certPath)
+		} else {
+			err = codesign.AddX509CertificateToKeychain(keychain, cert.certPath, cert.password)
+		}
 		if err != nil {
 			log.WithFields(log.Fields{"err": err}).Error("installing cert failed")
 			return err
@@ -126,6 +197,9 @@ func (s *SigningWorkspace) PrepareKeychain(keychainName string) error {
 
 //Close removes the keychain that was created from the systems keychain search list
 func (s *SigningWorkspace) Close() {
+	if s.keychainPath == "" {
+		return
+	}
 	log.Infof("removing %s from keychain search list", s.keychainPath)
 	err := codesign.RemoveFromKeychainSearchList(s.keychainPath)
 	if err != nil {
@@ -133,6 +207,16 @@ func (s *SigningWorkspace) Close() {
 	}
 }
 
+//SelectProfiles ranks the workspace's profiles for signing the app with bundleID for the device udid,
+//see codesign.SelectProfiles. The candidates' Index can be passed to GetConfig.
+func (s *SigningWorkspace) SelectProfiles(udid string, bundleID string) codesign.ProfileSelection {
+	return codesign.SelectProfiles(udid, bundleID, s.profiles)
+}
+
+func (s *SigningWorkspace) selectProfiles(udids []string, bundleID string) codesign.ProfileSelection {
+	return codesign.SelectProfilesForDevices(udids, bundleID, s.profiles)
+}
+
 //GetConfig creates codesign.SigningConfig from the workspace's internal data
 func (s *SigningWorkspace) GetConfig(index int) codesign.SigningConfig {
 	return codesign.SigningConfig{
@@ -140,6 +224,8 @@ func (s *SigningWorkspace) GetConfig(index int) codesign.SigningConfig {
 		EntitlementsFilePath: s.extractedFiles[index].entitlementPath,
 		KeychainPath:         s.keychainPath,
 		ProfileBytes:         s.profiles[index].RawData,
+		SigningCert:          s.profiles[index].SigningCert,
+		PrivateKey:           s.profiles[index].PrivateKey,
 	}
 }
 
@@ -149,11 +235,9 @@ func (s *SigningWorkspace) TestSigning() error {
 
 	for i := 0; i < length; i++ {
 		config := s.GetConfig(i)
-		cmd := exec.Command("/usr/bin/codesign", "-vv", "--keychain", config.KeychainPath, "--deep", "--force", "--sign", config.CertSha1, path.Join(s.workdir, "sign", "test.txt"))
-		output, err := cmd.CombinedOutput()
+		err := codesign.SignFileWithKeychain(path.Join(s.workdir, "sign", "test.txt"), config)
 		if err != nil {
-			log.WithFields(
-				log.Fields{"cert": config.CertSha1, "error": err, "cmd": cmd, "output": string(output)}).Infof("codesign test signing failed")
+			log.WithFields(log.Fields{"cert": config.CertSha1, "error": err}).Infof("codesign test signing failed")
 			return err
 		}
 	}
@@ -1,12 +1,25 @@
 package api_test
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"io/ioutil"
+	"math/big"
 	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/danielpaulus/app-signer/api"
+	"github.com/danielpaulus/app-signer/codesign"
+	"github.com/fullsailor/pkcs7"
 	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"howett.net/plist"
 )
 
 func TestWorkspaceInit(t *testing.T) {
@@ -28,3 +41,92 @@ func makeWorkspaceWithoutProfiles() (api.SigningWorkspace, string, func()) {
 	}
 	return workspace, dir, cleanUp
 }
+
+func TestResignIPAForDevicesErrors(t *testing.T) {
+	workspace, dir, cleanUp := makeWorkspaceWithoutProfiles()
+	defer cleanUp()
+	_, err := api.ResignIPAForDevices(workspace, []string{" ", ""}, "app.ipa", dir, api.ResignOptions{})
+	assert.True(t, errors.Is(err, api.ErrMissingUDID))
+	_, err = api.ResignIPAForDevices(workspace, []string{"device1"}, "app.ipa", dir, api.ResignOptions{Entitlements: "all"})
+	assert.True(t, errors.Is(err, api.ErrInvalidOptions))
+	_, err = api.ResignIPAForDevices(workspace, []string{"device1", "device2"}, "app.ipa", dir, api.ResignOptions{BundleID: "com.acme.app"})
+	assert.True(t, errors.Is(err, api.ErrNoMatchingProfile))
+	assert.Contains(t, err.Error(), "'device1', 'device2'")
+}
+
+func TestPrepareProfilesWithSameName(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "resigner-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(workdir)
+	profilesDir, err := ioutil.TempDir("", "profiles")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(profilesDir)
+
+	block, _ := pem.Decode(readFixture(t, "leaf.pem"))
+	if !assert.NotNil(t, block) {
+		return
+	}
+	for _, uuid := range []string{"uuid-1", "uuid-2"} {
+		writeUnsignedProfile(t, path.Join(profilesDir, uuid+".mobileprovision"), codesign.MobileProvisioningProfile{
+			Name:                  "team",
+			UUID:                  uuid,
+			DeveloperCertificates: [][]byte{block.Bytes},
+			Entitlements:          map[string]interface{}{"application-identifier": "TEAMID." + uuid},
+		})
+	}
+	assert.NoError(t, ioutil.WriteFile(path.Join(profilesDir, "team.p12"), readFixture(t, "chain-aes.p12"), 0600))
+
+	workspace, err := api.NewSigningWorkspaceWithOptions(workdir, "test", api.WorkspaceOptions{SkipProfileVerification: true})
+	if !assert.NoError(t, err) || !assert.NoError(t, workspace.PrepareProfiles(profilesDir)) {
+		return
+	}
+	entitlements := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		data, err := ioutil.ReadFile(workspace.GetConfig(i).EntitlementsFilePath)
+		if assert.NoError(t, err) {
+			entitlements[string(data)] = true
+		}
+	}
+	assert.Len(t, entitlements, 2, "profiles with the same name must not overwrite each other's files")
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(path.Join("..", "codesign", "fixtures", "p12", name))
+	assert.NoError(t, err)
+	return data
+}
+
+//writeUnsignedProfile writes the profile in a PKCS#7 envelope signed by a throwaway key, so it only loads without
+//profile verification
+func writeUnsignedProfile(t *testing.T, profilePath string, profile codesign.MobileProvisioningProfile) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err) {
+		return
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test"}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if !assert.NoError(t, err) {
+		return
+	}
+	content, err := plist.Marshal(profile, plist.XMLFormat)
+	if !assert.NoError(t, err) {
+		return
+	}
+	signedData, err := pkcs7.NewSignedData(content)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, signedData.AddSigner(cert, key, pkcs7.SignerInfoConfig{}))
+	signed, err := signedData.Finish()
+	if assert.NoError(t, err) {
+		assert.NoError(t, ioutil.WriteFile(profilePath, signed, 0644))
+	}
+}
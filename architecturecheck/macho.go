@@ -0,0 +1,142 @@
+package architecturecheck
+
+import (
+	"debug/macho"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"howett.net/plist"
+)
+
+const executableKey = "CFBundleExecutable"
+const infoPlist = "Info.plist"
+
+//CpuArm6432 is the cpu type of arm64_32 slices used on Apple Watch. It is not defined in debug/macho.
+const CpuArm6432 macho.Cpu = 0x0200000c
+
+//cpuSubtypeMask removes the capability bits (like the pointer authentication ABI version
+//of arm64e binaries) from a cpu subtype so only the actual subtype remains.
+const cpuSubtypeMask = 0x00ffffff
+
+//Mach-O cpu subtypes we know a name for, see <mach/machine.h>
+const (
+	cpuSubtypeX86All   = 3
+	cpuSubtypeX86_64H  = 8
+	cpuSubtypeArmV6    = 6
+	cpuSubtypeArmV7    = 9
+	cpuSubtypeArmV7S   = 11
+	cpuSubtypeArmV7K   = 12
+	cpuSubtypeArm64All = 0
+	cpuSubtypeArm64V8  = 1
+	cpuSubtypeArm64E   = 2
+)
+
+//Architecture is a single slice of a Mach-O binary identified by its cpu type and subtype.
+type Architecture struct {
+	Cpu    macho.Cpu
+	SubCpu uint32
+}
+
+//String returns the architecture name the same way lipo and Xcode print it f.ex. "arm64" or "x86_64".
+//Unknown combinations are printed as "cputype/subtype".
+func (a Architecture) String() string {
+	subtype := a.SubCpu & cpuSubtypeMask
+	switch a.Cpu {
+	case macho.Cpu386:
+		return "i386"
+	case macho.CpuAmd64:
+		if subtype == cpuSubtypeX86_64H {
+			return "x86_64h"
+		}
+		return "x86_64"
+	case macho.CpuArm:
+		switch subtype {
+		case cpuSubtypeArmV6:
+			return "armv6"
+		case cpuSubtypeArmV7:
+			return "armv7"
+		case cpuSubtypeArmV7S:
+			return "armv7s"
+		case cpuSubtypeArmV7K:
+			return "armv7k"
+		}
+	case macho.CpuArm64:
+		switch subtype {
+		case cpuSubtypeArm64All, cpuSubtypeArm64V8:
+			return "arm64"
+		case cpuSubtypeArm64E:
+			return "arm64e"
+		}
+	case CpuArm6432:
+		return "arm64_32"
+	}
+	return fmt.Sprintf("%d/%d", a.Cpu, subtype)
+}
+
+//IsSimulatorApp returns true if one of the architectures equals "x86_64".
+//It returns false otherwise.
+func IsSimulatorApp(architectures []string) bool {
+	for _, arch := range architectures {
+		if arch == "x86_64" {
+			return true
+		}
+	}
+	return false
+}
+
+//ExtractArchitectures takes a directory where it can find a Info.plist and an executable file to check.
+//Usually that will be the .app folder.
+//It will parse the Info.plist to find the executable file and read the architectures from its Mach-O headers.
+//It returns an string array with the parsed architecture names contained.
+func ExtractArchitectures(binDir string) ([]string, error) {
+	architectures, err := ExtractArchitectureTypes(binDir)
+	if err != nil {
+		return []string{}, err
+	}
+	names := make([]string, len(architectures))
+	for i, arch := range architectures {
+		names[i] = arch.String()
+	}
+	return names, nil
+}
+
+//ExtractArchitectureTypes works like ExtractArchitectures but returns the cpu type and subtype
+//of every slice of the main executable instead of their names.
+func ExtractArchitectureTypes(binDir string) ([]Architecture, error) {
+	binFile, err := getExecutable(binDir)
+	if err != nil {
+		return []Architecture{}, err
+	}
+	return ReadArchitectures(path.Join(binDir, binFile))
+}
+
+//ReadArchitectures parses the thin or universal Mach-O binary at binaryPath and returns
+//the architecture of each contained slice in file order.
+func ReadArchitectures(binaryPath string) ([]Architecture, error) {
+	slices, err := ReadSlices(binaryPath)
+	if err != nil {
+		return []Architecture{}, err
+	}
+	architectures := make([]Architecture, len(slices))
+	for i, slice := range slices {
+		architectures[i] = slice.Architecture
+	}
+	return architectures, nil
+}
+
+func getExecutable(binDir string) (string, error) {
+	plistBytes, err := ioutil.ReadFile(path.Join(binDir, infoPlist))
+	if err != nil {
+		return "", err
+	}
+	var data map[string]interface{}
+	_, err = plist.Unmarshal(plistBytes, &data)
+	if err != nil {
+		return "", err
+	}
+	if val, ok := data[executableKey]; ok {
+		return val.(string), nil
+	}
+	return "", fmt.Errorf("%s not in Info.plist: %+v", executableKey, data)
+}
@@ -0,0 +1,153 @@
+package architecturecheck_test
+
+import (
+	"bytes"
+	"debug/macho"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/danielpaulus/app-signer/architecturecheck"
+	"github.com/danielpaulus/app-signer/codesign"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPhysicalDevice(t *testing.T) {
+	ipa := readBytes("fixtures/wda.ipa")
+
+	readerAt := bytes.NewReader(ipa)
+	_, directory, err := codesign.ExtractZip(readerAt, int64(len(ipa)))
+	if err != nil {
+		log.Fatalf("failed extracting: %+v", err)
+	}
+	defer os.RemoveAll(directory)
+	appdir, _ := codesign.FindAppFolder(directory)
+
+	extractedArchs, err := architecturecheck.ExtractArchitectures(appdir)
+
+	assert.NoError(t, err)
+	assert.NotContains(t, extractedArchs, "x86_64")
+	assert.False(t, architecturecheck.IsSimulatorApp(extractedArchs))
+
+	slices, err := architecturecheck.ExtractSlices(appdir)
+	assert.NoError(t, err)
+	assert.False(t, architecturecheck.IsSimulatorBuild(slices))
+}
+
+func TestVirtualDevice(t *testing.T) {
+	ipa := readBytes("fixtures/simulator-app.zip")
+
+	readerAt := bytes.NewReader(ipa)
+	_, directory, err := codesign.ExtractZip(readerAt, int64(len(ipa)))
+	if err != nil {
+		log.Fatalf("failed extracting: %+v", err)
+	}
+	defer os.RemoveAll(directory)
+	appdir, _ := FindAppFolderVirtualDevice(directory)
+
+	extractedArchs, err := architecturecheck.ExtractArchitectures(appdir)
+
+	assert.NoError(t, err)
+	assert.Contains(t, extractedArchs, "x86_64")
+	assert.True(t, architecturecheck.IsSimulatorApp(extractedArchs))
+}
+
+func TestVirtualDeviceArchitectureTypes(t *testing.T) {
+	ipa := readBytes("fixtures/simulator-app.zip")
+
+	readerAt := bytes.NewReader(ipa)
+	_, directory, err := codesign.ExtractZip(readerAt, int64(len(ipa)))
+	if err != nil {
+		log.Fatalf("failed extracting: %+v", err)
+	}
+	defer os.RemoveAll(directory)
+	appdir, _ := FindAppFolderVirtualDevice(directory)
+
+	architectures, err := architecturecheck.ExtractArchitectureTypes(appdir)
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, []architecturecheck.Architecture{
+			{Cpu: macho.CpuAmd64, SubCpu: 3},
+			{Cpu: macho.CpuArm64, SubCpu: 0},
+		}, architectures)
+	}
+}
+
+func TestVirtualDevicePlatforms(t *testing.T) {
+	ipa := readBytes("fixtures/simulator-app.zip")
+
+	readerAt := bytes.NewReader(ipa)
+	_, directory, err := codesign.ExtractZip(readerAt, int64(len(ipa)))
+	if err != nil {
+		log.Fatalf("failed extracting: %+v", err)
+	}
+	defer os.RemoveAll(directory)
+	appdir, _ := FindAppFolderVirtualDevice(directory)
+
+	slices, err := architecturecheck.ExtractSlices(appdir)
+
+	if assert.NoError(t, err) && assert.Equal(t, 2, len(slices)) {
+		//the arm64 slice is the one built on Apple Silicon, lipo alone would not reveal it is a simulator build
+		assert.Equal(t, "arm64", slices[1].Architecture.String())
+		assert.Equal(t, architecturecheck.PlatformIOSSimulator, slices[1].Platform)
+		assert.True(t, architecturecheck.IsSimulatorBuild(slices[1:]))
+	}
+}
+
+func TestPlatformClassification(t *testing.T) {
+	device := []architecturecheck.BinarySlice{{Architecture: architecturecheck.Architecture{Cpu: macho.CpuArm64}, Platform: architecturecheck.PlatformIOS}}
+	assert.False(t, architecturecheck.IsSimulatorBuild(device))
+	assert.Equal(t, "arm64 (iOS)", device[0].String())
+
+	for _, platform := range []architecturecheck.Platform{architecturecheck.PlatformIOSSimulator, architecturecheck.PlatformTvOSSimulator, architecturecheck.PlatformWatchOSSimulator} {
+		assert.True(t, platform.IsSimulator())
+	}
+	for _, platform := range []architecturecheck.Platform{architecturecheck.PlatformIOS, architecturecheck.PlatformTvOS, architecturecheck.PlatformWatchOS, architecturecheck.PlatformMacCatalyst} {
+		assert.False(t, platform.IsSimulator())
+	}
+}
+
+func TestArchitectureNames(t *testing.T) {
+	testCases := map[string]architecturecheck.Architecture{
+		"arm64":    {Cpu: macho.CpuArm64, SubCpu: 0},
+		"arm64e":   {Cpu: macho.CpuArm64, SubCpu: 0x80000002},
+		"armv7":    {Cpu: macho.CpuArm, SubCpu: 9},
+		"armv7s":   {Cpu: macho.CpuArm, SubCpu: 11},
+		"x86_64":   {Cpu: macho.CpuAmd64, SubCpu: 3},
+		"i386":     {Cpu: macho.Cpu386, SubCpu: 3},
+		"arm64_32": {Cpu: architecturecheck.CpuArm6432, SubCpu: 1},
+	}
+	for name, arch := range testCases {
+		assert.Equal(t, name, arch.String())
+	}
+}
+
+//FindAppFolderVirtualDevice returns the path of the *.app directory
+//which must be in the root of the unzipped file.
+//or an error if there is no .app directory or more than one.
+func FindAppFolderVirtualDevice(rootDir string) (string, error) {
+	appFolders, err := filepath.Glob(path.Join(rootDir, "*.app"))
+	if err != nil {
+		return "", err
+	}
+	if len(appFolders) != 1 {
+		return "", fmt.Errorf("found more or less than exactly one app folder: %+v", appFolders)
+	}
+	return appFolders[0], nil
+}
+
+func readBytes(name string) []byte {
+	file, err := os.Open(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return data
+}
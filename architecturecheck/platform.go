@@ -0,0 +1,155 @@
+package architecturecheck
+
+import (
+	"debug/macho"
+	"fmt"
+	"path"
+)
+
+//Platform is the value of the platform field of a LC_BUILD_VERSION load command, see <mach-o/loader.h>
+type Platform uint32
+
+//All platforms a Mach-O binary can be built for. PlatformUnknown is used if a binary has
+//neither a LC_BUILD_VERSION nor a LC_VERSION_MIN_* load command.
+const (
+	PlatformUnknown           Platform = 0
+	PlatformMacOS             Platform = 1
+	PlatformIOS               Platform = 2
+	PlatformTvOS              Platform = 3
+	PlatformWatchOS           Platform = 4
+	PlatformBridgeOS          Platform = 5
+	PlatformMacCatalyst       Platform = 6
+	PlatformIOSSimulator      Platform = 7
+	PlatformTvOSSimulator     Platform = 8
+	PlatformWatchOSSimulator  Platform = 9
+	PlatformDriverKit         Platform = 10
+	PlatformVisionOS          Platform = 11
+	PlatformVisionOSSimulator Platform = 12
+)
+
+//load commands used to find out the platform of a binary
+const (
+	lcVersionMinMacOS    macho.LoadCmd = 0x24
+	lcVersionMinIPhoneOS macho.LoadCmd = 0x25
+	lcVersionMinTvOS     macho.LoadCmd = 0x2f
+	lcVersionMinWatchOS  macho.LoadCmd = 0x30
+	lcBuildVersion       macho.LoadCmd = 0x32
+)
+
+var platformNames = map[Platform]string{
+	PlatformUnknown:           "unknown",
+	PlatformMacOS:             "macOS",
+	PlatformIOS:               "iOS",
+	PlatformTvOS:              "tvOS",
+	PlatformWatchOS:           "watchOS",
+	PlatformBridgeOS:          "bridgeOS",
+	PlatformMacCatalyst:       "Mac Catalyst",
+	PlatformIOSSimulator:      "iOS Simulator",
+	PlatformTvOSSimulator:     "tvOS Simulator",
+	PlatformWatchOSSimulator:  "watchOS Simulator",
+	PlatformDriverKit:         "DriverKit",
+	PlatformVisionOS:          "visionOS",
+	PlatformVisionOSSimulator: "visionOS Simulator",
+}
+
+func (p Platform) String() string {
+	if name, ok := platformNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("platform(%d)", uint32(p))
+}
+
+//IsSimulator returns true for all simulator platforms.
+func (p Platform) IsSimulator() bool {
+	return p == PlatformIOSSimulator || p == PlatformTvOSSimulator || p == PlatformWatchOSSimulator || p == PlatformVisionOSSimulator
+}
+
+//BinarySlice is one architecture contained in a Mach-O binary together with
+//the platform it was built for.
+type BinarySlice struct {
+	Architecture Architecture
+	Platform     Platform
+}
+
+func (s BinarySlice) String() string {
+	return fmt.Sprintf("%s (%s)", s.Architecture, s.Platform)
+}
+
+//IsSimulatorBuild returns true if any of the slices was built for a simulator platform.
+//Unlike IsSimulatorApp this also detects arm64 simulator builds made on Apple Silicon Macs.
+func IsSimulatorBuild(slices []BinarySlice) bool {
+	for _, slice := range slices {
+		if slice.Platform.IsSimulator() {
+			return true
+		}
+	}
+	return false
+}
+
+//ExtractSlices parses the Info.plist in binDir to find the main executable and
+//returns architecture and platform of each of its slices.
+func ExtractSlices(binDir string) ([]BinarySlice, error) {
+	binFile, err := getExecutable(binDir)
+	if err != nil {
+		return []BinarySlice{}, err
+	}
+	return ReadSlices(path.Join(binDir, binFile))
+}
+
+//ReadSlices parses the thin or universal Mach-O binary at binaryPath and classifies each slice
+//by its LC_BUILD_VERSION or LC_VERSION_MIN_* load command.
+func ReadSlices(binaryPath string) ([]BinarySlice, error) {
+	fat, err := macho.OpenFat(binaryPath)
+	if err == nil {
+		defer fat.Close()
+		slices := make([]BinarySlice, len(fat.Arches))
+		for i, arch := range fat.Arches {
+			slices[i] = classifySlice(arch.File)
+		}
+		return slices, nil
+	}
+	if err != macho.ErrNotFat {
+		return []BinarySlice{}, fmt.Errorf("failed parsing universal binary %s: %w", binaryPath, err)
+	}
+	thin, err := macho.Open(binaryPath)
+	if err != nil {
+		return []BinarySlice{}, fmt.Errorf("failed parsing mach-o binary %s: %w", binaryPath, err)
+	}
+	defer thin.Close()
+	return []BinarySlice{classifySlice(thin)}, nil
+}
+
+func classifySlice(file *macho.File) BinarySlice {
+	slice := BinarySlice{Architecture: Architecture{Cpu: file.Cpu, SubCpu: file.SubCpu}}
+	for _, load := range file.Loads {
+		raw := load.Raw()
+		if len(raw) < 8 {
+			continue
+		}
+		switch macho.LoadCmd(file.ByteOrder.Uint32(raw)) {
+		case lcBuildVersion:
+			if len(raw) >= 12 {
+				slice.Platform = Platform(file.ByteOrder.Uint32(raw[8:]))
+				return slice
+			}
+		case lcVersionMinMacOS:
+			slice.Platform = PlatformMacOS
+		case lcVersionMinIPhoneOS:
+			slice.Platform = simulatorOnIntel(file.Cpu, PlatformIOS, PlatformIOSSimulator)
+		case lcVersionMinTvOS:
+			slice.Platform = simulatorOnIntel(file.Cpu, PlatformTvOS, PlatformTvOSSimulator)
+		case lcVersionMinWatchOS:
+			slice.Platform = simulatorOnIntel(file.Cpu, PlatformWatchOS, PlatformWatchOSSimulator)
+		}
+	}
+	return slice
+}
+
+//simulatorOnIntel is needed for old binaries which only have LC_VERSION_MIN_* load commands.
+//Those do not distinguish between device and simulator, but back then simulators always ran on intel.
+func simulatorOnIntel(cpu macho.Cpu, device Platform, simulator Platform) Platform {
+	if cpu == macho.CpuAmd64 || cpu == macho.Cpu386 {
+		return simulator
+	}
+	return device
+}
@@ -0,0 +1,154 @@
+package codesign
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"howett.net/plist"
+)
+
+//Info.plist keys that reference the bundle identifier of another bundle in the same app.
+//Watch apps point to their iOS app with WKCompanionAppBundleIdentifier, WatchKit extensions to their
+//watch app with NSExtension/NSExtensionAttributes/WKAppBundleIdentifier.
+const (
+	companionAppBundleIdentifierKey = "WKCompanionAppBundleIdentifier"
+	extensionKey                    = "NSExtension"
+)
+
+//SetBundleIdentifier changes the CFBundleIdentifier in the Info.plist of the bundle at bundlePath.
+//The plist keeps its binary or XML format.
+func SetBundleIdentifier(bundlePath string, identifier string) error {
+	return updateInfoPlist(bundlePath, func(info map[string]interface{}) {
+		info[bundleIdentifierKey] = identifier
+	})
+}
+
+//RewriteBundleIdentifiers gives the app at appPath the new bundle identifier. All nested .app, .appex and .xctest
+//bundles with identifiers starting with the app's old identifier get the new one as prefix instead and keep their
+//suffix, so com.old.app.widget becomes com.new.app.widget. References to changed identifiers in
+//WKCompanionAppBundleIdentifier and the NSExtension dictionary are updated as well.
+//It returns all changed identifiers, mapping old to new ones.
+func RewriteBundleIdentifiers(appPath string, newIdentifier string) (map[string]string, error) {
+	oldIdentifier, err := GetBundleIdentifier(appPath)
+	if err != nil {
+		return nil, err
+	}
+	bundles, err := findNestedBundles(appPath)
+	if err != nil {
+		return nil, err
+	}
+	bundles = append([]string{appPath}, bundles...)
+
+	changes := map[string]string{}
+	for _, bundle := range bundles {
+		identifier, err := GetBundleIdentifier(bundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading bundle identifier of %s: %w", bundle, err)
+		}
+		if rewritten, ok := replaceIdentifierPrefix(identifier, oldIdentifier, newIdentifier); ok {
+			changes[identifier] = rewritten
+		}
+	}
+
+	for _, bundle := range bundles {
+		err := updateInfoPlist(bundle, func(info map[string]interface{}) {
+			for key, value := range info {
+				switch key {
+				case bundleIdentifierKey, companionAppBundleIdentifierKey:
+					if rewritten, ok := changes[fmt.Sprint(value)]; ok {
+						info[key] = rewritten
+					}
+				case extensionKey:
+					info[key] = replaceIdentifiers(value, changes)
+				}
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed updating Info.plist of %s: %w", bundle, err)
+		}
+	}
+	log.WithFields(log.Fields{"app": appPath, "identifiers": changes}).Info("rewrote bundle identifiers")
+	return changes, nil
+}
+
+//findNestedBundles returns all .app, .appex and .xctest directories below appPath
+func findNestedBundles(appPath string) ([]string, error) {
+	files, err := GetFiles(appPath)
+	if err != nil {
+		return nil, err
+	}
+	bundles := []string{}
+	for _, file := range files {
+		if !isDirWithApp(file) {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil && info.IsDir() {
+			bundles = append(bundles, file)
+		}
+	}
+	return bundles, nil
+}
+
+//RewrittenBundleIdentifier returns the identifier a bundle with identifier gets from RewriteBundleIdentifiers when
+//the app's identifier changes from oldIdentifier to newIdentifier.
+func RewrittenBundleIdentifier(identifier string, oldIdentifier string, newIdentifier string) string {
+	rewritten, _ := replaceIdentifierPrefix(identifier, oldIdentifier, newIdentifier)
+	return rewritten
+}
+
+func replaceIdentifierPrefix(identifier string, oldPrefix string, newPrefix string) (string, bool) {
+	if identifier == oldPrefix {
+		return newPrefix, true
+	}
+	if strings.HasPrefix(identifier, oldPrefix+".") {
+		return newPrefix + strings.TrimPrefix(identifier, oldPrefix), true
+	}
+	return identifier, false
+}
+
+//replaceIdentifiers replaces all strings in the plist value that are a changed identifier
+func replaceIdentifiers(value interface{}, changes map[string]string) interface{} {
+	switch v := value.(type) {
+	case string:
+		if rewritten, ok := changes[v]; ok {
+			return rewritten
+		}
+	case map[string]interface{}:
+		for key, element := range v {
+			v[key] = replaceIdentifiers(element, changes)
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = replaceIdentifiers(element, changes)
+		}
+	}
+	return value
+}
+
+func updateInfoPlist(bundlePath string, update func(info map[string]interface{})) error {
+	plistPath := path.Join(bundlePath, infoPlist)
+	plistBytes, err := ioutil.ReadFile(plistPath)
+	if err != nil {
+		return err
+	}
+	var info map[string]interface{}
+	format, err := plist.Unmarshal(plistBytes, &info)
+	if err != nil {
+		return err
+	}
+	update(info)
+	var updated []byte
+	if format == plist.BinaryFormat {
+		updated, err = plist.Marshal(info, plist.BinaryFormat)
+	} else {
+		updated, err = plist.MarshalIndent(info, format, "\t")
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(plistPath, updated, 0644)
+}
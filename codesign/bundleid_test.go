@@ -0,0 +1,93 @@
+package codesign_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/danielpaulus/app-signer/codesign"
+	"github.com/stretchr/testify/assert"
+	"howett.net/plist"
+)
+
+func TestRewriteBundleIdentifiers(t *testing.T) {
+	appdir, cleanup := extractSimulatorApp()
+	defer cleanup()
+	watchApp := path.Join(appdir, "Watch", "bla WatchKit App.app")
+	watchExtension := path.Join(watchApp, "PlugIns", "bla WatchKit Extension.appex")
+	widget := path.Join(appdir, "PlugIns", "widget.appex")
+	unrelated := path.Join(appdir, "PlugIns", "unrelated.appex")
+	framework := path.Join(appdir, "Frameworks", "bla.framework")
+	writeInfoPlist(t, watchApp, map[string]interface{}{
+		"CFBundleIdentifier":             "d.bla.watchkitapp",
+		"WKCompanionAppBundleIdentifier": "d.bla",
+	})
+	writeInfoPlist(t, watchExtension, map[string]interface{}{
+		"CFBundleIdentifier": "d.bla.watchkitapp.watchkitextension",
+		"NSExtension": map[string]interface{}{
+			"NSExtensionAttributes":      map[string]interface{}{"WKAppBundleIdentifier": "d.bla.watchkitapp"},
+			"NSExtensionPointIdentifier": "com.apple.watchkit",
+		},
+	})
+	writeInfoPlist(t, widget, map[string]interface{}{"CFBundleIdentifier": "d.bla.widget"})
+	writeInfoPlist(t, unrelated, map[string]interface{}{"CFBundleIdentifier": "d.blabla"})
+	writeInfoPlist(t, framework, map[string]interface{}{"CFBundleIdentifier": "d.bla.framework"})
+
+	changes, err := codesign.RewriteBundleIdentifiers(appdir, "com.new.app")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]string{
+		"d.bla":                               "com.new.app",
+		"d.bla.watchkitapp":                   "com.new.app.watchkitapp",
+		"d.bla.watchkitapp.watchkitextension": "com.new.app.watchkitapp.watchkitextension",
+		"d.bla.widget":                        "com.new.app.widget",
+	}, changes)
+
+	assertIdentifier(t, appdir, "com.new.app")
+	assertIdentifier(t, widget, "com.new.app.widget")
+	assertIdentifier(t, unrelated, "d.blabla")
+	assertIdentifier(t, framework, "d.bla.framework")
+	watchInfo := readInfoPlist(t, watchApp)
+	assert.Equal(t, "com.new.app", watchInfo["WKCompanionAppBundleIdentifier"])
+	extensionInfo := readInfoPlist(t, watchExtension)
+	assert.Equal(t, "com.new.app.watchkitapp.watchkitextension", extensionInfo["CFBundleIdentifier"])
+	assert.Equal(t, map[string]interface{}{
+		"NSExtensionAttributes":      map[string]interface{}{"WKAppBundleIdentifier": "com.new.app.watchkitapp"},
+		"NSExtensionPointIdentifier": "com.apple.watchkit",
+	}, extensionInfo["NSExtension"])
+
+	//the fixture's Info.plist is binary and must stay binary
+	var info map[string]interface{}
+	format, err := plist.Unmarshal(readBytes(path.Join(appdir, "Info.plist")), &info)
+	assert.NoError(t, err)
+	assert.Equal(t, plist.BinaryFormat, format)
+	assert.Equal(t, "bla", info["CFBundleExecutable"])
+}
+
+func TestRewrittenBundleIdentifier(t *testing.T) {
+	assert.Equal(t, "com.new.app", codesign.RewrittenBundleIdentifier("com.old.app", "com.old.app", "com.new.app"))
+	assert.Equal(t, "com.new.app.widget", codesign.RewrittenBundleIdentifier("com.old.app.widget", "com.old.app", "com.new.app"))
+	assert.Equal(t, "com.old.apps", codesign.RewrittenBundleIdentifier("com.old.apps", "com.old.app", "com.new.app"))
+}
+
+func assertIdentifier(t *testing.T, bundle string, expected string) {
+	identifier, err := codesign.GetBundleIdentifier(bundle)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, identifier)
+}
+
+func writeInfoPlist(t *testing.T, bundle string, info map[string]interface{}) {
+	assert.NoError(t, os.MkdirAll(bundle, 0755))
+	data, err := plist.MarshalIndent(info, plist.XMLFormat, "\t")
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path.Join(bundle, "Info.plist"), data, 0644))
+}
+
+func readInfoPlist(t *testing.T, bundle string) map[string]interface{} {
+	var info map[string]interface{}
+	_, err := plist.Unmarshal(readBytes(path.Join(bundle, "Info.plist")), &info)
+	assert.NoError(t, err)
+	return info
+}
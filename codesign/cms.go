@@ -0,0 +1,194 @@
+package codesign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"howett.net/plist"
+)
+
+//The pkcs7 package can only create SHA-1 signatures, code signatures need SHA-256 and
+//Apple specific signed attributes, so the CMS structure is assembled here.
+var (
+	oidData                   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidAttributeContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttributeMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttributeSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidAppleCDHashes          = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 9, 1}
+	oidAppleCDHashes2         = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 9, 2}
+	oidSHA1                   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256                 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256        = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type cmsEncapsulatedContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsEncapsulatedContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsIssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	Sid                cmsIssuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttributes   asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type cmsHashAgilityValue struct {
+	Algorithm asn1.ObjectIdentifier
+	Digest    []byte
+}
+
+//buildCMSSignature creates the detached CMS signature over the first CodeDirectory like codesign does.
+//The signed attributes contain the cdhashes of all CodeDirectories so the alternate ones are protected as well.
+func buildCMSSignature(codeDirectories [][]byte, hashTypes []uint8, cert *x509.Certificate, key crypto.Signer, chain []*x509.Certificate, signingTime time.Time) ([]byte, error) {
+	cdhashes := make([][]byte, len(codeDirectories))
+	hashAgility := &bytes.Buffer{}
+	for i, cd := range codeDirectories {
+		full, ok := hashBytes(hashTypes[i], cd)
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash type %d", hashTypes[i])
+		}
+		cdhashes[i] = full[:20]
+		algorithm := oidSHA256
+		if hashTypes[i] == csHashTypeSha1 {
+			algorithm = oidSHA1
+		}
+		encoded, err := asn1.Marshal(cmsHashAgilityValue{Algorithm: algorithm, Digest: full})
+		if err != nil {
+			return nil, err
+		}
+		hashAgility.Write(encoded)
+	}
+	cdhashesPlist, err := plist.MarshalIndent(map[string]interface{}{"cdhashes": cdhashes}, plist.XMLFormat, "\t")
+	if err != nil {
+		return nil, err
+	}
+	messageDigest := sha256.Sum256(codeDirectories[0])
+
+	attributes := [][]byte{}
+	for _, attr := range []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidAttributeContentType, oidData},
+		{oidAttributeSigningTime, signingTime.UTC()},
+		{oidAttributeMessageDigest, messageDigest[:]},
+		{oidAppleCDHashes, cdhashesPlist},
+	} {
+		value, err := asn1.Marshal(attr.value)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := marshalCMSAttribute(attr.oid, value)
+		if err != nil {
+			return nil, err
+		}
+		attributes = append(attributes, encoded)
+	}
+	encoded, err := marshalCMSAttribute(oidAppleCDHashes2, hashAgility.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	attributes = append(attributes, encoded)
+	//DER requires the elements of a SET OF to be sorted by their encoding
+	sort.Slice(attributes, func(i, j int) bool { return bytes.Compare(attributes[i], attributes[j]) < 0 })
+	attributeSet := bytes.Join(attributes, nil)
+
+	toBeSigned, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: attributeSet})
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(toBeSigned)
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed signing CodeDirectory: %w", err)
+	}
+	signatureAlgorithm, err := cmsSignatureAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	certificates := &bytes.Buffer{}
+	certificates.Write(cert.Raw)
+	for _, c := range chain {
+		certificates.Write(c.Raw)
+	}
+
+	sha256Algorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	signedData := cmsSignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm},
+		EncapContentInfo: cmsEncapsulatedContentInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certificates.Bytes()},
+		SignerInfos: []cmsSignerInfo{{
+			Version:            1,
+			Sid:                cmsIssuerAndSerial{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, SerialNumber: cert.SerialNumber},
+			DigestAlgorithm:    sha256Algorithm,
+			SignedAttributes:   asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attributeSet},
+			SignatureAlgorithm: signatureAlgorithm,
+			Signature:          signature,
+		}},
+	}
+	inner, err := asn1.Marshal(signedData)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(cmsContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner},
+	})
+}
+
+func marshalCMSAttribute(oid asn1.ObjectIdentifier, values []byte) ([]byte, error) {
+	return asn1.Marshal(cmsAttribute{
+		Type:   oid,
+		Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: values},
+	})
+}
+
+func cmsSignatureAlgorithm(key crypto.Signer) (pkix.AlgorithmIdentifier, error) {
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}, nil
+	case *ecdsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, nil
+	}
+	return pkix.AlgorithmIdentifier{}, fmt.Errorf("unsupported private key type %T", key.Public())
+}
@@ -0,0 +1,353 @@
+package codesign
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//CodeSignatureDir is the directory inside every signed bundle that contains CodeResources
+const CodeSignatureDir = "_CodeSignature"
+
+//CodeResourcesFile is the name of the resource seal inside CodeSignatureDir
+const CodeResourcesFile = "CodeResources"
+
+//ResourceRule is one entry of the rules and rules2 dictionaries of a CodeResources file.
+//For every file the matching rule with the highest weight decides if it is omitted, optional
+//or, in case of rules2, sealed as nested code with its cdhash and designated requirement.
+//A rule without any flags and weight is written as a plain 'true'.
+type ResourceRule struct {
+	Pattern  string
+	Omit     bool
+	Optional bool
+	Nested   bool
+	Weight   float64
+}
+
+//DefaultResourceRules are the legacy rules codesign uses for iOS bundles
+var DefaultResourceRules = []ResourceRule{
+	{Pattern: `^.*`},
+	{Pattern: `^.*\.lproj/`, Optional: true, Weight: 1000},
+	{Pattern: `^.*\.lproj/locversion.plist$`, Omit: true, Weight: 1100},
+	{Pattern: `^Base\.lproj/`, Weight: 1010},
+	{Pattern: `^version.plist$`},
+}
+
+//DefaultResourceRules2 are the rules2 codesign uses for iOS bundles
+var DefaultResourceRules2 = []ResourceRule{
+	{Pattern: `.*\.dSYM($|/)`, Weight: 11},
+	{Pattern: `^(.*/)?\.DS_Store$`, Omit: true, Weight: 2000},
+	{Pattern: `^.*`},
+	{Pattern: `^.*\.lproj/`, Optional: true, Weight: 1000},
+	{Pattern: `^.*\.lproj/locversion.plist$`, Omit: true, Weight: 1100},
+	{Pattern: `^Base\.lproj/`, Weight: 1010},
+	{Pattern: `^Info\.plist$`, Omit: true, Weight: 20},
+	{Pattern: `^PkgInfo$`, Omit: true, Weight: 20},
+	{Pattern: `^embedded\.provisionprofile$`, Weight: 20},
+	{Pattern: `^version\.plist$`, Weight: 20},
+}
+
+//NestedCode is what CodeResources records about a signed bundle or binary inside of another bundle.
+type NestedCode struct {
+	CDHash      []byte
+	Requirement string
+}
+
+//CodeResourcesOptions configures GenerateCodeResources. Empty Rules and Rules2 mean the iOS defaults.
+//Nested code that is signed with Certificate gets the designated requirement codesign would
+//create for it, other nested code is pinned by its cdhash.
+type CodeResourcesOptions struct {
+	Rules       []ResourceRule
+	Rules2      []ResourceRule
+	Certificate *x509.Certificate
+}
+
+type compiledRule struct {
+	ResourceRule
+	regexp *regexp.Regexp
+}
+
+//GenerateCodeResources walks the .app, .appex or .framework at bundlePath and creates the
+//_CodeSignature/CodeResources plist sealing all of its resources, byte compatible with the one codesign writes.
+//The main executable and the _CodeSignature directory itself are not part of the seal.
+func GenerateCodeResources(bundlePath string, options CodeResourcesOptions) ([]byte, error) {
+	if len(options.Rules) == 0 {
+		options.Rules = DefaultResourceRules
+	}
+	if len(options.Rules2) == 0 {
+		options.Rules2 = DefaultResourceRules2
+	}
+	rules, err := compileRules(options.Rules)
+	if err != nil {
+		return nil, err
+	}
+	rules2, err := compileRules(options.Rules2)
+	if err != nil {
+		return nil, err
+	}
+	excluded := map[string]bool{path.Join(bundlePath, CodeSignatureDir): true}
+	if executable, err := getBundleExecutable(bundlePath); err == nil {
+		excluded[path.Join(bundlePath, executable)] = true
+	}
+
+	allFiles, err := GetFiles(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]interface{}{}
+	files2 := map[string]interface{}{}
+	nestedDirs := []string{}
+	for _, file := range allFiles {
+		if isExcluded(file, excluded) {
+			continue
+		}
+		relative := strings.TrimPrefix(file, bundlePath+"/")
+		info, err := os.Lstat(file)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			continue
+		}
+		if err := addResourceV1(files, file, relative, info, rules); err != nil {
+			return nil, err
+		}
+		if isInside(file, nestedDirs) {
+			continue
+		}
+		rule, ok := matchRule(relative, rules2)
+		if !ok || rule.Omit {
+			continue
+		}
+		if rule.Nested {
+			nestedRoot, nestedRelative := nestedCodeRoot(bundlePath, relative)
+			if _, done := files2[nestedRelative]; done {
+				continue
+			}
+			nested, err := readNestedCode(nestedRoot, options.Certificate)
+			if err != nil {
+				return nil, err
+			}
+			files2[nestedRelative] = map[string]interface{}{"cdhash": nested.CDHash, "requirement": nested.Requirement}
+			if nestedRoot != file {
+				nestedDirs = append(nestedDirs, nestedRoot)
+			}
+			continue
+		}
+		entry, err := resourceEntryV2(file, info)
+		if err != nil {
+			return nil, err
+		}
+		if rule.Optional {
+			entry["optional"] = true
+		}
+		files2[relative] = entry
+	}
+
+	return marshalApplePlist(map[string]interface{}{
+		"files":  files,
+		"files2": files2,
+		"rules":  rulesToPlist(options.Rules),
+		"rules2": rulesToPlist(options.Rules2),
+	})
+}
+
+//WriteCodeResources generates the CodeResources for bundlePath, stores it in the bundle's
+//_CodeSignature directory and returns its contents so they can be hashed into the signature.
+func WriteCodeResources(bundlePath string, options CodeResourcesOptions) ([]byte, error) {
+	codeResources, err := GenerateCodeResources(bundlePath, options)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(path.Join(bundlePath, CodeSignatureDir), 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(path.Join(bundlePath, CodeSignatureDir, CodeResourcesFile), codeResources, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return codeResources, nil
+}
+
+func addResourceV1(files map[string]interface{}, file string, relative string, info os.FileInfo, rules []compiledRule) error {
+	//the legacy format has no way to represent symlinks
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	rule, ok := matchRule(relative, rules)
+	if !ok || rule.Omit {
+		return nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	hash := sha1.Sum(data)
+	if rule.Optional {
+		files[relative] = map[string]interface{}{"hash": hash[:], "optional": true}
+		return nil
+	}
+	files[relative] = hash[:]
+	return nil
+}
+
+func resourceEntryV2(file string, info os.FileInfo) (map[string]interface{}, error) {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(file)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"symlink": target}, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	return map[string]interface{}{"hash2": hash[:]}, nil
+}
+
+//nestedCodeRoot returns the outermost bundle directory containing relative, or the file itself if it
+//is not inside of a bundle, like a dylib in Frameworks.
+func nestedCodeRoot(bundlePath string, relative string) (string, string) {
+	parts := strings.Split(relative, "/")
+	for i := range parts[:len(parts)-1] {
+		if isBundleDirName(parts[i]) {
+			nestedRelative := strings.Join(parts[:i+1], "/")
+			return path.Join(bundlePath, nestedRelative), nestedRelative
+		}
+	}
+	return path.Join(bundlePath, relative), relative
+}
+
+func isBundleDirName(name string) bool {
+	for _, suffix := range []string{appSuffix, appExtensionSuffix, xctestSuffix, frameworkSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+//readNestedCode gets the cdhash from the embedded signature of a nested binary or the main executable
+//of a nested bundle.
+func readNestedCode(nestedPath string, cert *x509.Certificate) (NestedCode, error) {
+	binaryPath := nestedPath
+	if info, err := os.Stat(nestedPath); err == nil && info.IsDir() {
+		executable, err := getBundleExecutable(nestedPath)
+		if err != nil {
+			return NestedCode{}, fmt.Errorf("nested bundle %s has no executable: %w", nestedPath, err)
+		}
+		binaryPath = path.Join(nestedPath, executable)
+	}
+	signatures, err := ReadEmbeddedSignatures(binaryPath)
+	if err != nil {
+		return NestedCode{}, fmt.Errorf("nested code %s must be signed first: %w", nestedPath, err)
+	}
+	cd := signatures[0].CodeDirectories[0]
+	cdhash := cd.CDHash()
+	if len(cdhash) < 20 {
+		return NestedCode{}, fmt.Errorf("nested code %s has an unsupported hash type %d", nestedPath, cd.HashType)
+	}
+	cdhash = cdhash[:20]
+	requirement := fmt.Sprintf(`cdhash H"%s"`, hex.EncodeToString(cdhash))
+	if cert != nil && cd.Flags&csAdhoc == 0 {
+		requirement = DesignatedRequirement(cd.Identifier, cert)
+	}
+	return NestedCode{CDHash: cdhash, Requirement: requirement}, nil
+}
+
+func rulesToPlist(rules []ResourceRule) map[string]interface{} {
+	result := map[string]interface{}{}
+	for _, rule := range rules {
+		if !rule.Omit && !rule.Optional && !rule.Nested && rule.Weight == 0 {
+			result[rule.Pattern] = true
+			continue
+		}
+		entry := map[string]interface{}{}
+		if rule.Omit {
+			entry["omit"] = true
+		}
+		if rule.Optional {
+			entry["optional"] = true
+		}
+		if rule.Nested {
+			entry["nested"] = true
+		}
+		if rule.Weight != 0 {
+			entry["weight"] = rule.Weight
+		}
+		result[rule.Pattern] = entry
+	}
+	return result
+}
+
+func compileRules(rules []ResourceRule) ([]compiledRule, error) {
+	compiled := make([]compiledRule, len(rules))
+	for i, rule := range rules {
+		r, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid resource rule %s: %w", rule.Pattern, err)
+		}
+		compiled[i] = compiledRule{ResourceRule: rule, regexp: r}
+	}
+	//rules without weight count as weight 1, the highest weight wins
+	sort.SliceStable(compiled, func(i, j int) bool { return ruleWeight(compiled[i]) > ruleWeight(compiled[j]) })
+	return compiled, nil
+}
+
+func ruleWeight(rule compiledRule) float64 {
+	if rule.Weight == 0 {
+		return 1
+	}
+	return rule.Weight
+}
+
+func matchRule(relative string, rules []compiledRule) (compiledRule, bool) {
+	for _, rule := range rules {
+		if rule.regexp.MatchString(relative) {
+			return rule, true
+		}
+	}
+	return compiledRule{}, false
+}
+
+func isExcluded(file string, excluded map[string]bool) bool {
+	for dir := range excluded {
+		if file == dir || strings.HasPrefix(file, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func isInside(file string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(file, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func getBundleExecutable(bundlePath string) (string, error) {
+	info, err := readInfoPlist(bundlePath)
+	if err != nil {
+		return "", err
+	}
+	executable, ok := info[executableKey].(string)
+	if !ok {
+		return "", fmt.Errorf("%s not in Info.plist of %s", executableKey, filepath.Base(bundlePath))
+	}
+	return executable, nil
+}
@@ -0,0 +1,59 @@
+package codesign_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/danielpaulus/app-signer/codesign"
+	"github.com/stretchr/testify/assert"
+	"howett.net/plist"
+)
+
+//TestCodeResourcesMatchCodesign generates the resource seal for the simulator fixture and compares
+//it to the one Xcode created.
+func TestCodeResourcesMatchCodesign(t *testing.T) {
+	appdir, cleanup := extractSimulatorApp()
+	defer cleanup()
+	expected := readBytes(path.Join(appdir, codesign.CodeSignatureDir, codesign.CodeResourcesFile))
+
+	codeResources, err := codesign.GenerateCodeResources(appdir, codesign.CodeResourcesOptions{})
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, string(expected), string(codeResources))
+	}
+}
+
+func TestNestedCodeResources(t *testing.T) {
+	appdir, cleanup := extractSimulatorApp()
+	defer cleanup()
+	cert, key := makeSigningCertificate("Apple Development: Test (ABC)", "TEAMID1234")
+
+	//move a copy of the app into the PlugIns folder and sign it, so it looks like an app extension
+	pluginDir := path.Join(appdir, "PlugIns", "ext.appex")
+	assert.NoError(t, os.MkdirAll(pluginDir, 0755))
+	for _, file := range []string{"Info.plist", "bla"} {
+		assert.NoError(t, ioutil.WriteFile(path.Join(pluginDir, file), readBytes(path.Join(appdir, file)), 0755))
+	}
+	err := codesign.SignMachO(path.Join(pluginDir, "bla"), codesign.MachOSigningOptions{Identifier: "d.bla.ext", Certificate: cert, PrivateKey: key})
+	assert.NoError(t, err)
+
+	rules2 := append([]codesign.ResourceRule{{Pattern: `^PlugIns/`, Nested: true, Weight: 10}}, codesign.DefaultResourceRules2...)
+	codeResources, err := codesign.WriteCodeResources(appdir, codesign.CodeResourcesOptions{Rules2: rules2, Certificate: cert})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, codeResources, readBytes(path.Join(appdir, codesign.CodeSignatureDir, codesign.CodeResourcesFile)))
+
+	var parsed map[string]map[string]interface{}
+	_, err = plist.Unmarshal(codeResources, &parsed)
+	if assert.NoError(t, err) {
+		nested := parsed["files2"]["PlugIns/ext.appex"].(map[string]interface{})
+		assert.Equal(t, codesign.DesignatedRequirement("d.bla.ext", cert), nested["requirement"])
+		assert.Len(t, nested["cdhash"], 20)
+		assert.NotContains(t, parsed["files2"], "PlugIns/ext.appex/Info.plist")
+		//the legacy list does not know nested code and contains all files
+		assert.Contains(t, parsed["files"], "PlugIns/ext.appex/Info.plist")
+	}
+}
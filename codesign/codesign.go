@@ -1,11 +1,13 @@
 package codesign
 
 import (
+	"context"
+	"crypto"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
@@ -18,27 +20,138 @@ const codesignPath = "/usr/bin/codesign"
 
 //In iOS apps you will find three types of directories that need signing applied.
 //They either end with .app, .appex (app extensions) or .xctest.
+//Additionally, .framework directories inside of Frameworks folders are signed before their parent.
 const (
 	appSuffix          = ".app"
 	appExtensionSuffix = ".appex"
 	xctestSuffix       = ".xctest"
+	frameworkSuffix    = ".framework"
 )
 
 //SigningConfig contains the CertSha1 of the certificate that will be used for signing.
 //EntitlementsFilePath points to a plist file containing the entitlements extracted from
 //the correct mobileprovisioning profile.
 //KeychainPath contains the path to the keychain that contains the signing certificate.
+//SigningCert and PrivateKey are only needed by signers that do not use the keychain.
+//Context is set by the bundle walker, it cancels running codesign invocations and carries the logger, see WithLogger.
 type SigningConfig struct {
 	CertSha1             string
 	EntitlementsFilePath string
 	KeychainPath         string
 	ProfileBytes         []byte
+	SigningCert          *x509.Certificate
+	PrivateKey           crypto.Signer
+	Context              context.Context
+}
+
+//signingContext returns the Context of the config or the background context if there is none
+func (c SigningConfig) signingContext() context.Context {
+	if c.Context == nil {
+		return context.Background()
+	}
+	return c.Context
 }
 
 //Sign uses the cert, entitlements and keychain from the SigningConf to codesign the unzipped app
 //in the root path. Root needs to be a directory named 'Payload' with all the app contents inside of it.
 //Then the filetree will be walked and all the frameworks and app folders will be codesigned.
+//Signing is done with the codesign command, use SignWithSigner to pick a different backend.
 func Sign(root string, config SigningConfig) error {
+	return SignWithSigner(root, config, CodesignSigner{})
+}
+
+//SignWithSigner works like Sign but lets the given Signer sign every component it finds.
+func SignWithSigner(root string, config SigningConfig, signer Signer) error {
+	return signComponents(context.Background(), root, signer, func(string) (SigningConfig, error) {
+		return config, nil
+	})
+}
+
+//ErrMissingBundleConfig is returned by SignBundles if there is no SigningConfig for a bundle.
+var ErrMissingBundleConfig = errors.New("no signing config for bundle")
+
+//BundleConfigs maps bundle identifiers to the SigningConfig the bundle with that identifier is signed with.
+//Apps with extensions or watch apps need one entry for each of them, because every bundle needs a
+//profile for its own bundle identifier.
+type BundleConfigs map[string]SigningConfig
+
+//SignBundles works like SignWithSigner but signs each .app and .appex with the config of its bundle identifier.
+//Frameworks are signed with the config of the bundle containing them and .xctest bundles without an entry
+//with the one of their host app. It fails with ErrMissingBundleConfig before signing anything if a bundle has no config.
+func SignBundles(root string, configs BundleConfigs, signer Signer) error {
+	return SignBundlesContext(context.Background(), root, configs, signer)
+}
+
+//SignBundlesContext works like SignBundles but stops with the context's error before the next bundle once ctx is
+//cancelled. Running codesign invocations are cancelled too. Progress is logged to the logger of ctx, see WithLogger.
+func SignBundlesContext(ctx context.Context, root string, configs BundleConfigs, signer Signer) error {
+	if !strings.HasSuffix(root, "Payload") {
+		root = path.Join(root, "Payload")
+	}
+	dirs, err := findAppDirs(root)
+	if err != nil {
+		return err
+	}
+	bundleConfigs := map[string]SigningConfig{}
+	for _, dir := range dirs {
+		config, err := bundleConfig(dir, root, configs)
+		if err != nil {
+			return err
+		}
+		bundleConfigs[dir] = config
+	}
+	return signComponents(ctx, root, signer, func(dir string) (SigningConfig, error) {
+		return bundleConfigs[dir], nil
+	})
+}
+
+//ProfileBundles returns the bundle identifiers of the app at appPath and all its nested .app and .appex bundles keyed
+//by their path. These are the bundles that embed a provisioning profile and need an entry in BundleConfigs.
+func ProfileBundles(appPath string) (map[string]string, error) {
+	nested, err := findNestedBundles(appPath)
+	if err != nil {
+		return nil, err
+	}
+	bundles := map[string]string{}
+	for _, bundle := range append([]string{appPath}, nested...) {
+		if !shouldReplaceProfile(bundle) {
+			continue
+		}
+		identifier, err := GetBundleIdentifier(bundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading bundle identifier of %s: %w", bundle, err)
+		}
+		bundles[bundle] = identifier
+	}
+	return bundles, nil
+}
+
+//bundleConfig looks up the config of the bundle in dir. Test bundles fall back to the config of the closest
+//bundle containing them.
+func bundleConfig(dir string, root string, configs BundleConfigs) (SigningConfig, error) {
+	for bundle := dir; strings.HasPrefix(bundle, root) && bundle != root; bundle = filepath.Dir(bundle) {
+		if !isDirWithApp(bundle) {
+			continue
+		}
+		identifier, err := GetBundleIdentifier(bundle)
+		if err != nil {
+			return SigningConfig{}, fmt.Errorf("failed reading bundle identifier of %s: %w", bundle, err)
+		}
+		if config, ok := configs[identifier]; ok {
+			return config, nil
+		}
+		if !strings.HasSuffix(bundle, xctestSuffix) {
+			relative, _ := filepath.Rel(root, dir)
+			return SigningConfig{}, fmt.Errorf("%w: '%s' (%s)", ErrMissingBundleConfig, identifier, relative)
+		}
+	}
+	relative, _ := filepath.Rel(root, dir)
+	return SigningConfig{}, fmt.Errorf("%w: %s", ErrMissingBundleConfig, relative)
+}
+
+//signComponents signs the frameworks and bundles below root, starting with the most deeply nested ones.
+//configFor returns the config for the bundle in the given dir. Before each bundle ctx is checked.
+func signComponents(ctx context.Context, root string, signer Signer, configFor func(dir string) (SigningConfig, error)) error {
 	if !strings.HasSuffix(root, "Payload") {
 		root = path.Join(root, "Payload")
 	}
@@ -55,11 +168,20 @@ func Sign(root string, config SigningConfig) error {
 	}
 
 	for _, dir := range dirs {
-		err := signFrameworks(dir, config)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		config, err := configFor(dir)
+		if err != nil {
+			return err
+		}
+		config.Context = ctx
+		loggerFrom(ctx).WithFields(log.Fields{"bundle": dir}).Debug("signing bundle")
+		err = signFrameworks(dir, config, signer)
 		if err != nil {
 			return fmt.Errorf("error signing frameworks %s err:%w", dir, err)
 		}
-		err = signAppDir(dir, config)
+		err = signAppDir(dir, config, signer)
 		if err != nil {
 			return fmt.Errorf("error signing appDir %s err:%w", dir, err)
 		}
@@ -70,16 +192,15 @@ func Sign(root string, config SigningConfig) error {
 
 //Verify runs "codesign -vv --deep" to verbosely verify recursively the given path is properly signed.
 func Verify(path string) error {
-	cmd := exec.Command(codesignPath, "-vv", "--deep", path)
-	output, err := cmd.CombinedOutput()
+	output, err := executeCodesign("-vv", "--deep", path)
 	if err != nil {
-		log.WithFields(log.Fields{"path": path, "error": err, "cmd": cmd, "output": string(output)}).Infof("codesign invoked")
+		log.WithFields(log.Fields{"path": path, "error": err, "output": output}).Infof("codesign verification failed")
 		return err
 	}
 	return nil
 }
 
-func signFrameworks(root string, config SigningConfig) error {
+func signFrameworks(root string, config SigningConfig, signer Signer) error {
 	frameworksPath := path.Join(root, "Frameworks")
 	//it is a recursive call, if there are no more frameworks found, we just return nil here
 	if _, err := os.Stat(frameworksPath); os.IsNotExist(err) {
@@ -94,13 +215,13 @@ func signFrameworks(root string, config SigningConfig) error {
 	//Frameworks at the leaf level of the file tree must be signed first.
 	// Afterwards sign the current Frameworks directory.
 	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".framework") {
+		if strings.HasSuffix(file.Name(), frameworkSuffix) {
 			fullpath := path.Join(frameworksPath, file.Name())
-			err := signFrameworks(fullpath, config)
+			err := signFrameworks(fullpath, config, signer)
 			if err != nil {
 				return fmt.Errorf("signing Frameworks had err:%w", err)
 			}
-			err = exeuteCodesignFramework(fullpath, config)
+			err = signer.SignFramework(fullpath, config)
 			if err != nil {
 				return fmt.Errorf("running codesign on frameworks had err:%w", err)
 			}
@@ -109,18 +230,40 @@ func signFrameworks(root string, config SigningConfig) error {
 	return nil
 }
 
-func exeuteCodesignFramework(path string, config SigningConfig) error {
-	cmd := exec.Command(codesignPath, "-vv", "--keychain", config.KeychainPath, "--deep", "--force", "--sign", config.CertSha1, path)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		log.WithFields(log.Fields{"error": err, "cmd": cmd, "output": string(output)}).Errorf("codesign invoked")
-		return err
-	}
-	log.WithFields(log.Fields{"cmd": cmd, "output": string(output)}).Debugf("codesign invoked")
-	return err
+//signNestedMachOs calls sign for every Mach-O file of the bundle except the main executable, like dylibs in
+//Frameworks or inside a framework. Nested bundles are skipped, the walker signs them before their parent.
+func signNestedMachOs(bundlePath string, executable string, sign func(machOPath string) error) error {
+	return walkNestedCode(bundlePath, executable, func(string) error { return nil }, sign)
 }
 
-func signAppDir(appPath string, config SigningConfig) error {
+//walkNestedCode calls bundle for every outermost nested .app, .appex, .xctest and .framework of the bundle and
+//machO for every Mach-O file outside of them except the main executable.
+func walkNestedCode(bundlePath string, executable string, bundle func(bundlePath string) error, machO func(machOPath string) error) error {
+	return filepath.Walk(bundlePath, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if file != bundlePath && isBundleDirName(info.Name()) {
+				if err := bundle(file); err != nil {
+					return err
+				}
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || file == path.Join(bundlePath, executable) {
+			return nil
+		}
+		isMachO, err := isMachOFile(file)
+		if err != nil || !isMachO {
+			return err
+		}
+		return machO(file)
+	})
+}
+
+func signAppDir(appPath string, config SigningConfig, signer Signer) error {
 	if shouldReplaceProfile(appPath) {
 		target := path.Join(appPath, "embedded.mobileprovision")
 		err := ioutil.WriteFile(target, config.ProfileBytes, 0644)
@@ -128,15 +271,7 @@ func signAppDir(appPath string, config SigningConfig) error {
 			return fmt.Errorf("failed replacing embedded.mobileprovision profile in %s with %w", appPath, err)
 		}
 	}
-	cmd := exec.Command(codesignPath, "-vv", "--keychain", config.KeychainPath, "--deep", "--force", "--sign", config.CertSha1, "--entitlements", config.EntitlementsFilePath, appPath)
-	output, err := cmd.CombinedOutput()
-
-	if err != nil {
-		log.WithFields(log.Fields{"error": err, "cmd": cmd, "output": string(output)}).Errorf("codesign failed")
-		return err
-	}
-	log.WithFields(log.Fields{"cmd": cmd, "output": string(output)}).Debugf("codesign invoked")
-	return err
+	return signer.SignBundle(appPath, config)
 }
 
 func findAppDirs(root string) ([]string, error) {
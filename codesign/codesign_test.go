@@ -2,9 +2,12 @@ package codesign_test
 
 import (
 	"bytes"
+	"context"
 	b64 "encoding/base64"
+	"errors"
 	"github.com/danielpaulus/app-signer/api"
 	"github.com/danielpaulus/app-signer/codesign"
+	"github.com/danielpaulus/app-signer/runner"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
@@ -153,3 +156,78 @@ func installOnRealDevice(udid string, ipa []byte) {
 	}
 	log.Info("Install successful")
 }
+
+//recordingSigner remembers which certificate every component was signed with
+type recordingSigner struct {
+	signed map[string]string
+}
+
+func (r *recordingSigner) SignFramework(frameworkPath string, config codesign.SigningConfig) error {
+	r.signed[path.Base(frameworkPath)] = config.CertSha1
+	return nil
+}
+
+func (r *recordingSigner) SignBundle(bundlePath string, config codesign.SigningConfig) error {
+	r.signed[path.Base(bundlePath)] = config.CertSha1
+	return nil
+}
+
+func TestSignBundles(t *testing.T) {
+	root, err := ioutil.TempDir("", "sign-bundles")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(root)
+	app := path.Join(root, "Payload", "main.app")
+	writeInfoPlist(t, app, map[string]interface{}{"CFBundleIdentifier": "com.acme.app"})
+	writeInfoPlist(t, path.Join(app, "PlugIns", "widget.appex"), map[string]interface{}{"CFBundleIdentifier": "com.acme.app.widget"})
+	writeInfoPlist(t, path.Join(app, "PlugIns", "widget.appex", "Frameworks", "lib.framework"), map[string]interface{}{"CFBundleIdentifier": "com.acme.lib"})
+	writeInfoPlist(t, path.Join(app, "PlugIns", "tests.xctest"), map[string]interface{}{"CFBundleIdentifier": "com.acme.tests"})
+
+	signer := &recordingSigner{signed: map[string]string{}}
+	err = codesign.SignBundles(root, codesign.BundleConfigs{"com.acme.app": {CertSha1: "APP"}}, signer)
+	assert.True(t, errors.Is(err, codesign.ErrMissingBundleConfig))
+	assert.Contains(t, err.Error(), "'com.acme.app.widget' (main.app/PlugIns/widget.appex)")
+	assert.Empty(t, signer.signed)
+
+	err = codesign.SignBundles(root, codesign.BundleConfigs{"com.acme.app": {CertSha1: "APP"}, "com.acme.app.widget": {CertSha1: "WIDGET"}}, signer)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]string{"main.app": "APP", "widget.appex": "WIDGET", "lib.framework": "WIDGET", "tests.xctest": "APP"}, signer.signed)
+		assert.FileExists(t, path.Join(app, "PlugIns", "widget.appex", "embedded.mobileprovision"))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	signer.signed = map[string]string{}
+	err = codesign.SignBundlesContext(ctx, root, codesign.BundleConfigs{"com.acme.app": {CertSha1: "APP"}, "com.acme.app.widget": {CertSha1: "WIDGET"}}, signer)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, signer.signed)
+
+	bundles, err := codesign.ProfileBundles(app)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]string{app: "com.acme.app", path.Join(app, "PlugIns", "widget.appex"): "com.acme.app.widget"}, bundles)
+	}
+}
+
+func TestSignBundlesContextLogsToLogger(t *testing.T) {
+	root, err := ioutil.TempDir("", "sign-bundles-logger")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(root)
+	writeInfoPlist(t, path.Join(root, "Payload", "main.app"), map[string]interface{}{"CFBundleIdentifier": "com.acme.app"})
+	fake := runner.NewFakeRunner()
+	defer codesign.SetCommandRunner(codesign.SetCommandRunner(fake))
+
+	var logs bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&logs)
+	logger.SetLevel(log.DebugLevel)
+	ctx := codesign.WithLogger(context.Background(), logger)
+	err = codesign.SignBundlesContext(ctx, root, codesign.BundleConfigs{"com.acme.app": {CertSha1: "APP"}}, codesign.CodesignSigner{})
+	if assert.NoError(t, err) {
+		assert.Len(t, fake.CommandLines(), 1)
+		assert.Contains(t, logs.String(), "signing bundle")
+		assert.Contains(t, logs.String(), "codesign invoked")
+	}
+}
@@ -0,0 +1,293 @@
+package codesign
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io/ioutil"
+)
+
+//Magic numbers of the blobs contained in an embedded code signature, see cs_blobs.h in the xnu sources.
+//All blobs are stored big endian, independent of the byte order of the Mach-O binary.
+const (
+	csMagicRequirement             = 0xfade0c00
+	csMagicRequirements            = 0xfade0c01
+	csMagicCodeDirectory           = 0xfade0c02
+	csMagicEmbeddedSignature       = 0xfade0cc0
+	csMagicEmbeddedEntitlements    = 0xfade7171
+	csMagicEmbeddedDerEntitlements = 0xfade7172
+	csMagicBlobWrapper             = 0xfade0b01
+)
+
+//Slot types used in the index of the embedded signature superblob.
+//Negative special slots in the CodeDirectory use the same numbers, f.ex. the hash of
+//the entitlements blob is stored in special slot -5.
+const (
+	csSlotCodeDirectory            = 0
+	csSlotInfoPlist                = 1
+	csSlotRequirements             = 2
+	csSlotResourceDir              = 3
+	csSlotApplication              = 4
+	csSlotEntitlements             = 5
+	csSlotRepSpecific              = 6
+	csSlotDerEntitlements          = 7
+	csSlotAlternateCodeDirectories = 0x1000
+	csSlotSignature                = 0x10000
+)
+
+//Hash types of a CodeDirectory
+const (
+	csHashTypeSha1   = 1
+	csHashTypeSha256 = 2
+)
+
+//CodeDirectory flags and exec segment flags we set or check
+const (
+	csAdhoc                 = 0x2
+	csExecSegMainBinary     = 0x1
+	csExecSegAllowUnsigned  = 0x10
+	codeDirectoryVersion    = 0x20400
+	codeDirectoryHeaderSize = 88
+	pageSizeBits            = 12
+	pageSize                = 1 << pageSizeBits
+)
+
+//CodeDirectory is a parsed CodeDirectory blob of an embedded signature.
+//SpecialSlots contains the hashes of the special slots with index 0 being special slot -1 (Info.plist).
+type CodeDirectory struct {
+	Raw          []byte
+	Version      uint32
+	Flags        uint32
+	Identifier   string
+	TeamID       string
+	HashType     uint8
+	PageSize     int
+	CodeLimit    uint64
+	ExecSegBase  uint64
+	ExecSegLimit uint64
+	ExecSegFlags uint64
+	SpecialSlots [][]byte
+	CodeSlots    [][]byte
+}
+
+//CDHash returns the full hash of the CodeDirectory blob using the CodeDirectory's own hash type.
+//The cdhash Apple tools print is the first 20 bytes of it.
+func (cd CodeDirectory) CDHash() []byte {
+	h := newCodeDirectoryHash(cd.HashType)
+	if h == nil {
+		return nil
+	}
+	h.Write(cd.Raw)
+	return h.Sum(nil)
+}
+
+//SpecialSlot returns the hash stored for the given positive special slot number or nil
+//if the CodeDirectory does not contain that slot.
+func (cd CodeDirectory) SpecialSlot(slot int) []byte {
+	if slot < 1 || slot > len(cd.SpecialSlots) {
+		return nil
+	}
+	return cd.SpecialSlots[slot-1]
+}
+
+//EmbeddedSignature is the parsed code signature superblob of one Mach-O slice.
+type EmbeddedSignature struct {
+	//Offset of the signature relative to the start of the slice, this is also the code limit
+	Offset          uint32
+	CodeDirectories []CodeDirectory
+	Requirements    []byte
+	Entitlements    []byte
+	DerEntitlements []byte
+	CMSSignature    []byte
+	//RawBlobs contains every blob of the superblob by slot type, including magic and length
+	RawBlobs map[uint32][]byte
+}
+
+//BestCodeDirectory returns the CodeDirectory with the strongest hash type, usually the SHA-256 one.
+func (s EmbeddedSignature) BestCodeDirectory() CodeDirectory {
+	best := CodeDirectory{}
+	for _, cd := range s.CodeDirectories {
+		if cd.HashType >= best.HashType {
+			best = cd
+		}
+	}
+	return best
+}
+
+//ReadEmbeddedSignatures parses the LC_CODE_SIGNATURE of every slice of the thin or universal
+//Mach-O binary at binaryPath. It returns an error if any slice is not signed.
+func ReadEmbeddedSignatures(binaryPath string) ([]EmbeddedSignature, error) {
+	data, err := ioutil.ReadFile(binaryPath)
+	if err != nil {
+		return []EmbeddedSignature{}, err
+	}
+	slices, err := splitMachO(data)
+	if err != nil {
+		return []EmbeddedSignature{}, fmt.Errorf("failed parsing %s: %w", binaryPath, err)
+	}
+	result := make([]EmbeddedSignature, len(slices))
+	for i, slice := range slices {
+		m, err := parseMachOSlice(slice.data)
+		if err != nil {
+			return []EmbeddedSignature{}, fmt.Errorf("failed parsing slice %d of %s: %w", i, binaryPath, err)
+		}
+		offset, size, ok := m.codeSignatureRange()
+		if !ok {
+			return []EmbeddedSignature{}, fmt.Errorf("slice %d of %s is not signed", i, binaryPath)
+		}
+		if uint64(offset)+uint64(size) > uint64(len(slice.data)) {
+			return []EmbeddedSignature{}, fmt.Errorf("code signature of slice %d in %s is out of bounds", i, binaryPath)
+		}
+		signature, err := parseEmbeddedSignature(slice.data[offset : offset+size])
+		if err != nil {
+			return []EmbeddedSignature{}, fmt.Errorf("failed parsing code signature of slice %d in %s: %w", i, binaryPath, err)
+		}
+		signature.Offset = offset
+		result[i] = signature
+	}
+	return result, nil
+}
+
+func parseEmbeddedSignature(data []byte) (EmbeddedSignature, error) {
+	result := EmbeddedSignature{RawBlobs: map[uint32][]byte{}}
+	if len(data) < 12 || binary.BigEndian.Uint32(data) != csMagicEmbeddedSignature {
+		return result, fmt.Errorf("missing embedded signature magic")
+	}
+	length := binary.BigEndian.Uint32(data[4:])
+	count := binary.BigEndian.Uint32(data[8:])
+	if int(length) > len(data) || 12+8*int(count) > int(length) {
+		return result, fmt.Errorf("invalid superblob length %d", length)
+	}
+	data = data[:length]
+	for i := 0; i < int(count); i++ {
+		slotType := binary.BigEndian.Uint32(data[12+8*i:])
+		offset := binary.BigEndian.Uint32(data[16+8*i:])
+		blob, err := readBlob(data, offset)
+		if err != nil {
+			return result, fmt.Errorf("blob for slot %#x: %w", slotType, err)
+		}
+		result.RawBlobs[slotType] = blob
+		switch {
+		case slotType == csSlotCodeDirectory || (slotType >= csSlotAlternateCodeDirectories && slotType < csSlotAlternateCodeDirectories+5):
+			cd, err := parseCodeDirectory(blob)
+			if err != nil {
+				return result, err
+			}
+			result.CodeDirectories = append(result.CodeDirectories, cd)
+		case slotType == csSlotRequirements:
+			result.Requirements = blob
+		case slotType == csSlotEntitlements:
+			result.Entitlements = blob[8:]
+		case slotType == csSlotDerEntitlements:
+			result.DerEntitlements = blob[8:]
+		case slotType == csSlotSignature:
+			result.CMSSignature = blob[8:]
+		}
+	}
+	if len(result.CodeDirectories) == 0 {
+		return result, fmt.Errorf("signature does not contain a CodeDirectory")
+	}
+	return result, nil
+}
+
+func readBlob(superblob []byte, offset uint32) ([]byte, error) {
+	if uint64(offset)+8 > uint64(len(superblob)) {
+		return nil, fmt.Errorf("offset %d out of bounds", offset)
+	}
+	length := binary.BigEndian.Uint32(superblob[offset+4:])
+	if length < 8 || uint64(offset)+uint64(length) > uint64(len(superblob)) {
+		return nil, fmt.Errorf("invalid blob length %d at offset %d", length, offset)
+	}
+	return superblob[offset : offset+length], nil
+}
+
+func parseCodeDirectory(blob []byte) (CodeDirectory, error) {
+	if len(blob) < 44 || binary.BigEndian.Uint32(blob) != csMagicCodeDirectory {
+		return CodeDirectory{}, fmt.Errorf("invalid CodeDirectory blob")
+	}
+	be := binary.BigEndian
+	cd := CodeDirectory{
+		Raw:       blob,
+		Version:   be.Uint32(blob[8:]),
+		Flags:     be.Uint32(blob[12:]),
+		HashType:  blob[37],
+		PageSize:  1 << blob[39],
+		CodeLimit: uint64(be.Uint32(blob[32:])),
+	}
+	hashOffset := be.Uint32(blob[16:])
+	identOffset := be.Uint32(blob[20:])
+	nSpecialSlots := be.Uint32(blob[24:])
+	nCodeSlots := be.Uint32(blob[28:])
+	hashSize := uint32(blob[36])
+
+	if blob[39] == 0 {
+		cd.PageSize = 0
+	}
+	if cd.Version >= 0x20200 && len(blob) >= 52 {
+		if teamOffset := be.Uint32(blob[48:]); teamOffset != 0 {
+			cd.TeamID = readCString(blob, teamOffset)
+		}
+	}
+	if cd.Version >= 0x20300 && len(blob) >= 64 {
+		if codeLimit64 := be.Uint64(blob[56:]); codeLimit64 != 0 {
+			cd.CodeLimit = codeLimit64
+		}
+	}
+	if cd.Version >= 0x20400 && len(blob) >= codeDirectoryHeaderSize {
+		cd.ExecSegBase = be.Uint64(blob[64:])
+		cd.ExecSegLimit = be.Uint64(blob[72:])
+		cd.ExecSegFlags = be.Uint64(blob[80:])
+	}
+	cd.Identifier = readCString(blob, identOffset)
+	if newCodeDirectoryHash(cd.HashType) == nil {
+		return CodeDirectory{}, fmt.Errorf("unsupported CodeDirectory hash type %d", cd.HashType)
+	}
+
+	if uint64(hashOffset)+uint64(nCodeSlots)*uint64(hashSize) > uint64(len(blob)) || uint64(nSpecialSlots)*uint64(hashSize) > uint64(hashOffset) {
+		return CodeDirectory{}, fmt.Errorf("CodeDirectory hash slots out of bounds")
+	}
+	cd.SpecialSlots = make([][]byte, nSpecialSlots)
+	for i := uint32(1); i <= nSpecialSlots; i++ {
+		start := hashOffset - i*hashSize
+		cd.SpecialSlots[i-1] = blob[start : start+hashSize]
+	}
+	cd.CodeSlots = make([][]byte, nCodeSlots)
+	for i := uint32(0); i < nCodeSlots; i++ {
+		start := hashOffset + i*hashSize
+		cd.CodeSlots[i] = blob[start : start+hashSize]
+	}
+	return cd, nil
+}
+
+func readCString(data []byte, offset uint32) string {
+	if offset >= uint32(len(data)) {
+		return ""
+	}
+	end := offset
+	for end < uint32(len(data)) && data[end] != 0 {
+		end++
+	}
+	return string(data[offset:end])
+}
+
+func newCodeDirectoryHash(hashType uint8) hash.Hash {
+	switch hashType {
+	case csHashTypeSha1:
+		return sha1.New()
+	case csHashTypeSha256:
+		return sha256.New()
+	}
+	return nil
+}
+
+//hashBytes hashes data with the CodeDirectory hash type, it returns false for unknown hash types
+func hashBytes(hashType uint8, data []byte) ([]byte, bool) {
+	h := newCodeDirectoryHash(hashType)
+	if h == nil {
+		return nil, false
+	}
+	h.Write(data)
+	return h.Sum(nil), true
+}
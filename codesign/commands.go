@@ -0,0 +1,82 @@
+package codesign
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/app-signer/runner"
+	log "github.com/sirupsen/logrus"
+)
+
+//Timeouts for the external tools. Signing big apps can take a while, the keychain commands should
+//return almost immediately and only hang if security waits for user input.
+const (
+	securityTimeout = 2 * time.Minute
+	codesignTimeout = 10 * time.Minute
+)
+
+var (
+	commandRunnerMux sync.RWMutex
+	commandRunner    runner.Runner = runner.NewExecRunner()
+)
+
+//SetCommandRunner replaces the runner used for all security and codesign invocations and returns
+//the previous one, so tests can script tool responses with a runner.FakeRunner and restore it afterwards.
+func SetCommandRunner(r runner.Runner) runner.Runner {
+	commandRunnerMux.Lock()
+	defer commandRunnerMux.Unlock()
+	previous := commandRunner
+	commandRunner = r
+	return previous
+}
+
+//CommandRunner returns the runner used for all security and codesign invocations
+func CommandRunner() runner.Runner {
+	commandRunnerMux.RLock()
+	defer commandRunnerMux.RUnlock()
+	return commandRunner
+}
+
+func executeSecurity(args ...string) (string, error) {
+	cmd := runner.Command{Name: securityPath, Args: args, Timeout: securityTimeout}
+	result, err := CommandRunner().Run(context.Background(), cmd)
+	if err != nil {
+		log.WithFields(log.Fields{"cmd": cmd, "output": string(result.Output), "error": err}).Errorf("security failed")
+	}
+	log.WithFields(log.Fields{"cmd": cmd, "output": string(result.Output)}).Debugf("security invoked")
+	return string(result.Output), err
+}
+
+func executeCodesign(args ...string) (string, error) {
+	return executeCodesignContext(context.Background(), args...)
+}
+
+//executeCodesignContext runs codesign until it finishes or ctx is cancelled and logs to the logger of ctx
+func executeCodesignContext(ctx context.Context, args ...string) (string, error) {
+	logger := loggerFrom(ctx)
+	cmd := runner.Command{Name: codesignPath, Args: args, Timeout: codesignTimeout}
+	result, err := CommandRunner().Run(ctx, cmd)
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err, "cmd": cmd, "output": string(result.Output)}).Errorf("codesign failed")
+		return string(result.Output), err
+	}
+	logger.WithFields(log.Fields{"cmd": cmd, "output": string(result.Output)}).Debugf("codesign invoked")
+	return string(result.Output), nil
+}
+
+type loggerKey struct{}
+
+//WithLogger returns a context that makes signing log to logger instead of the standard logger,
+//f.ex. to collect the log of a signing job. Pass it to SignBundlesContext.
+func WithLogger(ctx context.Context, logger log.FieldLogger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+//loggerFrom returns the logger set with WithLogger or the standard logger
+func loggerFrom(ctx context.Context) log.FieldLogger {
+	if logger, ok := ctx.Value(loggerKey{}).(log.FieldLogger); ok {
+		return logger
+	}
+	return log.StandardLogger()
+}
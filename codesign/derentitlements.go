@@ -0,0 +1,114 @@
+package codesign
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"howett.net/plist"
+)
+
+//DER tags used by the DER encoded entitlements blob that iOS 15 and later requires.
+//Dictionaries are encoded as a context specific constructed tag 16 containing a sequence of
+//key value pairs for each entry, the whole thing is wrapped in an application specific tag 16
+//together with a version number.
+const (
+	derTagBoolean      = 0x01
+	derTagInteger      = 0x02
+	derTagUTF8String   = 0x0c
+	derTagSequence     = 0x30
+	derTagDictionary   = 0xb0
+	derTagEntitlements = 0x70
+)
+
+//encodeDerEntitlements converts an entitlements plist into the DER representation stored in special slot 7.
+func encodeDerEntitlements(entitlementsPlist []byte) ([]byte, error) {
+	var entitlements map[string]interface{}
+	_, err := plist.Unmarshal(entitlementsPlist, &entitlements)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing entitlements plist: %w", err)
+	}
+	dictionary, err := derEncodeValue(entitlements)
+	if err != nil {
+		return nil, err
+	}
+	content := append(derEncode(derTagInteger, []byte{1}), dictionary...)
+	return derEncode(derTagEntitlements, content), nil
+}
+
+func derEncodeValue(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return derEncode(derTagBoolean, []byte{0xff}), nil
+		}
+		return derEncode(derTagBoolean, []byte{0x00}), nil
+	case string:
+		return derEncode(derTagUTF8String, []byte(v)), nil
+	case uint64:
+		return derEncodeInteger(new(big.Int).SetUint64(v)), nil
+	case int64:
+		return derEncodeInteger(big.NewInt(v)), nil
+	case []interface{}:
+		content := &bytes.Buffer{}
+		for _, element := range v {
+			encoded, err := derEncodeValue(element)
+			if err != nil {
+				return nil, err
+			}
+			content.Write(encoded)
+		}
+		return derEncode(derTagSequence, content.Bytes()), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		content := &bytes.Buffer{}
+		for _, key := range keys {
+			encoded, err := derEncodeValue(v[key])
+			if err != nil {
+				return nil, fmt.Errorf("entitlement %s: %w", key, err)
+			}
+			content.Write(derEncode(derTagSequence, append(derEncode(derTagUTF8String, []byte(key)), encoded...)))
+		}
+		return derEncode(derTagDictionary, content.Bytes()), nil
+	}
+	return nil, fmt.Errorf("unsupported entitlement value type %T", value)
+}
+
+func derEncodeInteger(value *big.Int) []byte {
+	if value.Sign() == 0 {
+		return derEncode(derTagInteger, []byte{0})
+	}
+	if value.Sign() > 0 {
+		content := value.Bytes()
+		if content[0]&0x80 != 0 {
+			content = append([]byte{0}, content...)
+		}
+		return derEncode(derTagInteger, content)
+	}
+	//two's complement of negative numbers
+	length := len(value.Bytes()) + 1
+	twos := new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), uint(8*length)), value).Bytes()
+	for len(twos) > 1 && twos[0] == 0xff && twos[1]&0x80 != 0 {
+		twos = twos[1:]
+	}
+	return derEncode(derTagInteger, twos)
+}
+
+func derEncode(tag byte, content []byte) []byte {
+	result := []byte{tag}
+	length := len(content)
+	switch {
+	case length < 0x80:
+		result = append(result, byte(length))
+	default:
+		lengthBytes := big.NewInt(int64(length)).Bytes()
+		result = append(result, 0x80|byte(len(lengthBytes)))
+		result = append(result, lengthBytes...)
+	}
+	return append(result, content...)
+}
@@ -0,0 +1,273 @@
+package codesign
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+//DeviceCoverage lists the profiles containing a device. Covered is true if at least one of them has not expired.
+type DeviceCoverage struct {
+	UDID     string        `json:"udid"`
+	Covered  bool          `json:"covered"`
+	Profiles []ProfileInfo `json:"profiles"`
+}
+
+//CoverageReport contains the coverage of every checked device, in the order they were passed to CheckCoverage,
+//and the UDIDs of the devices no valid profile covers.
+type CoverageReport struct {
+	Devices   []DeviceCoverage `json:"devices"`
+	Uncovered []string         `json:"uncovered"`
+}
+
+//CheckCoverage finds all profiles provisioning each of the devices. Profiles provisioning all devices cover every udid.
+//Expired profiles are listed for a device, but do not count as covering it. The status of the profiles is determined
+//for the time now and the warning window.
+func CheckCoverage(udids []string, profiles []ProfileFile, now time.Time, window time.Duration) CoverageReport {
+	report := CoverageReport{Devices: []DeviceCoverage{}, Uncovered: []string{}}
+	for _, udid := range udids {
+		coverage := DeviceCoverage{UDID: udid, Profiles: []ProfileInfo{}}
+		for _, file := range profiles {
+			if _, ok := checkDevice(udid, file.Profile); !ok {
+				continue
+			}
+			info := NewProfileInfo(file.Profile, now, window)
+			info.Path = file.Path
+			coverage.Profiles = append(coverage.Profiles, info)
+			coverage.Covered = coverage.Covered || info.Status != ProfileStatusExpired
+		}
+		if !coverage.Covered {
+			report.Uncovered = append(report.Uncovered, udid)
+		}
+		report.Devices = append(report.Devices, coverage)
+	}
+	return report
+}
+
+//ReadUDIDs reads a list of device UDIDs, one per line. Only the first column of every line is used, so device
+//lists exported from the Apple developer portal with tab separated name and platform columns work too.
+//Empty lines, lines starting with '#' and the 'Device ID' header are skipped.
+func ReadUDIDs(reader io.Reader) ([]string, error) {
+	udids := []string{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fields := strings.FieldsFunc(scanner.Text(), func(r rune) bool {
+			return r == '\t' || r == ',' || r == ' '
+		})
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || fields[0] == "Device" {
+			continue
+		}
+		udids = append(udids, fields[0])
+	}
+	return udids, scanner.Err()
+}
+
+//maxCoverCombinations limits the exhaustive search for the smallest set of profiles in CoverDevices,
+//if more combinations would have to be checked the profiles are picked greedily.
+const maxCoverCombinations = 100000
+
+//DeviceGroup is a set of devices the app can be signed for with the same profile
+type DeviceGroup struct {
+	Candidate ProfileCandidate
+	UDIDs     []string
+}
+
+//DeviceCover splits devices into groups sharing a profile. Uncovered contains the devices no profile can be used for.
+type DeviceCover struct {
+	Groups    []DeviceGroup
+	Uncovered []string
+}
+
+//CoverDevices finds the smallest set of profiles that can sign the app with bundleID for all devices, ideally a single
+//one. Among sets of the same size the one with the most specific App IDs wins. Each device is assigned to the first
+//group whose profile covers it, groups are ordered by the rank of their profile.
+func CoverDevices(udids []string, bundleID string, profiles []ProfileAndCertificate) DeviceCover {
+	cover := DeviceCover{Groups: []DeviceGroup{}, Uncovered: []string{}}
+	covering := map[int]map[string]bool{}
+	ranks := map[int]int{}
+	covered := []string{}
+	for _, udid := range udids {
+		selection := SelectProfiles(udid, bundleID, profiles)
+		if len(selection.Candidates) == 0 {
+			cover.Uncovered = append(cover.Uncovered, udid)
+			continue
+		}
+		covered = append(covered, udid)
+		for _, candidate := range selection.Candidates {
+			if covering[candidate.Index] == nil {
+				covering[candidate.Index] = map[string]bool{}
+			}
+			covering[candidate.Index][udid] = true
+			ranks[candidate.Index] = candidate.Rank
+		}
+	}
+	indexes := make([]int, 0, len(covering))
+	for index := range covering {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		if ranks[indexes[i]] != ranks[indexes[j]] {
+			return ranks[indexes[i]] > ranks[indexes[j]]
+		}
+		return indexes[i] < indexes[j]
+	})
+
+	assigned := map[string]bool{}
+	for _, index := range smallestCover(covered, removeDominated(indexes, covering), covering, ranks) {
+		group := []string{}
+		for _, udid := range covered {
+			if covering[index][udid] && !assigned[udid] {
+				assigned[udid] = true
+				group = append(group, udid)
+			}
+		}
+		if len(group) == 0 {
+			continue
+		}
+		selection := SelectProfilesForDevices(group, bundleID, profiles)
+		for _, candidate := range selection.Candidates {
+			if candidate.Index == index {
+				cover.Groups = append(cover.Groups, DeviceGroup{Candidate: candidate, UDIDs: group})
+			}
+		}
+	}
+	return cover
+}
+
+//UncoveredBundles returns the bundle identifiers out of bundleIDs that no profile can sign for all devices of
+//the group. CoverDevices only considers the app's identifier, extensions and watch apps can need other App IDs.
+func (g DeviceGroup) UncoveredBundles(bundleIDs []string, profiles []ProfileAndCertificate) []string {
+	uncovered := []string{}
+	for _, bundleID := range bundleIDs {
+		if _, ok := SelectProfilesForDevices(g.UDIDs, bundleID, profiles).Best(); !ok {
+			uncovered = append(uncovered, bundleID)
+		}
+	}
+	return uncovered
+}
+
+//removeDominated drops profiles covering only devices a better ranked profile covers as well
+func removeDominated(indexes []int, covering map[int]map[string]bool) []int {
+	result := []int{}
+	for i, index := range indexes {
+		dominated := false
+		for j, other := range indexes {
+			if i == j || len(covering[other]) < len(covering[index]) || (len(covering[other]) == len(covering[index]) && j > i) {
+				continue
+			}
+			dominated = true
+			for udid := range covering[index] {
+				if !covering[other][udid] {
+					dominated = false
+					break
+				}
+			}
+			if dominated {
+				break
+			}
+		}
+		if !dominated {
+			result = append(result, index)
+		}
+	}
+	return result
+}
+
+//smallestCover returns the profile indexes covering all udids, checking all combinations with increasing size
+//as long as there are not too many of them and picking greedily otherwise. indexes must be sorted by rank.
+func smallestCover(udids []string, indexes []int, covering map[int]map[string]bool, ranks map[int]int) []int {
+	coversAll := func(combination []int) bool {
+		for _, udid := range udids {
+			found := false
+			for _, index := range combination {
+				if covering[index][udid] {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+	for size := 1; size <= len(indexes); size++ {
+		if binomial(len(indexes), size) > maxCoverCombinations {
+			break
+		}
+		var best []int
+		bestRank := -1
+		forEachCombination(len(indexes), size, func(positions []int) {
+			combination := make([]int, size)
+			rank := 0
+			for i, position := range positions {
+				combination[i] = indexes[position]
+				rank += ranks[indexes[position]]
+			}
+			if rank > bestRank && coversAll(combination) {
+				best, bestRank = combination, rank
+			}
+		})
+		if best != nil {
+			return best
+		}
+	}
+
+	chosen := []int{}
+	remaining := map[string]bool{}
+	for _, udid := range udids {
+		remaining[udid] = true
+	}
+	for len(remaining) > 0 {
+		bestIndex, bestCount := -1, 0
+		for _, index := range indexes {
+			count := 0
+			for udid := range covering[index] {
+				if remaining[udid] {
+					count++
+				}
+			}
+			if count > bestCount {
+				bestIndex, bestCount = index, count
+			}
+		}
+		if bestIndex == -1 {
+			break
+		}
+		chosen = append(chosen, bestIndex)
+		for udid := range covering[bestIndex] {
+			delete(remaining, udid)
+		}
+	}
+	return chosen
+}
+
+//forEachCombination calls f with every sorted combination of size positions out of 0..n-1
+func forEachCombination(n int, size int, f func(positions []int)) {
+	positions := make([]int, size)
+	var next func(start int, depth int)
+	next = func(start int, depth int) {
+		if depth == size {
+			f(positions)
+			return
+		}
+		for i := start; i <= n-(size-depth); i++ {
+			positions[depth] = i
+			next(i+1, depth+1)
+		}
+	}
+	next(0, 0)
+}
+
+func binomial(n int, k int) int {
+	result := 1
+	for i := 1; i <= k; i++ {
+		result = result * (n - k + i) / i
+		if result > maxCoverCombinations {
+			return result
+		}
+	}
+	return result
+}
@@ -0,0 +1,103 @@
+package codesign_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/app-signer/codesign"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckCoverage(t *testing.T) {
+	now := time.Now()
+	profiles := []codesign.ProfileFile{
+		{Path: "dev.mobileprovision", Profile: codesign.MobileProvisioningProfile{Name: "dev", ProvisionedDevices: []string{"device1", "device2"}, ExpirationDate: now.Add(100 * 24 * time.Hour),
+			Entitlements: map[string]interface{}{"application-identifier": "TEAMID.*"}}},
+		{Path: "old.mobileprovision", Profile: codesign.MobileProvisioningProfile{Name: "old", ProvisionedDevices: []string{"device2", "device3"}, ExpirationDate: now.Add(-time.Hour)}},
+		{Path: "soon.mobileprovision", Profile: codesign.MobileProvisioningProfile{Name: "soon", ProvisionedDevices: []string{"device1"}, ExpirationDate: now.Add(24 * time.Hour)}},
+	}
+	report := codesign.CheckCoverage([]string{"device1", "device2", "device3", "device4"}, profiles, now, codesign.DefaultExpiryWarning)
+	if !assert.Len(t, report.Devices, 4) {
+		return
+	}
+	assert.Equal(t, []string{"device3", "device4"}, report.Uncovered)
+
+	device1 := report.Devices[0]
+	assert.True(t, device1.Covered)
+	if assert.Len(t, device1.Profiles, 2) {
+		assert.Equal(t, "dev", device1.Profiles[0].Name)
+		assert.Equal(t, "TEAMID.*", device1.Profiles[0].AppID)
+		assert.Equal(t, "dev.mobileprovision", device1.Profiles[0].Path)
+		assert.Equal(t, codesign.ProfileStatusExpiring, device1.Profiles[1].Status)
+	}
+	assert.True(t, report.Devices[1].Covered)
+	assert.False(t, report.Devices[2].Covered)
+	assert.Equal(t, codesign.ProfileStatusExpired, report.Devices[2].Profiles[0].Status)
+	assert.Empty(t, report.Devices[3].Profiles)
+
+	enterprise := []codesign.ProfileFile{{Profile: codesign.MobileProvisioningProfile{Name: "enterprise", ProvisionsAllDevices: true}}}
+	assert.Empty(t, codesign.CheckCoverage([]string{"device4"}, enterprise, now, 0).Uncovered)
+}
+
+func TestReadUDIDs(t *testing.T) {
+	list := "Device ID\tDevice Name\tDevice Platform\n00008030-001A\tiPhone\tios\n\n# lab devices\nabcdef0123 \n"
+	udids, err := codesign.ReadUDIDs(strings.NewReader(list))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"00008030-001A", "abcdef0123"}, udids)
+	}
+}
+
+func TestCoverDevices(t *testing.T) {
+	expiry := time.Now().Add(100 * 24 * time.Hour)
+	profiles := []codesign.ProfileAndCertificate{
+		testProfile("wildcard", "TEAMID.*", expiry, "device1", "device2"),
+		testProfile("exact", "TEAMID.com.acme.app", expiry, "device2", "device3"),
+		testProfile("small wildcard", "TEAMID.*", expiry, "device3"),
+		testProfile("other app", "TEAMID.com.other.app", expiry, "device4"),
+	}
+	cover := codesign.CoverDevices([]string{"device1", "device2", "device3", "device4", "device5"}, "com.acme.app", profiles)
+	assert.Equal(t, []string{"device4", "device5"}, cover.Uncovered)
+	if assert.Len(t, cover.Groups, 2) {
+		assert.Equal(t, "exact", cover.Groups[0].Candidate.Name)
+		assert.Equal(t, []string{"device2", "device3"}, cover.Groups[0].UDIDs)
+		assert.Equal(t, "wildcard", cover.Groups[1].Candidate.Name)
+		assert.Equal(t, []string{"device1"}, cover.Groups[1].UDIDs)
+		assert.Contains(t, cover.Groups[0].Candidate.Reasons, "all 2 devices are provisioned")
+	}
+
+	profiles = append(profiles, testProfile("everything", "TEAMID.*", expiry, "device1", "device2", "device3"))
+	cover = codesign.CoverDevices([]string{"device1", "device2", "device3"}, "com.acme.app", profiles)
+	assert.Empty(t, cover.Uncovered)
+	if assert.Len(t, cover.Groups, 1) {
+		assert.Equal(t, "everything", cover.Groups[0].Candidate.Name)
+		assert.Equal(t, []string{"device1", "device2", "device3"}, cover.Groups[0].UDIDs)
+	}
+}
+
+func TestDeviceGroupUncoveredBundles(t *testing.T) {
+	expiry := time.Now().Add(100 * 24 * time.Hour)
+	profiles := []codesign.ProfileAndCertificate{
+		testProfile("app", "TEAMID.com.acme.app", expiry, "device1", "device2"),
+		testProfile("widget", "TEAMID.com.acme.app.widget", expiry, "device1"),
+	}
+	cover := codesign.CoverDevices([]string{"device1", "device2"}, "com.acme.app", profiles)
+	if assert.Len(t, cover.Groups, 1) {
+		bundleIDs := []string{"com.acme.app", "com.acme.app.widget", "com.acme.app.watch"}
+		assert.Equal(t, []string{"com.acme.app.widget", "com.acme.app.watch"}, cover.Groups[0].UncoveredBundles(bundleIDs, profiles))
+		assert.Empty(t, cover.Groups[0].UncoveredBundles(bundleIDs[:1], profiles))
+	}
+	group := codesign.DeviceGroup{UDIDs: []string{"device1"}}
+	assert.Equal(t, []string{"com.acme.app.watch"}, group.UncoveredBundles([]string{"com.acme.app.widget", "com.acme.app.watch"}, profiles))
+}
+
+func TestSelectProfilesForDevices(t *testing.T) {
+	expiry := time.Now().Add(100 * 24 * time.Hour)
+	profiles := []codesign.ProfileAndCertificate{testProfile("wildcard", "TEAMID.*", expiry, "device1", "device2")}
+	selection := codesign.SelectProfilesForDevices([]string{"device1", "device3", "device4"}, "com.acme.app", profiles)
+	assert.False(t, selection.DeviceProvisioned())
+	if assert.Len(t, selection.Rejected, 1) {
+		assert.Equal(t, "2 of 3 devices are not provisioned: 'device3', 'device4'", selection.Rejected[0].Reasons[0])
+	}
+	assert.True(t, codesign.SelectProfilesForDevices([]string{"device1", "device2"}, "com.acme.app", profiles).DeviceProvisioned())
+}
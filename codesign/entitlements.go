@@ -0,0 +1,273 @@
+package codesign
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"howett.net/plist"
+)
+
+//Entitlements every signed app needs, they are taken from the profile even if the binary was signed without them.
+const (
+	teamIdentifierEntitlement = "com.apple.developer.team-identifier"
+	getTaskAllowEntitlement   = "get-task-allow"
+)
+
+//ReadEntitlements returns the entitlements the Mach-O binary at binaryPath was signed with.
+//The result is empty if the binary is signed without entitlements, an unsigned binary is an error.
+func ReadEntitlements(binaryPath string) (map[string]interface{}, error) {
+	signatures, err := ReadEmbeddedSignatures(binaryPath)
+	if err != nil {
+		return nil, err
+	}
+	entitlements := map[string]interface{}{}
+	for _, signature := range signatures {
+		if len(signature.Entitlements) == 0 {
+			continue
+		}
+		_, err := plist.Unmarshal(signature.Entitlements, &entitlements)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing entitlements of %s: %w", binaryPath, err)
+		}
+		break
+	}
+	return entitlements, nil
+}
+
+//MergeEntitlements keeps the entitlements the binary was signed with, as far as the profile grants them.
+//Keys missing in the profile are dropped, array values like keychain-access-groups keep only the elements matching
+//one of the profile's values, where a trailing '*' in the profile matches any suffix. Strings the profile does not
+//grant are replaced by the profile's value if that is a string without wildcard, like aps-environment, and dropped
+//otherwise. Booleans are kept unless the profile only grants false. Values of another type than the profile's are
+//dropped. Values prefixed with the team id the binary was signed for are rewritten to teamID first. application-identifier, the team identifier and get-task-allow are always added.
+//It returns the merged entitlements and the sorted keys that were dropped.
+func MergeEntitlements(signed map[string]interface{}, granted map[string]interface{}, teamID string) (map[string]interface{}, []string) {
+	oldTeamID := signedTeamID(signed)
+	merged := map[string]interface{}{}
+	removed := []string{}
+	for key, value := range signed {
+		grantedValue, ok := granted[key]
+		if !ok {
+			removed = append(removed, key)
+			continue
+		}
+		value = rewriteTeamID(value, oldTeamID, teamID)
+		mergedValue, ok := mergeEntitlement(value, grantedValue)
+		if !ok {
+			removed = append(removed, key)
+			continue
+		}
+		merged[key] = mergedValue
+	}
+	for _, key := range []string{applicationIdentifierKey, teamIdentifierEntitlement, getTaskAllowEntitlement} {
+		if _, ok := merged[key]; ok {
+			continue
+		}
+		if value, ok := granted[key]; ok {
+			merged[key] = value
+		}
+	}
+	sort.Strings(removed)
+	return merged, removed
+}
+
+//ConcretiseEntitlements replaces the wildcards a profile's entitlements contain with the identifier of the bundle they
+//are signed into. application-identifier becomes <app id prefix>.<bundleID>, wildcard strings prefixed with the app id
+//prefix or team id, like TEAMID.* in keychain-access-groups or the ubiquity-kvstore-identifier, become the same.
+//Wildcard array elements that do not cover bundleID are dropped. Devices refuse to install apps with wildcards in
+//these entitlements. The given map is not modified.
+func ConcretiseEntitlements(entitlements map[string]interface{}, bundleID string) map[string]interface{} {
+	appID, _ := entitlements[applicationIdentifierKey].(string)
+	prefixes := []string{}
+	if index := strings.Index(appID, "."); index != -1 {
+		prefixes = append(prefixes, appID[:index])
+	}
+	if teamID, ok := entitlements[teamIdentifierEntitlement].(string); ok && teamID != "" {
+		prefixes = append(prefixes, teamID)
+	}
+
+	result := make(map[string]interface{}, len(entitlements))
+	for key, value := range entitlements {
+		switch v := value.(type) {
+		case string:
+			if concrete, ok := concretiseIdentifier(v, prefixes, bundleID); ok {
+				result[key] = concrete
+			} else {
+				result[key] = v
+			}
+		case []interface{}:
+			elements := []interface{}{}
+			seen := map[string]bool{}
+			for _, element := range v {
+				s, isString := element.(string)
+				if !isString {
+					elements = append(elements, element)
+					continue
+				}
+				concrete, ok := concretiseIdentifier(s, prefixes, bundleID)
+				if !ok {
+					if strings.Contains(s, "*") && hasAnyPrefix(s, prefixes) {
+						continue
+					}
+					concrete = s
+				}
+				if !seen[concrete] {
+					seen[concrete] = true
+					elements = append(elements, concrete)
+				}
+			}
+			result[key] = elements
+		default:
+			result[key] = value
+		}
+	}
+	if len(prefixes) > 0 && appID != "" {
+		result[applicationIdentifierKey] = prefixes[0] + "." + bundleID
+	}
+	return result
+}
+
+//ReadBundleEntitlements returns the entitlements the executable of the bundle at bundlePath was signed with.
+func ReadBundleEntitlements(bundlePath string) (map[string]interface{}, error) {
+	executable, err := getBundleExecutable(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := ReadEntitlements(path.Join(bundlePath, executable))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading entitlements of %s: %w", bundlePath, err)
+	}
+	return signed, nil
+}
+
+//WriteEntitlements stores the entitlements as XML plist at outputPath, the format codesign expects.
+func WriteEntitlements(outputPath string, entitlements map[string]interface{}) error {
+	data, err := plist.MarshalIndent(entitlements, plist.XMLFormat, "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outputPath, data, 0644)
+}
+
+//WriteMergedEntitlements merges the entitlements of the executable of the bundle at bundlePath with the granted ones
+//of a profile, see MergeEntitlements, and writes them as XML plist to outputPath. It returns the dropped keys.
+func WriteMergedEntitlements(bundlePath string, granted map[string]interface{}, teamID string, outputPath string) ([]string, error) {
+	signed, err := ReadBundleEntitlements(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	merged, removed := MergeEntitlements(signed, granted, teamID)
+	return removed, WriteEntitlements(outputPath, merged)
+}
+
+//concretiseIdentifier turns PREFIX.* or PREFIX.com.acme.* into PREFIX.<bundleID> if the wildcard covers the bundle.
+//It returns false for values that are no team prefixed wildcards or that do not cover bundleID.
+func concretiseIdentifier(value string, prefixes []string, bundleID string) (string, bool) {
+	if !strings.Contains(value, "*") {
+		return value, false
+	}
+	for _, prefix := range prefixes {
+		if !strings.HasPrefix(value, prefix+".") {
+			continue
+		}
+		if _, ok := MatchAppID(strings.TrimPrefix(value, prefix+"."), bundleID); ok {
+			return prefix + "." + bundleID, true
+		}
+	}
+	return value, false
+}
+
+func hasAnyPrefix(value string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func mergeEntitlement(value interface{}, granted interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case string:
+		if entitlementGranted(v, granted) {
+			return v, true
+		}
+		if g, ok := granted.(string); ok && !strings.Contains(g, "*") {
+			return g, true
+		}
+		return nil, false
+	case []interface{}:
+		kept := []interface{}{}
+		for _, element := range v {
+			if s, ok := element.(string); ok && entitlementGranted(s, granted) {
+				kept = append(kept, s)
+			}
+		}
+		return kept, len(kept) > 0
+	case bool:
+		if g, ok := granted.(bool); ok {
+			return v && g, true
+		}
+		//boolean capabilities are often granted as "*" or an array containing it
+		return v, entitlementGranted("*", granted)
+	}
+	return value, true
+}
+
+//entitlementGranted returns true if value equals one of the granted values or matches one ending with '*'
+func entitlementGranted(value string, granted interface{}) bool {
+	patterns := []string{}
+	switch g := granted.(type) {
+	case string:
+		patterns = append(patterns, g)
+	case []interface{}:
+		for _, element := range g {
+			if s, ok := element.(string); ok {
+				patterns = append(patterns, s)
+			}
+		}
+	}
+	for _, pattern := range patterns {
+		if pattern == value || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(value, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+//signedTeamID returns the team id the entitlements were created for
+func signedTeamID(entitlements map[string]interface{}) string {
+	if teamID, ok := entitlements[teamIdentifierEntitlement].(string); ok {
+		return teamID
+	}
+	if appID, ok := entitlements[applicationIdentifierKey].(string); ok && strings.Contains(appID, ".") {
+		return appID[:strings.Index(appID, ".")]
+	}
+	return ""
+}
+
+//rewriteTeamID replaces the team id of strings that are the old team id or are prefixed with it
+func rewriteTeamID(value interface{}, oldTeamID string, teamID string) interface{} {
+	if oldTeamID == "" || teamID == "" {
+		return value
+	}
+	switch v := value.(type) {
+	case string:
+		if v == oldTeamID {
+			return teamID
+		}
+		if strings.HasPrefix(v, oldTeamID+".") {
+			return teamID + strings.TrimPrefix(v, oldTeamID)
+		}
+	case []interface{}:
+		rewritten := make([]interface{}, len(v))
+		for i, element := range v {
+			rewritten[i] = rewriteTeamID(element, oldTeamID, teamID)
+		}
+		return rewritten
+	}
+	return value
+}
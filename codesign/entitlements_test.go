@@ -0,0 +1,178 @@
+package codesign_test
+
+import (
+	"path"
+	"testing"
+
+	"github.com/danielpaulus/app-signer/codesign"
+	"github.com/stretchr/testify/assert"
+	"howett.net/plist"
+)
+
+func TestMergeEntitlements(t *testing.T) {
+	signed := map[string]interface{}{
+		"application-identifier":                                 "OLDTEAM.com.acme.app",
+		"com.apple.developer.team-identifier":                    "OLDTEAM",
+		"get-task-allow":                                         false,
+		"keychain-access-groups":                                 []interface{}{"OLDTEAM.com.acme.shared", "OTHERTEAM.com.other"},
+		"com.apple.security.application-groups":                  []interface{}{"group.com.acme"},
+		"aps-environment":                                        "production",
+		"com.apple.developer.healthkit":                          true,
+		"com.apple.developer.siri":                               true,
+		"com.apple.developer.homekit":                            true,
+		"com.apple.developer.game-center":                        true,
+		"com.apple.developer.nfc.readersession.formats":          true,
+		"com.apple.developer.icloud-container-environment":       "Production",
+		"com.apple.developer.ubiquity-kvstore-identifier":        "OLDTEAM.com.acme.kv",
+		"com.apple.developer.default-data-protection":            "NSFileProtectionComplete",
+		"com.apple.developer.associated-appclip-app-identifiers": "OTHERTEAM.com.other.clip",
+	}
+	granted := map[string]interface{}{
+		"application-identifier":                 "NEWTEAM.com.acme.*",
+		"com.apple.developer.team-identifier":    "NEWTEAM",
+		"get-task-allow":                         true,
+		"keychain-access-groups":                 []interface{}{"NEWTEAM.*"},
+		"aps-environment":                        "development",
+		"com.apple.developer.associated-domains": "*",
+		//granted values of other types or with wildcards never replace the signed value, booleans are granted by "*"
+		"com.apple.developer.siri":                               false,
+		"com.apple.developer.homekit":                            "*",
+		"com.apple.developer.game-center":                        []interface{}{"*"},
+		"com.apple.developer.nfc.readersession.formats":          []interface{}{"NDEF"},
+		"com.apple.developer.icloud-container-environment":       []interface{}{"Development", "Production"},
+		"com.apple.developer.ubiquity-kvstore-identifier":        "NEWTEAM.*",
+		"com.apple.developer.default-data-protection":            "*",
+		"com.apple.developer.associated-appclip-app-identifiers": []interface{}{"NEWTEAM.com.acme.*"},
+	}
+	merged, removed := codesign.MergeEntitlements(signed, granted, "NEWTEAM")
+	assert.Equal(t, map[string]interface{}{
+		"application-identifier":                           "NEWTEAM.com.acme.app",
+		"com.apple.developer.team-identifier":              "NEWTEAM",
+		"get-task-allow":                                   false,
+		"keychain-access-groups":                           []interface{}{"NEWTEAM.com.acme.shared"},
+		"aps-environment":                                  "development",
+		"com.apple.developer.siri":                         false,
+		"com.apple.developer.homekit":                      true,
+		"com.apple.developer.game-center":                  true,
+		"com.apple.developer.icloud-container-environment": "Production",
+		"com.apple.developer.ubiquity-kvstore-identifier":  "NEWTEAM.com.acme.kv",
+		"com.apple.developer.default-data-protection":      "NSFileProtectionComplete",
+	}, merged)
+	assert.Equal(t, []string{"com.apple.developer.associated-appclip-app-identifiers", "com.apple.developer.healthkit", "com.apple.developer.nfc.readersession.formats", "com.apple.security.application-groups"}, removed)
+
+	merged, removed = codesign.MergeEntitlements(map[string]interface{}{"aps-environment": "production", "com.apple.developer.icloud-container-environment": "Production"},
+		map[string]interface{}{"aps-environment": "*", "com.apple.developer.icloud-container-environment": []interface{}{"Development"}}, "NEWTEAM")
+	assert.Equal(t, map[string]interface{}{"aps-environment": "production"}, merged)
+	assert.Equal(t, []string{"com.apple.developer.icloud-container-environment"}, removed)
+
+	merged, removed = codesign.MergeEntitlements(map[string]interface{}{}, granted, "NEWTEAM")
+	assert.Empty(t, removed)
+	assert.Equal(t, map[string]interface{}{
+		"application-identifier":              "NEWTEAM.com.acme.*",
+		"com.apple.developer.team-identifier": "NEWTEAM",
+		"get-task-allow":                      true,
+	}, merged)
+}
+
+func TestWriteMergedEntitlements(t *testing.T) {
+	root, app, cleanup := nativelySignedApp(t)
+	defer cleanup()
+
+	signed, err := codesign.ReadEntitlements(path.Join(app, "bla"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "TEAMID1234.d.bla", signed["application-identifier"])
+	}
+
+	output := path.Join(root, "merged.plist")
+	granted := map[string]interface{}{"application-identifier": "NEWTEAM.*", "keychain-access-groups": []interface{}{"NEWTEAM.*"}}
+	removed, err := codesign.WriteMergedEntitlements(app, granted, "NEWTEAM", output)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"get-task-allow"}, removed)
+		var merged map[string]interface{}
+		_, err := plist.Unmarshal(readBytes(output), &merged)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"application-identifier": "NEWTEAM.d.bla", "keychain-access-groups": []interface{}{"NEWTEAM.*"}}, merged)
+	}
+}
+
+func TestConcretiseEntitlements(t *testing.T) {
+	profile := map[string]interface{}{
+		"application-identifier":                          "PREFIX.*",
+		"com.apple.developer.team-identifier":             "TEAMID",
+		"keychain-access-groups":                          []interface{}{"PREFIX.*", "PREFIX.com.other.*", "PREFIX.com.acme.shared", "com.apple.token"},
+		"com.apple.developer.ubiquity-kvstore-identifier": "TEAMID.*",
+		"com.apple.developer.associated-domains":          "*",
+		"get-task-allow":                                  true,
+	}
+	concrete := codesign.ConcretiseEntitlements(profile, "com.acme.app")
+	assert.Equal(t, map[string]interface{}{
+		"application-identifier":                          "PREFIX.com.acme.app",
+		"com.apple.developer.team-identifier":             "TEAMID",
+		"keychain-access-groups":                          []interface{}{"PREFIX.com.acme.app", "PREFIX.com.acme.shared", "com.apple.token"},
+		"com.apple.developer.ubiquity-kvstore-identifier": "TEAMID.com.acme.app",
+		"com.apple.developer.associated-domains":          "*",
+		"get-task-allow":                                  true,
+	}, concrete)
+	assert.Equal(t, "PREFIX.*", profile["application-identifier"])
+
+	//stale identifiers kept from the binary are replaced too
+	concrete = codesign.ConcretiseEntitlements(map[string]interface{}{"application-identifier": "PREFIX.com.old.app"}, "com.acme.app")
+	assert.Equal(t, "PREFIX.com.acme.app", concrete["application-identifier"])
+}
+
+func TestDiffEntitlements(t *testing.T) {
+	app := map[string]interface{}{
+		"application-identifier":                 "TEAMID.com.acme.app",
+		"aps-environment":                        "production",
+		"com.apple.security.application-groups":  []interface{}{"group.com.acme", "group.com.other"},
+		"com.apple.developer.associated-domains": []interface{}{"applinks:acme.com"},
+		"keychain-access-groups":                 []interface{}{"TEAMID.com.acme.app"},
+		"com.apple.developer.healthkit":          true,
+	}
+	profile := map[string]interface{}{
+		"application-identifier":                 "TEAMID.*",
+		"aps-environment":                        "development",
+		"com.apple.security.application-groups":  []interface{}{"group.com.acme"},
+		"com.apple.developer.associated-domains": "*",
+		"keychain-access-groups":                 []interface{}{"TEAMID.*"},
+		"get-task-allow":                         true,
+	}
+	diff := codesign.DiffEntitlements(app, profile, "TEAMID")
+	assert.Equal(t, []codesign.EntitlementDifference{{Key: "com.apple.developer.healthkit", App: true}}, diff.Missing)
+	assert.Equal(t, []codesign.EntitlementDifference{{Key: "get-task-allow", Profile: true}}, diff.Extra)
+	assert.Equal(t, []codesign.EntitlementDifference{
+		{Key: "aps-environment", App: "production", Profile: "development"},
+		{Key: "com.apple.security.application-groups", App: []interface{}{"group.com.acme", "group.com.other"}, Profile: []interface{}{"group.com.acme"}},
+	}, diff.Changed)
+	assert.False(t, diff.Compatible())
+
+	diff.BundleID, diff.Path, diff.Profile = "com.acme.app", "bla.app", "dev"
+	assert.Equal(t, `com.acme.app (bla.app) with profile 'dev'
+  missing  com.apple.developer.healthkit: app true, not granted by the profile
+  changed  aps-environment: app "production", profile "development"
+  changed  com.apple.security.application-groups: app ["group.com.acme","group.com.other"], profile ["group.com.acme"]
+  extra    get-task-allow: profile true, not used by the app
+`, diff.String())
+
+	assert.True(t, codesign.DiffEntitlements(map[string]interface{}{"get-task-allow": true}, map[string]interface{}{"get-task-allow": true}, "TEAMID").Compatible())
+
+	assert.True(t, codesign.DiffEntitlements(map[string]interface{}{"com.apple.developer.homekit": true}, map[string]interface{}{"com.apple.developer.homekit": "*"}, "TEAMID").Compatible())
+
+	//resigning for another team keeps the identifiers, only their team prefix changes
+	otherTeam := map[string]interface{}{
+		"application-identifier":              "OLDTEAM.com.acme.app",
+		"com.apple.developer.team-identifier": "OLDTEAM",
+		"keychain-access-groups":              []interface{}{"OLDTEAM.com.acme.app", "OLDTEAM.com.acme.shared"},
+	}
+	newTeam := map[string]interface{}{
+		"application-identifier":              "NEWTEAM.*",
+		"com.apple.developer.team-identifier": "NEWTEAM",
+		"keychain-access-groups":              []interface{}{"NEWTEAM.*"},
+	}
+	diff = codesign.DiffEntitlements(otherTeam, newTeam, "NEWTEAM")
+	assert.True(t, diff.Compatible(), diff.String())
+	assert.Empty(t, diff.Changed)
+	diff = codesign.DiffEntitlements(otherTeam, newTeam, "THIRDTEAM")
+	assert.Len(t, diff.Changed, 3)
+	assert.Equal(t, "OLDTEAM.com.acme.app", diff.Changed[0].App, "the app's values are reported as signed")
+}
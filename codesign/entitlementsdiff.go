@@ -0,0 +1,113 @@
+package codesign
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+//EntitlementDifference is one key that differs between the entitlements of an app and a profile.
+//App or Profile is nil if the key only exists on one side.
+type EntitlementDifference struct {
+	Key     string      `json:"key"`
+	App     interface{} `json:"app,omitempty"`
+	Profile interface{} `json:"profile,omitempty"`
+}
+
+//EntitlementsDiff compares the entitlements a bundle is signed with against the ones its profile grants.
+//Missing keys are used by the app but not granted by the profile, Extra keys are granted but not used.
+//Changed keys exist on both sides, but the profile's value does not grant the app's value, f.ex. a different
+//aps-environment or app groups not contained in the profile.
+type EntitlementsDiff struct {
+	BundleID string                  `json:"bundleId"`
+	Path     string                  `json:"path"`
+	Profile  string                  `json:"profile"`
+	Missing  []EntitlementDifference `json:"missing"`
+	Extra    []EntitlementDifference `json:"extra"`
+	Changed  []EntitlementDifference `json:"changed"`
+}
+
+//DiffEntitlements compares the entitlements of an app with the ones granted by a profile of the team teamID.
+//Values prefixed with the app's old team id are compared with the prefix replaced by teamID, like MergeEntitlements
+//does when signing. Wildcards in the profile, like TEAMID.* in keychain-access-groups, grant every value they match.
+//The differences are sorted by key and contain the app's values as they are signed.
+func DiffEntitlements(app map[string]interface{}, profile map[string]interface{}, teamID string) EntitlementsDiff {
+	diff := EntitlementsDiff{Missing: []EntitlementDifference{}, Extra: []EntitlementDifference{}, Changed: []EntitlementDifference{}}
+	oldTeamID := signedTeamID(app)
+	for key, value := range app {
+		granted, ok := profile[key]
+		if !ok {
+			diff.Missing = append(diff.Missing, EntitlementDifference{Key: key, App: value})
+			continue
+		}
+		if !grantsEntitlement(rewriteTeamID(value, oldTeamID, teamID), granted) {
+			diff.Changed = append(diff.Changed, EntitlementDifference{Key: key, App: value, Profile: granted})
+		}
+	}
+	for key, granted := range profile {
+		if _, ok := app[key]; !ok {
+			diff.Extra = append(diff.Extra, EntitlementDifference{Key: key, Profile: granted})
+		}
+	}
+	for _, differences := range [][]EntitlementDifference{diff.Missing, diff.Extra, diff.Changed} {
+		sort.Slice(differences, func(i, j int) bool { return differences[i].Key < differences[j].Key })
+	}
+	return diff
+}
+
+//Compatible returns true if the profile grants every entitlement of the app with the same value.
+func (d EntitlementsDiff) Compatible() bool {
+	return len(d.Missing) == 0 && len(d.Changed) == 0
+}
+
+//String prints the diff in a human readable form, one line per difference
+func (d EntitlementsDiff) String() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%s (%s) with profile '%s'", d.BundleID, d.Path, d.Profile)
+	if len(d.Missing)+len(d.Extra)+len(d.Changed) == 0 {
+		builder.WriteString(": entitlements match\n")
+		return builder.String()
+	}
+	builder.WriteString("\n")
+	for _, difference := range d.Missing {
+		fmt.Fprintf(&builder, "  missing  %s: app %s, not granted by the profile\n", difference.Key, formatEntitlement(difference.App))
+	}
+	for _, difference := range d.Changed {
+		fmt.Fprintf(&builder, "  changed  %s: app %s, profile %s\n", difference.Key, formatEntitlement(difference.App), formatEntitlement(difference.Profile))
+	}
+	for _, difference := range d.Extra {
+		fmt.Fprintf(&builder, "  extra    %s: profile %s, not used by the app\n", difference.Key, formatEntitlement(difference.Profile))
+	}
+	return builder.String()
+}
+
+//grantsEntitlement checks if the granted value of a profile covers the value of the app
+func grantsEntitlement(value interface{}, granted interface{}) bool {
+	switch v := value.(type) {
+	case string:
+		return entitlementGranted(v, granted)
+	case []interface{}:
+		for _, element := range v {
+			s, ok := element.(string)
+			if !ok || !entitlementGranted(s, granted) {
+				return false
+			}
+		}
+		return true
+	case bool:
+		if _, ok := granted.(bool); !ok {
+			return entitlementGranted("*", granted)
+		}
+	}
+	return reflect.DeepEqual(value, granted)
+}
+
+func formatEntitlement(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
@@ -9,16 +9,12 @@ import (
 )
 
 const bundleIdentifierKey = "CFBundleIdentifier"
+const executableKey = "CFBundleExecutable"
 const infoPlist = "Info.plist"
 
 // GetBundleIdentifier finds the Info.plist and returns the bundleid of an app
 func GetBundleIdentifier(binDir string) (string, error) {
-	plistBytes, err := ioutil.ReadFile(path.Join(binDir, infoPlist))
-	if err != nil {
-		return "", err
-	}
-	var data map[string]interface{}
-	_, err = plist.Unmarshal(plistBytes, &data)
+	data, err := readInfoPlist(binDir)
 	if err != nil {
 		return "", err
 	}
@@ -27,3 +23,16 @@ func GetBundleIdentifier(binDir string) (string, error) {
 	}
 	return "", fmt.Errorf("%s not in Info.plist: %+v", bundleIdentifierKey, data)
 }
+
+func readInfoPlist(binDir string) (map[string]interface{}, error) {
+	plistBytes, err := ioutil.ReadFile(path.Join(binDir, infoPlist))
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]interface{}
+	_, err = plist.Unmarshal(plistBytes, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,260 @@
+package codesign
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+//Mach-O header magics and load commands needed to place an embedded signature.
+//debug/macho only reads binaries, so the signer keeps its own minimal view of the headers
+//to be able to rewrite them.
+const (
+	machoMagic32     = 0xfeedface
+	machoMagic64     = 0xfeedfacf
+	fatMagic         = 0xcafebabe
+	machoExecute     = 0x2
+	lcSegment        = 0x1
+	lcSegment64      = 0x19
+	lcCodeSignature  = 0x1d
+	fatArchSize      = 20
+	fatHeaderSize    = 8
+	linkeditSegment  = "__LINKEDIT"
+	textSegment      = "__TEXT"
+	signatureAlign   = 16
+	segmentPageAlign = 0x4000
+)
+
+//machoSliceData is one architecture of a binary, thin binaries consist of exactly one.
+type machoSliceData struct {
+	cpuType    uint32
+	cpuSubtype uint32
+	align      uint32
+	data       []byte
+}
+
+//splitMachO returns the slices of a universal binary or the binary itself if it is thin.
+func splitMachO(data []byte) ([]machoSliceData, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("file too small to be a mach-o binary")
+	}
+	if binary.BigEndian.Uint32(data) != fatMagic {
+		m, err := parseMachOSlice(data)
+		if err != nil {
+			return nil, err
+		}
+		return []machoSliceData{{cpuType: m.cpuType, cpuSubtype: m.cpuSubtype, align: 14, data: data}}, nil
+	}
+	count := binary.BigEndian.Uint32(data[4:])
+	if fatHeaderSize+int(count)*fatArchSize > len(data) {
+		return nil, fmt.Errorf("universal binary header out of bounds")
+	}
+	slices := make([]machoSliceData, count)
+	for i := 0; i < int(count); i++ {
+		arch := data[fatHeaderSize+i*fatArchSize:]
+		offset := binary.BigEndian.Uint32(arch[8:])
+		size := binary.BigEndian.Uint32(arch[12:])
+		if uint64(offset)+uint64(size) > uint64(len(data)) {
+			return nil, fmt.Errorf("slice %d of universal binary out of bounds", i)
+		}
+		slices[i] = machoSliceData{
+			cpuType:    binary.BigEndian.Uint32(arch),
+			cpuSubtype: binary.BigEndian.Uint32(arch[4:]),
+			align:      binary.BigEndian.Uint32(arch[16:]),
+			data:       data[offset : offset+size],
+		}
+	}
+	return slices, nil
+}
+
+//isMachOFile checks the magic of the file at filePath for a thin or universal Mach-O binary
+func isMachOFile(filePath string) (bool, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false, nil
+	}
+	for _, value := range []uint32{binary.LittleEndian.Uint32(magic), binary.BigEndian.Uint32(magic)} {
+		if value == machoMagic32 || value == machoMagic64 || value == fatMagic {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//joinMachO is the reverse of splitMachO. A single slice that came from a thin binary is returned as is,
+//otherwise a universal binary is created with every slice placed at its required alignment.
+func joinMachO(slices []machoSliceData, universal bool) []byte {
+	if !universal && len(slices) == 1 {
+		return slices[0].data
+	}
+	header := make([]byte, fatHeaderSize+len(slices)*fatArchSize)
+	binary.BigEndian.PutUint32(header, fatMagic)
+	binary.BigEndian.PutUint32(header[4:], uint32(len(slices)))
+	out := bytes.NewBuffer(header)
+	for i, slice := range slices {
+		offset := alignUp(uint64(out.Len()), uint64(1)<<slice.align)
+		out.Write(make([]byte, offset-uint64(out.Len())))
+		arch := header[fatHeaderSize+i*fatArchSize:]
+		binary.BigEndian.PutUint32(arch, slice.cpuType)
+		binary.BigEndian.PutUint32(arch[4:], slice.cpuSubtype)
+		binary.BigEndian.PutUint32(arch[8:], uint32(offset))
+		binary.BigEndian.PutUint32(arch[12:], uint32(len(slice.data)))
+		binary.BigEndian.PutUint32(arch[16:], slice.align)
+		out.Write(slice.data)
+	}
+	result := out.Bytes()
+	copy(result, header)
+	return result
+}
+
+//machoHeader keeps the offsets of the load commands the signer needs to modify.
+//All offsets are relative to the start of the slice, -1 means the command is not present.
+type machoHeader struct {
+	data            []byte
+	byteOrder       binary.ByteOrder
+	is64            bool
+	cpuType         uint32
+	cpuSubtype      uint32
+	fileType        uint32
+	headerSize      int
+	sizeOfCmds      uint32
+	codeSignature   int
+	linkedit        int
+	text            int
+	firstSectionOff uint64
+}
+
+func parseMachOSlice(data []byte) (machoHeader, error) {
+	m := machoHeader{data: data, codeSignature: -1, linkedit: -1, text: -1}
+	if len(data) < 28 {
+		return m, fmt.Errorf("file too small to be a mach-o binary")
+	}
+	switch {
+	case binary.LittleEndian.Uint32(data) == machoMagic64:
+		m.byteOrder, m.is64, m.headerSize = binary.LittleEndian, true, 32
+	case binary.LittleEndian.Uint32(data) == machoMagic32:
+		m.byteOrder, m.headerSize = binary.LittleEndian, 28
+	case binary.BigEndian.Uint32(data) == machoMagic64:
+		m.byteOrder, m.is64, m.headerSize = binary.BigEndian, true, 32
+	case binary.BigEndian.Uint32(data) == machoMagic32:
+		m.byteOrder, m.headerSize = binary.BigEndian, 28
+	default:
+		return m, fmt.Errorf("invalid mach-o magic %x", data[:4])
+	}
+	bo := m.byteOrder
+	m.cpuType = bo.Uint32(data[4:])
+	m.cpuSubtype = bo.Uint32(data[8:])
+	m.fileType = bo.Uint32(data[12:])
+	ncmds := bo.Uint32(data[16:])
+	m.sizeOfCmds = bo.Uint32(data[20:])
+	if uint64(m.headerSize)+uint64(m.sizeOfCmds) > uint64(len(data)) {
+		return m, fmt.Errorf("load commands out of bounds")
+	}
+	m.firstSectionOff = uint64(len(data))
+	offset := m.headerSize
+	for i := uint32(0); i < ncmds; i++ {
+		if offset+8 > m.headerSize+int(m.sizeOfCmds) {
+			return m, fmt.Errorf("load command %d out of bounds", i)
+		}
+		cmd := bo.Uint32(data[offset:])
+		cmdSize := int(bo.Uint32(data[offset+4:]))
+		if cmdSize < 8 || offset+cmdSize > m.headerSize+int(m.sizeOfCmds) {
+			return m, fmt.Errorf("invalid size of load command %d", i)
+		}
+		switch cmd {
+		case lcCodeSignature:
+			m.codeSignature = offset
+		case lcSegment, lcSegment64:
+			name := string(bytes.TrimRight(data[offset+8:offset+24], "\x00"))
+			if name == linkeditSegment {
+				m.linkedit = offset
+			}
+			if name == textSegment {
+				m.text = offset
+			}
+			m.trackFirstSection(offset, cmd == lcSegment64)
+		}
+		offset += cmdSize
+	}
+	if m.linkedit == -1 {
+		return m, fmt.Errorf("binary has no %s segment", linkeditSegment)
+	}
+	return m, nil
+}
+
+//trackFirstSection remembers the lowest file offset of any section, the space between the end of the
+//load commands and that offset is free and can be used to add a LC_CODE_SIGNATURE.
+func (m *machoHeader) trackFirstSection(segmentOffset int, is64 bool) {
+	bo := m.byteOrder
+	var nsects uint32
+	var sectionStart, sectionSize, offsetField, flagsField int
+	if is64 {
+		nsects, sectionStart, sectionSize, offsetField, flagsField = bo.Uint32(m.data[segmentOffset+64:]), 72, 80, 48, 64
+	} else {
+		nsects, sectionStart, sectionSize, offsetField, flagsField = bo.Uint32(m.data[segmentOffset+48:]), 56, 68, 40, 56
+	}
+	for i := 0; i < int(nsects); i++ {
+		section := segmentOffset + sectionStart + i*sectionSize
+		if section+sectionSize > len(m.data) {
+			return
+		}
+		sectionType := bo.Uint32(m.data[section+flagsField:]) & 0xff
+		fileOffset := uint64(bo.Uint32(m.data[section+offsetField:]))
+		//zerofill sections have no file contents
+		if fileOffset == 0 || sectionType == 0x1 || sectionType == 0xc || sectionType == 0x12 {
+			continue
+		}
+		if fileOffset < m.firstSectionOff {
+			m.firstSectionOff = fileOffset
+		}
+	}
+}
+
+func (m machoHeader) codeSignatureRange() (uint32, uint32, bool) {
+	if m.codeSignature == -1 {
+		return 0, 0, false
+	}
+	return m.byteOrder.Uint32(m.data[m.codeSignature+8:]), m.byteOrder.Uint32(m.data[m.codeSignature+12:]), true
+}
+
+//segmentRange returns fileoff and filesize of the segment command at offset.
+func (m machoHeader) segmentRange(offset int) (uint64, uint64) {
+	if offset == -1 {
+		return 0, 0
+	}
+	if m.is64 {
+		return m.byteOrder.Uint64(m.data[offset+40:]), m.byteOrder.Uint64(m.data[offset+48:])
+	}
+	return uint64(m.byteOrder.Uint32(m.data[offset+32:])), uint64(m.byteOrder.Uint32(m.data[offset+36:]))
+}
+
+//setLinkeditSize updates filesize and, if needed, vmsize of the __LINKEDIT segment so it
+//ends exactly at end.
+func (m machoHeader) setLinkeditSize(end uint64) {
+	fileOff, _ := m.segmentRange(m.linkedit)
+	fileSize := end - fileOff
+	vmSize := alignUp(fileSize, segmentPageAlign)
+	bo := m.byteOrder
+	if m.is64 {
+		bo.PutUint64(m.data[m.linkedit+48:], fileSize)
+		if bo.Uint64(m.data[m.linkedit+32:]) < vmSize {
+			bo.PutUint64(m.data[m.linkedit+32:], vmSize)
+		}
+		return
+	}
+	bo.PutUint32(m.data[m.linkedit+36:], uint32(fileSize))
+	if uint64(bo.Uint32(m.data[m.linkedit+28:])) < vmSize {
+		bo.PutUint32(m.data[m.linkedit+28:], uint32(vmSize))
+	}
+}
+
+func alignUp(value uint64, alignment uint64) uint64 {
+	return (value + alignment - 1) / alignment * alignment
+}
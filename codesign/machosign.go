@@ -0,0 +1,318 @@
+package codesign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"howett.net/plist"
+)
+
+//cmsSizeSlack is added to the estimated size of the CMS signature when reserving space for the
+//embedded signature. ECDSA signatures and the signing time do not always encode to the same length.
+const cmsSizeSlack = 512
+
+//MachOSigningOptions contains everything that goes into the embedded signature of a Mach-O binary.
+//Without Certificate and PrivateKey an ad-hoc signature is created.
+//InfoPlist and CodeResources are the raw file contents of the bundle the binary belongs to, their
+//hashes are stored in the special slots of the CodeDirectory. Entitlements must be a plist and are
+//only embedded into main executables.
+type MachOSigningOptions struct {
+	Identifier       string
+	TeamID           string
+	Certificate      *x509.Certificate
+	PrivateKey       crypto.Signer
+	CertificateChain []*x509.Certificate
+	Entitlements     []byte
+	InfoPlist        []byte
+	CodeResources    []byte
+}
+
+//SignMachO replaces the embedded signature of the thin or universal Mach-O binary at binaryPath with
+//a new one. It writes CodeDirectories with SHA-1 and SHA-256 hashes, the designated requirement,
+//entitlements and a CMS signature made with the given key directly into the file.
+//Existing signatures are replaced in place, unsigned binaries get a new LC_CODE_SIGNATURE load command.
+func SignMachO(binaryPath string, options MachOSigningOptions) error {
+	info, err := os.Stat(binaryPath)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(binaryPath)
+	if err != nil {
+		return err
+	}
+	signed, err := signMachOBytes(data, options)
+	if err != nil {
+		return fmt.Errorf("failed signing %s: %w", binaryPath, err)
+	}
+	return ioutil.WriteFile(binaryPath, signed, info.Mode())
+}
+
+func signMachOBytes(data []byte, options MachOSigningOptions) ([]byte, error) {
+	if options.Identifier == "" {
+		return nil, fmt.Errorf("signing identifier must not be empty")
+	}
+	if (options.Certificate == nil) != (options.PrivateKey == nil) {
+		return nil, fmt.Errorf("certificate and private key must be provided together")
+	}
+	if options.TeamID == "" && options.Certificate != nil && len(options.Certificate.Subject.OrganizationalUnit) > 0 {
+		options.TeamID = options.Certificate.Subject.OrganizationalUnit[0]
+	}
+	universal := len(data) >= 4 && binary.BigEndian.Uint32(data) == fatMagic
+	slices, err := splitMachO(data)
+	if err != nil {
+		return nil, err
+	}
+	signingTime := time.Now()
+	for i := range slices {
+		slices[i].data, err = signSlice(slices[i].data, options, signingTime)
+		if err != nil {
+			return nil, fmt.Errorf("slice %d: %w", i, err)
+		}
+	}
+	return joinMachO(slices, universal), nil
+}
+
+//signatureBlobs are the parts of the embedded signature that do not depend on the binary contents.
+type signatureBlobs struct {
+	requirements    []byte
+	entitlements    []byte
+	derEntitlements []byte
+	execSegFlags    uint64
+}
+
+func newSignatureBlobs(m machoHeader, options MachOSigningOptions) (signatureBlobs, error) {
+	requirements, err := buildRequirementsBlob(options.Identifier, options.Certificate)
+	if err != nil {
+		return signatureBlobs{}, err
+	}
+	blobs := signatureBlobs{requirements: requirements}
+	if m.fileType != machoExecute {
+		return blobs, nil
+	}
+	blobs.execSegFlags = csExecSegMainBinary
+	if len(options.Entitlements) == 0 {
+		return blobs, nil
+	}
+	blobs.entitlements = newBlob(csMagicEmbeddedEntitlements, options.Entitlements)
+	der, err := encodeDerEntitlements(options.Entitlements)
+	if err != nil {
+		return signatureBlobs{}, err
+	}
+	blobs.derEntitlements = newBlob(csMagicEmbeddedDerEntitlements, der)
+
+	var entitlements map[string]interface{}
+	_, err = plist.Unmarshal(options.Entitlements, &entitlements)
+	if err != nil {
+		return signatureBlobs{}, err
+	}
+	if allow, ok := entitlements["get-task-allow"].(bool); ok && allow {
+		blobs.execSegFlags |= csExecSegAllowUnsigned
+	}
+	return blobs, nil
+}
+
+func signSlice(original []byte, options MachOSigningOptions, signingTime time.Time) ([]byte, error) {
+	m, err := parseMachOSlice(original)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	reserved := uint64(0)
+	if offset, size, ok := m.codeSignatureRange(); ok {
+		//drop the old signature, its space is reused if the new one fits
+		if uint64(offset) > uint64(len(original)) {
+			return nil, fmt.Errorf("existing code signature out of bounds")
+		}
+		data = append([]byte{}, original[:offset]...)
+		reserved = uint64(size)
+	} else {
+		data = append([]byte{}, original...)
+	}
+	m, err = parseMachOSlice(data)
+	if err != nil {
+		return nil, err
+	}
+	if m.codeSignature == -1 {
+		m, err = addCodeSignatureCommand(m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	signatureOffset := alignUp(uint64(len(data)), signatureAlign)
+	data = append(data, make([]byte, signatureOffset-uint64(len(data)))...)
+	m.data = data
+
+	blobs, err := newSignatureBlobs(m, options)
+	if err != nil {
+		return nil, err
+	}
+	size, err := estimateSignatureSize(signatureOffset, m, blobs, options, signingTime)
+	if err != nil {
+		return nil, err
+	}
+	if reserved > size {
+		size = reserved
+	}
+	m.byteOrder.PutUint32(data[m.codeSignature+8:], uint32(signatureOffset))
+	m.byteOrder.PutUint32(data[m.codeSignature+12:], uint32(size))
+	m.setLinkeditSize(signatureOffset + size)
+
+	signature, err := buildEmbeddedSignature(data, m, blobs, options, signingTime)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(signature)) > size {
+		return nil, fmt.Errorf("signature of %d bytes does not fit into the reserved %d bytes", len(signature), size)
+	}
+	data = append(data, signature...)
+	return append(data, make([]byte, size-uint64(len(signature)))...), nil
+}
+
+//addCodeSignatureCommand appends a LC_CODE_SIGNATURE to the load commands. This only works if
+//there is enough padding between the load commands and the first section, which the linker usually leaves.
+func addCodeSignatureCommand(m machoHeader) (machoHeader, error) {
+	end := uint64(m.headerSize) + uint64(m.sizeOfCmds)
+	if end+16 > m.firstSectionOff {
+		return m, fmt.Errorf("not enough space to add LC_CODE_SIGNATURE load command")
+	}
+	for _, b := range m.data[end : end+16] {
+		if b != 0 {
+			return m, fmt.Errorf("space after load commands is not empty, can not add LC_CODE_SIGNATURE")
+		}
+	}
+	bo := m.byteOrder
+	bo.PutUint32(m.data[end:], lcCodeSignature)
+	bo.PutUint32(m.data[end+4:], 16)
+	bo.PutUint32(m.data[16:], bo.Uint32(m.data[16:])+1)
+	bo.PutUint32(m.data[20:], m.sizeOfCmds+16)
+	return parseMachOSlice(m.data)
+}
+
+//estimateSignatureSize builds the signature once with the final blob sizes to find out how much
+//space needs to be reserved in the __LINKEDIT segment.
+func estimateSignatureSize(codeLimit uint64, m machoHeader, blobs signatureBlobs, options MachOSigningOptions, signingTime time.Time) (uint64, error) {
+	signature, err := buildEmbeddedSignature(m.data[:codeLimit], m, blobs, options, signingTime)
+	if err != nil {
+		return 0, err
+	}
+	size := uint64(len(signature))
+	if options.Certificate != nil {
+		size += cmsSizeSlack
+	}
+	return alignUp(size, signatureAlign), nil
+}
+
+//buildEmbeddedSignature hashes code and creates the superblob that is placed right after it.
+func buildEmbeddedSignature(code []byte, m machoHeader, blobs signatureBlobs, options MachOSigningOptions, signingTime time.Time) ([]byte, error) {
+	hashTypes := []uint8{csHashTypeSha1, csHashTypeSha256}
+	codeDirectories := make([][]byte, len(hashTypes))
+	for i, hashType := range hashTypes {
+		codeDirectories[i] = buildCodeDirectory(hashType, code, m, blobs, options)
+	}
+
+	cms := []byte{}
+	if options.Certificate != nil {
+		var err error
+		cms, err = buildCMSSignature(codeDirectories, hashTypes, options.Certificate, options.PrivateKey, options.CertificateChain, signingTime)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	order := []uint32{csSlotCodeDirectory, csSlotRequirements}
+	contents := map[uint32][]byte{csSlotCodeDirectory: codeDirectories[0], csSlotRequirements: blobs.requirements}
+	if blobs.entitlements != nil {
+		order = append(order, csSlotEntitlements, csSlotDerEntitlements)
+		contents[csSlotEntitlements] = blobs.entitlements
+		contents[csSlotDerEntitlements] = blobs.derEntitlements
+	}
+	for i, cd := range codeDirectories[1:] {
+		slot := uint32(csSlotAlternateCodeDirectories + i)
+		order = append(order, slot)
+		contents[slot] = cd
+	}
+	order = append(order, csSlotSignature)
+	contents[csSlotSignature] = newBlob(csMagicBlobWrapper, cms)
+	return newSuperBlob(csMagicEmbeddedSignature, order, contents), nil
+}
+
+func buildCodeDirectory(hashType uint8, code []byte, m machoHeader, blobs signatureBlobs, options MachOSigningOptions) []byte {
+	special := [][]byte{
+		hashOrNil(hashType, options.InfoPlist),
+		hashOrNil(hashType, blobs.requirements),
+		hashOrNil(hashType, options.CodeResources),
+		nil,
+		hashOrNil(hashType, blobs.entitlements),
+		nil,
+		hashOrNil(hashType, blobs.derEntitlements),
+	}
+	//only as many special slots as needed to include the last one that is used
+	nSpecialSlots := len(special)
+	for nSpecialSlots > 0 && special[nSpecialSlots-1] == nil {
+		nSpecialSlots--
+	}
+	//buildCodeDirectory is only called with the supported hash types
+	emptyHash, _ := hashBytes(hashType, nil)
+	hashSize := len(emptyHash)
+	nCodeSlots := (len(code) + pageSize - 1) / pageSize
+
+	identOffset := codeDirectoryHeaderSize
+	teamOffset := 0
+	hashOffset := identOffset + len(options.Identifier) + 1
+	if options.TeamID != "" {
+		teamOffset = hashOffset
+		hashOffset += len(options.TeamID) + 1
+	}
+	hashOffset += nSpecialSlots * hashSize
+	length := hashOffset + nCodeSlots*hashSize
+
+	flags := uint32(0)
+	if options.Certificate == nil {
+		flags = csAdhoc
+	}
+	textOffset, textSize := m.segmentRange(m.text)
+
+	cd := &bytes.Buffer{}
+	writeUint32s(cd, csMagicCodeDirectory, uint32(length), codeDirectoryVersion, flags, uint32(hashOffset), uint32(identOffset),
+		uint32(nSpecialSlots), uint32(nCodeSlots), uint32(len(code)))
+	cd.Write([]byte{byte(hashSize), hashType, 0, pageSizeBits})
+	//spare2, scatterOffset, teamOffset, spare3
+	writeUint32s(cd, 0, 0, uint32(teamOffset), 0)
+	binary.Write(cd, binary.BigEndian, []uint64{0, textOffset, textSize, blobs.execSegFlags})
+	cd.WriteString(options.Identifier)
+	cd.WriteByte(0)
+	if options.TeamID != "" {
+		cd.WriteString(options.TeamID)
+		cd.WriteByte(0)
+	}
+	for i := nSpecialSlots - 1; i >= 0; i-- {
+		if special[i] == nil {
+			cd.Write(make([]byte, hashSize))
+			continue
+		}
+		cd.Write(special[i])
+	}
+	for page := 0; page < nCodeSlots; page++ {
+		end := (page + 1) * pageSize
+		if end > len(code) {
+			end = len(code)
+		}
+		hash, _ := hashBytes(hashType, code[page*pageSize:end])
+		cd.Write(hash)
+	}
+	return cd.Bytes()
+}
+
+func hashOrNil(hashType uint8, data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	hash, _ := hashBytes(hashType, data)
+	return hash
+}
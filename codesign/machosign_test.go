@@ -0,0 +1,175 @@
+package codesign_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"debug/macho"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/app-signer/codesign"
+	"github.com/fullsailor/pkcs7"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+//TestAdhocSignatureMatchesCodesign re-signs the simulator fixture, which was signed by Xcode, with the same
+//inputs codesign used and checks that all the hashes end up exactly the same.
+func TestAdhocSignatureMatchesCodesign(t *testing.T) {
+	appdir, cleanup := extractSimulatorApp()
+	defer cleanup()
+	binary := path.Join(appdir, "bla")
+	original, err := codesign.ReadEmbeddedSignatures(binary)
+	if err != nil {
+		log.Fatalf("failed reading fixture signature: %+v", err)
+	}
+
+	err = codesign.SignMachO(binary, codesign.MachOSigningOptions{
+		Identifier:    "d.bla",
+		Entitlements:  original[0].Entitlements,
+		InfoPlist:     readBytes(path.Join(appdir, "Info.plist")),
+		CodeResources: readBytes(path.Join(appdir, "_CodeSignature", "CodeResources")),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	resigned, err := codesign.ReadEmbeddedSignatures(binary)
+	if assert.NoError(t, err) && assert.Equal(t, len(original), len(resigned)) {
+		for i := range original {
+			expected := original[i].BestCodeDirectory()
+			actual := resigned[i].BestCodeDirectory()
+			assert.Equal(t, expected.Identifier, actual.Identifier)
+			assert.Equal(t, expected.CodeLimit, actual.CodeLimit)
+			assert.Equal(t, expected.ExecSegLimit, actual.ExecSegLimit)
+			assert.Equal(t, expected.ExecSegFlags, actual.ExecSegFlags)
+			assert.Equal(t, expected.CodeSlots, actual.CodeSlots)
+			for _, slot := range []int{1, 2, 3, 5} {
+				assert.Equal(t, expected.SpecialSlot(slot), actual.SpecialSlot(slot), "special slot -%d", slot)
+			}
+			assert.Equal(t, 2, len(resigned[i].CodeDirectories))
+		}
+	}
+	_, err = macho.OpenFat(binary)
+	assert.NoError(t, err)
+}
+
+func TestSignMachOWithCertificate(t *testing.T) {
+	appdir, cleanup := extractSimulatorApp()
+	defer cleanup()
+	binary := path.Join(appdir, "bla")
+	cert, key := makeSigningCertificate("Apple Development: Test (ABC)", "TEAMID1234")
+
+	err := codesign.SignMachO(binary, codesign.MachOSigningOptions{
+		Identifier:   "d.bla",
+		Certificate:  cert,
+		PrivateKey:   key,
+		Entitlements: []byte(entitlementsFixture),
+		InfoPlist:    readBytes(path.Join(appdir, "Info.plist")),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	signatures, err := codesign.ReadEmbeddedSignatures(binary)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, signature := range signatures {
+		if !assert.Equal(t, 2, len(signature.CodeDirectories)) {
+			continue
+		}
+		assert.Equal(t, "TEAMID1234", signature.CodeDirectories[0].TeamID)
+		assert.Equal(t, uint8(1), signature.CodeDirectories[0].HashType)
+		assert.Equal(t, uint8(2), signature.CodeDirectories[1].HashType)
+		//get-task-allow needs the allow unsigned exec segment flag
+		assert.Equal(t, uint64(0x11), signature.CodeDirectories[1].ExecSegFlags)
+		assert.Contains(t, string(signature.Requirements), "subject.CN")
+
+		p7, err := pkcs7.Parse(signature.CMSSignature)
+		if assert.NoError(t, err) {
+			p7.Content = signature.CodeDirectories[0].Raw
+			assert.NoError(t, p7.Verify())
+			assert.Equal(t, cert.Raw, p7.GetOnlySigner().Raw)
+		}
+	}
+}
+
+func TestResigningReplacesSignature(t *testing.T) {
+	appdir, cleanup := extractSimulatorApp()
+	defer cleanup()
+	binary := path.Join(appdir, "bla")
+	cert, key := makeSigningCertificate("Apple Development: Test (ABC)", "TEAMID1234")
+	options := codesign.MachOSigningOptions{Identifier: "d.bla", Certificate: cert, PrivateKey: key}
+
+	err := codesign.SignMachO(binary, options)
+	assert.NoError(t, err)
+	//signing again must replace the first signature instead of appending
+	sizeAfterFirstSigning := len(readBytes(binary))
+	err = codesign.SignMachO(binary, options)
+	assert.NoError(t, err)
+	assert.Equal(t, sizeAfterFirstSigning, len(readBytes(binary)))
+
+	err = codesign.SignMachO(binary, codesign.MachOSigningOptions{Certificate: cert, PrivateKey: key})
+	assert.Error(t, err)
+}
+
+const entitlementsFixture = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>application-identifier</key>
+	<string>TEAMID1234.d.bla</string>
+	<key>get-task-allow</key>
+	<true/>
+	<key>keychain-access-groups</key>
+	<array>
+		<string>TEAMID1234.*</string>
+	</array>
+</dict>
+</plist>
+`
+
+func extractSimulatorApp() (string, func()) {
+	zipBytes := readBytes("../architecturecheck/fixtures/simulator-app.zip")
+	_, directory, err := codesign.ExtractZip(bytes.NewReader(zipBytes), int64(len(zipBytes)))
+	if err != nil {
+		log.Fatalf("failed extracting: %+v", err)
+	}
+	appdir, err := codesign.FindAppFolderVirtualDevice(directory)
+	if err != nil {
+		log.Fatalf("failed finding app: %+v", err)
+	}
+	return appdir, func() { os.RemoveAll(directory) }
+}
+
+//makeSigningCertificate creates a self signed certificate that looks like an Apple development certificate
+func makeSigningCertificate(commonName string, teamID string) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName, OrganizationalUnit: []string{teamID}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cert, key
+}
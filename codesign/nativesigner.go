@@ -0,0 +1,77 @@
+package codesign
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//NativeSigner signs bundles without any Apple tools. It seals the resources with a generated
+//CodeResources file and writes the embedded signature using SigningCert and PrivateKey of the SigningConfig.
+type NativeSigner struct{}
+
+//SignFramework signs the dylibs in the framework, seals its resources and signs its executable
+func (NativeSigner) SignFramework(frameworkPath string, config SigningConfig) error {
+	return signBundleNatively(frameworkPath, config, nil)
+}
+
+//SignBundle signs all dylibs in the bundle, f.ex. in its Frameworks folder, seals the resources and
+//signs the main executable with the entitlements of the SigningConfig
+func (NativeSigner) SignBundle(bundlePath string, config SigningConfig) error {
+	entitlements, err := ioutil.ReadFile(config.EntitlementsFilePath)
+	if err != nil {
+		return fmt.Errorf("failed reading entitlements %s: %w", config.EntitlementsFilePath, err)
+	}
+	return signBundleNatively(bundlePath, config, entitlements)
+}
+
+func signBundleNatively(bundlePath string, config SigningConfig, entitlements []byte) error {
+	if config.SigningCert == nil || config.PrivateKey == nil {
+		return fmt.Errorf("native signing needs a certificate and private key in the signing config")
+	}
+	identifier, err := GetBundleIdentifier(bundlePath)
+	if err != nil {
+		return err
+	}
+	executable, err := getBundleExecutable(bundlePath)
+	if err != nil {
+		return err
+	}
+	err = signNestedMachOs(bundlePath, executable, func(file string) error {
+		name := filepath.Base(file)
+		return SignMachO(file, machOSigningOptions(strings.TrimSuffix(name, filepath.Ext(name)), config))
+	})
+	if err != nil {
+		return err
+	}
+	infoPlist, err := ioutil.ReadFile(path.Join(bundlePath, infoPlist))
+	if err != nil {
+		return err
+	}
+	codeResources, err := WriteCodeResources(bundlePath, CodeResourcesOptions{Certificate: config.SigningCert})
+	if err != nil {
+		return fmt.Errorf("failed sealing resources of %s: %w", bundlePath, err)
+	}
+	options := machOSigningOptions(identifier, config)
+	options.InfoPlist = infoPlist
+	options.CodeResources = codeResources
+	options.Entitlements = entitlements
+	err = SignMachO(path.Join(bundlePath, executable), options)
+	if err != nil {
+		return err
+	}
+	loggerFrom(config.signingContext()).WithFields(log.Fields{"bundle": bundlePath, "identifier": identifier}).Debug("signed natively")
+	return nil
+}
+
+func machOSigningOptions(identifier string, config SigningConfig) MachOSigningOptions {
+	return MachOSigningOptions{
+		Identifier:  identifier,
+		Certificate: config.SigningCert,
+		PrivateKey:  config.PrivateKey,
+	}
+}
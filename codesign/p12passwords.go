@@ -0,0 +1,134 @@
+package codesign
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+//P12PasswordEnvPrefix is the prefix of environment variables containing the password of a profile's p12 file,
+//f.ex. SIGN_P12PASSWORD_<UUID> or SIGN_P12PASSWORD_MY_PROFILE_NAME, see P12PasswordEnvName.
+const P12PasswordEnvPrefix = "SIGN_P12PASSWORD_"
+
+//P12PasswordManifest is the name of the passwords manifest that is read from the profiles directory if present.
+const P12PasswordManifest = "p12passwords.json"
+
+//P12PasswordSidecarExtension is the extension of a file next to a profile that contains the password of its p12,
+//f.ex. test.mobileprovision, test.p12 and test.p12password.
+const P12PasswordSidecarExtension = ".p12password"
+
+//Sources a p12 password can be resolved from, see P12Passwords.Resolve
+const (
+	PasswordSourceSidecar     = "sidecar file"
+	PasswordSourceEnvironment = "environment"
+	PasswordSourceManifest    = "manifest"
+	PasswordSourceDefault     = "default password"
+)
+
+//P12Passwords resolves the password of the p12 file belonging to each profile, so every team's certificate can have
+//its own password. Manifest maps profile UUIDs, names or file names without extension to passwords.
+//Default is used for profiles that have no password of their own.
+type P12Passwords struct {
+	Default  string
+	Manifest map[string]string
+}
+
+//LoadP12Passwords creates P12Passwords with the given default password. The manifest is read from manifestPath,
+//or from P12PasswordManifest in each directory of the path list profilesPath, see ProfileDirectories,
+//if manifestPath is empty.
+//The manifest is a JSON object mapping profile UUIDs, names or file names to passwords.
+func LoadP12Passwords(profilesPath string, defaultPassword string, manifestPath string) (P12Passwords, error) {
+	passwords := P12Passwords{Default: defaultPassword, Manifest: map[string]string{}}
+	manifests := []string{manifestPath}
+	if manifestPath == "" {
+		manifests = []string{}
+		for _, dir := range ProfileDirectories(profilesPath) {
+			manifest := path.Join(dir, P12PasswordManifest)
+			if _, err := os.Stat(manifest); err == nil {
+				manifests = append(manifests, manifest)
+			}
+		}
+	}
+	for _, manifest := range manifests {
+		data, err := ioutil.ReadFile(manifest)
+		if err != nil {
+			return passwords, fmt.Errorf("failed reading p12 password manifest: %w", err)
+		}
+		entries := map[string]string{}
+		err = json.Unmarshal(data, &entries)
+		if err != nil {
+			return passwords, fmt.Errorf("failed parsing p12 password manifest %s: %w", manifest, err)
+		}
+		for key, password := range entries {
+			if _, ok := passwords.Manifest[key]; !ok {
+				passwords.Manifest[key] = password
+			}
+		}
+	}
+	return passwords, nil
+}
+
+//Resolve returns the password for the p12 of the profile at profilePath and where it came from. In order of precedence
+//these are a sidecar file next to the profile, an environment variable for the profile's UUID or name,
+//a manifest entry for the UUID, name or file name and finally the default password.
+//Trailing newlines of sidecar files are ignored.
+func (p P12Passwords) Resolve(profilePath string, profile MobileProvisioningProfile) (string, string, error) {
+	sidecar := strings.TrimSuffix(profilePath, filepath.Ext(profilePath)) + P12PasswordSidecarExtension
+	data, err := ioutil.ReadFile(sidecar)
+	if err == nil {
+		return strings.TrimRight(string(data), "\r\n"), PasswordSourceSidecar, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", "", fmt.Errorf("failed reading p12 password file %s: %w", sidecar, err)
+	}
+
+	keys := []string{profile.UUID, profile.Name}
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if password, ok := os.LookupEnv(P12PasswordEnvName(key)); ok {
+			return password, PasswordSourceEnvironment, nil
+		}
+	}
+	keys = append(keys, strings.TrimSuffix(filepath.Base(profilePath), filepath.Ext(profilePath)))
+	for _, key := range keys {
+		if password, ok := p.Manifest[key]; ok && key != "" {
+			return password, PasswordSourceManifest, nil
+		}
+	}
+	return p.Default, PasswordSourceDefault, nil
+}
+
+//ResolveCertificate returns the password meant for the certificate file at certPath itself, that is a sidecar file
+//next to it or a manifest entry for its file name. It returns false if there is none.
+func (p P12Passwords) ResolveCertificate(certPath string) (string, bool, error) {
+	base := strings.TrimSuffix(certPath, filepath.Ext(certPath))
+	data, err := ioutil.ReadFile(base + P12PasswordSidecarExtension)
+	if err == nil {
+		return strings.TrimRight(string(data), "\r\n"), true, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", false, fmt.Errorf("failed reading p12 password file: %w", err)
+	}
+	password, ok := p.Manifest[filepath.Base(base)]
+	return password, ok, nil
+}
+
+//P12PasswordEnvName returns the environment variable holding the p12 password for a profile UUID or name.
+//The key is upper cased and every character that is no letter or digit becomes '_',
+//so the profile 'Acme Dev' is looked up in SIGN_P12PASSWORD_ACME_DEV.
+func P12PasswordEnvName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, key)
+	return P12PasswordEnvPrefix + name
+}
@@ -0,0 +1,71 @@
+package codesign_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/danielpaulus/app-signer/codesign"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestP12PasswordEnvName(t *testing.T) {
+	assert.Equal(t, "SIGN_P12PASSWORD_ACME_DEV_1", codesign.P12PasswordEnvName("Acme Dev-1"))
+	assert.Equal(t, "SIGN_P12PASSWORD_0A1B_2C", codesign.P12PasswordEnvName("0a1b-2c"))
+}
+
+func TestResolveP12Password(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p12passwords")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(path.Join(dir, codesign.P12PasswordManifest), []byte(`{"uuid-manifest": "from uuid", "Named": "from name", "file": "from file"}`), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+	passwords, err := codesign.LoadP12Passwords(dir, "default", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	resolve := func(file string, uuid string, name string) (string, string) {
+		password, source, err := passwords.Resolve(path.Join(dir, file+".mobileprovision"), codesign.MobileProvisioningProfile{UUID: uuid, Name: name})
+		assert.NoError(t, err)
+		return password, source
+	}
+	password, source := resolve("other", "uuid-manifest", "Named")
+	assert.Equal(t, "from uuid", password)
+	assert.Equal(t, codesign.PasswordSourceManifest, source)
+	password, _ = resolve("other", "unknown", "Named")
+	assert.Equal(t, "from name", password)
+	password, _ = resolve("file", "unknown", "unknown")
+	assert.Equal(t, "from file", password)
+	password, source = resolve("other", "unknown", "unknown")
+	assert.Equal(t, "default", password)
+	assert.Equal(t, codesign.PasswordSourceDefault, source)
+
+	t.Setenv(codesign.P12PasswordEnvName("Named"), "from env")
+	password, source = resolve("other", "uuid-manifest", "Named")
+	assert.Equal(t, "from env", password)
+	assert.Equal(t, codesign.PasswordSourceEnvironment, source)
+
+	err = ioutil.WriteFile(path.Join(dir, "other"+codesign.P12PasswordSidecarExtension), []byte("from sidecar\n"), 0600)
+	if !assert.NoError(t, err) {
+		return
+	}
+	password, source = resolve("other", "uuid-manifest", "Named")
+	assert.Equal(t, "from sidecar", password)
+	assert.Equal(t, codesign.PasswordSourceSidecar, source)
+}
+
+func TestLoadP12PasswordsErrors(t *testing.T) {
+	passwords, err := codesign.LoadP12Passwords(".", "default", "")
+	assert.NoError(t, err)
+	assert.Empty(t, passwords.Manifest)
+	_, err = codesign.LoadP12Passwords(".", "default", "does-not-exist.json")
+	assert.Error(t, err)
+	_, err = codesign.LoadP12Passwords(".", "default", "fixtures/embedded.mobileprovision")
+	assert.Error(t, err)
+}
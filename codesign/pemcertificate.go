@@ -0,0 +1,142 @@
+package codesign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//ParsePEMCertificate decodes a certificate and its private key from PEM data. certPEM can contain the key as well,
+//keyPEM is then empty. If certPEM contains a chain, the certificate belonging to the private key is returned.
+//Keys can be PKCS#8, PKCS#1 RSA or SEC 1 EC keys, encrypted keys are not supported.
+func ParsePEMCertificate(certPEM []byte, keyPEM []byte) (*x509.Certificate, crypto.Signer, error) {
+	certificates := []*x509.Certificate{}
+	var key crypto.Signer
+	for _, data := range [][]byte{certPEM, keyPEM} {
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			switch {
+			case block.Type == "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed parsing PEM certificate: %w", err)
+				}
+				certificates = append(certificates, cert)
+			case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+				if key != nil {
+					return nil, nil, fmt.Errorf("PEM data contains more than one private key")
+				}
+				if _, encrypted := block.Headers["DEK-Info"]; encrypted || block.Type == "ENCRYPTED PRIVATE KEY" {
+					return nil, nil, fmt.Errorf("encrypted PEM private keys are not supported")
+				}
+				parsed, err := parsePEMPrivateKey(block)
+				if err != nil {
+					return nil, nil, err
+				}
+				key = parsed
+			}
+		}
+	}
+	if len(certificates) == 0 {
+		return nil, nil, fmt.Errorf("no certificate found in PEM data")
+	}
+	if key == nil {
+		return nil, nil, fmt.Errorf("no private key found in PEM data")
+	}
+	for _, cert := range certificates {
+		if publicKeysEqual(cert.PublicKey, key.Public()) {
+			return cert, key, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("private key does not belong to any certificate in the PEM data")
+}
+
+//EncodePEMCertificate stores the certificate and key as one PEM file with a PKCS#8 key, the format
+//AddPEMToKeychain imports.
+func EncodePEMCertificate(cert *x509.Certificate, key crypto.Signer) ([]byte, error) {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	return append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})...), nil
+}
+
+//signingCertificateFiles returns the files holding the signing certificate of the profile at profilePath.
+//That is <name>.p12 if it exists, otherwise <name>.pem together with <name>.key if that exists.
+//A single <name>.pem needs to contain certificate and key.
+func signingCertificateFiles(profilePath string) (p12Path string, pemPath string, keyPath string) {
+	base := strings.TrimSuffix(profilePath, filepath.Ext(profilePath))
+	if _, err := os.Stat(base + ".p12"); err == nil {
+		return base + ".p12", "", ""
+	}
+	if _, err := os.Stat(base + ".pem"); err != nil {
+		return base + ".p12", "", ""
+	}
+	if _, err := os.Stat(base + ".key"); err == nil {
+		return "", base + ".pem", base + ".key"
+	}
+	return "", base + ".pem", ""
+}
+
+//readPEMCertificate reads the certificate and key from pemPath and the optional keyPath
+func readPEMCertificate(pemPath string, keyPath string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := ioutil.ReadFile(pemPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	var keyPEM []byte
+	if keyPath != "" {
+		keyPEM, err = ioutil.ReadFile(keyPath)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	cert, key, err := ParsePEMCertificate(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed parsing %s: %w", pemPath, err)
+	}
+	return cert, key, nil
+}
+
+func parsePEMPrivateKey(block *pem.Block) (crypto.Signer, error) {
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing PEM private key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+func publicKeysEqual(a crypto.PublicKey, b crypto.PublicKey) bool {
+	switch key := a.(type) {
+	case *rsa.PublicKey:
+		return key.Equal(b)
+	case *ecdsa.PublicKey:
+		return key.Equal(b)
+	}
+	return false
+}
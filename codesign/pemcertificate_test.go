@@ -0,0 +1,84 @@
+package codesign_test
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/danielpaulus/app-signer/codesign"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePEMCertificate(t *testing.T) {
+	cert, key := makeSigningCertificate("Apple Development: PEM (ABC)", "TEAMID")
+	other, otherKey := makeSigningCertificate("Apple Development: Other (ABC)", "TEAMID")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	otherPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	parsed, parsedKey, err := codesign.ParsePEMCertificate(certPEM, keyPEM)
+	if assert.NoError(t, err) {
+		assert.Equal(t, cert.Raw, parsed.Raw)
+		assert.True(t, key.PublicKey.Equal(parsedKey.Public()))
+	}
+
+	combined, err := codesign.EncodePEMCertificate(cert, key)
+	if assert.NoError(t, err) {
+		parsed, _, err = codesign.ParsePEMCertificate(append(otherPEM, combined...), nil)
+		if assert.NoError(t, err) {
+			assert.Equal(t, cert.Raw, parsed.Raw)
+		}
+	}
+
+	_, _, err = codesign.ParsePEMCertificate(certPEM, nil)
+	assert.EqualError(t, err, "no private key found in PEM data")
+	_, _, err = codesign.ParsePEMCertificate(keyPEM, nil)
+	assert.EqualError(t, err, "no certificate found in PEM data")
+	otherKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(otherKey)})
+	_, _, err = codesign.ParsePEMCertificate(certPEM, otherKeyPEM)
+	assert.EqualError(t, err, "private key does not belong to any certificate in the PEM data")
+	_, _, err = codesign.ParsePEMCertificate(certPEM, pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: []byte{1}}))
+	assert.EqualError(t, err, "encrypted PEM private keys are not supported")
+}
+
+func TestParseProfileWithPEM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pemprofiles")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	cert, key := makeSigningCertificate("Apple Development: PEM (ABC)", "TEAMID")
+	other, _ := makeSigningCertificate("Apple Development: Other (ABC)", "TEAMID")
+	profile := testProfile("pem", "TEAMID.*", cert.NotAfter, "device1").MobileProvisioningProfile
+	profile.DeveloperCertificates = [][]byte{other.Raw, cert.Raw}
+	writeSignedProfile(t, path.Join(dir, "pem.mobileprovision"), profile)
+	combined, err := codesign.EncodePEMCertificate(cert, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "pem.pem"), combined, 0600))
+	parsed, err := codesign.ParseProfileWithTrust(path.Join(dir, "pem.mobileprovision"), "", testProfileTrust())
+	if assert.NoError(t, err) {
+		assert.Equal(t, cert.Raw, parsed.SigningCert.Raw)
+		assert.Empty(t, parsed.P12Bytes)
+		assert.Equal(t, combined, parsed.PEMBytes)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "pem.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "pem.key"), keyPEM, 0600))
+	parsed, err = codesign.ParseProfileWithTrust(path.Join(dir, "pem.mobileprovision"), "", testProfileTrust())
+	if assert.NoError(t, err) {
+		assert.Equal(t, cert.Raw, parsed.SigningCert.Raw)
+		assert.True(t, key.PublicKey.Equal(parsed.PrivateKey.Public()))
+	}
+
+	profile.DeveloperCertificates = [][]byte{other.Raw}
+	writeSignedProfile(t, path.Join(dir, "pem.mobileprovision"), profile)
+	_, err = codesign.ParseProfileWithTrust(path.Join(dir, "pem.mobileprovision"), "", testProfileTrust())
+	assert.Error(t, err)
+}
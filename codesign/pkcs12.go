@@ -0,0 +1,486 @@
+package codesign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+//golang.org/x/crypto/pkcs12 only decodes legacy p12 files with a single certificate. OpenSSL 3 encrypts with
+//PBES2/AES and uses SHA-256 MACs, Keychain Access adds the certificate chain, so PKCS#12 (RFC 7292) is decoded here.
+var (
+	oidEncryptedData                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidKeyBag                        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidPKCS8ShroudedKeyBag           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag                       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidSafeContentsBag               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 6}
+	oidX509CertificateBag            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidPBEWithSHAAnd3KeyTripleDESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPBEWithSHAAnd40BitRC2CBC      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 6}
+	oidPBES2                         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2                        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256                = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384                = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512                = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC                     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC                     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC                     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC                    = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidSHA384                        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512                        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+//ErrP12Password is returned if the MAC or the decryption of a p12 file fails, which means the password is wrong.
+var ErrP12Password = errors.New("wrong p12 password")
+
+//P12Identity is a certificate of a p12 file together with its private key
+type P12Identity struct {
+	Certificate *x509.Certificate
+	PrivateKey  crypto.Signer
+}
+
+//P12Contents are all certificates and private keys of a p12 file. Identities pairs each key with its certificate,
+//Certificates contains all certificates including the chain.
+type P12Contents struct {
+	Identities   []P12Identity
+	Certificates []*x509.Certificate
+}
+
+type p12PFX struct {
+	Version  int
+	AuthSafe cmsContentInfo
+	MacData  p12MacData `asn1:"optional"`
+}
+
+type p12MacData struct {
+	Mac        p12DigestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type p12DigestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type p12EncryptedData struct {
+	Version              int
+	EncryptedContentInfo p12EncryptedContentInfo
+}
+
+type p12EncryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type p12EncryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type p12SafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []p12BagAttribute `asn1:"set,optional"`
+}
+
+type p12BagAttribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type p12CertBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type p12PBEParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type p12PBES2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type p12PBKDF2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+//DecodeP12 decodes all certificates and keys of a p12 file. It supports the legacy 3DES and RC2 encryption as well as
+//PBES2 with AES or 3DES and SHA-1 or SHA-2 MACs. Keys are paired with their certificate by public key.
+//A wrong password results in ErrP12Password.
+func DecodeP12(data []byte, password string) (P12Contents, error) {
+	var pfx p12PFX
+	rest, err := asn1.Unmarshal(data, &pfx)
+	if err != nil {
+		return P12Contents{}, fmt.Errorf("failed parsing p12: %w", err)
+	}
+	if len(rest) != 0 {
+		return P12Contents{}, fmt.Errorf("failed parsing p12: trailing data")
+	}
+	if pfx.Version != 3 {
+		return P12Contents{}, fmt.Errorf("unsupported p12 version %d", pfx.Version)
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidData) {
+		return P12Contents{}, fmt.Errorf("unsupported p12 content type %s, only password integrity is supported", pfx.AuthSafe.ContentType)
+	}
+	var authSafe []byte
+	_, err = asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe)
+	if err != nil {
+		return P12Contents{}, fmt.Errorf("failed parsing p12 content: %w", err)
+	}
+
+	bmpPassword, err := bmpString(password)
+	if err != nil {
+		return P12Contents{}, err
+	}
+	if len(pfx.MacData.Mac.Digest) > 0 {
+		err = verifyP12Mac(pfx.MacData, authSafe, bmpPassword)
+		if errors.Is(err, ErrP12Password) && password == "" {
+			//some tools use an empty byte string instead of the encoded empty string
+			bmpPassword = nil
+			err = verifyP12Mac(pfx.MacData, authSafe, bmpPassword)
+		}
+		if err != nil {
+			return P12Contents{}, err
+		}
+	}
+
+	var contentInfos []cmsContentInfo
+	_, err = asn1.Unmarshal(authSafe, &contentInfos)
+	if err != nil {
+		return P12Contents{}, fmt.Errorf("failed parsing p12 content: %w", err)
+	}
+	decoder := p12Decoder{password: password, bmpPassword: bmpPassword}
+	for _, info := range contentInfos {
+		var safeContents []byte
+		switch {
+		case info.ContentType.Equal(oidData):
+			_, err = asn1.Unmarshal(info.Content.Bytes, &safeContents)
+		case info.ContentType.Equal(oidEncryptedData):
+			var encrypted p12EncryptedData
+			_, err = asn1.Unmarshal(info.Content.Bytes, &encrypted)
+			if err == nil {
+				content := encrypted.EncryptedContentInfo
+				safeContents, err = decoder.decrypt(content.ContentEncryptionAlgorithm, content.EncryptedContent)
+			}
+		default:
+			err = fmt.Errorf("unsupported p12 content type %s", info.ContentType)
+		}
+		if err != nil {
+			return P12Contents{}, err
+		}
+		err = decoder.readSafeContents(safeContents)
+		if err != nil {
+			return P12Contents{}, err
+		}
+	}
+	return decoder.contents()
+}
+
+//SigningIdentity returns the certificate and key whose SHA-1 fingerprint is one of fingerprints, f.ex. the developer
+//certificates of a profile. Certificates of the chain and certificates without a key are skipped.
+func (c P12Contents) SigningIdentity(fingerprints []string) (P12Identity, error) {
+	for _, identity := range c.Identities {
+		sha1 := getSha1Fingerprint(identity.Certificate)
+		for _, fingerprint := range fingerprints {
+			if fingerprint == sha1 {
+				return identity, nil
+			}
+		}
+	}
+	return P12Identity{}, fmt.Errorf("none of the %d certificates with private key in the p12 is contained in the provisioning profile", len(c.Identities))
+}
+
+type p12Decoder struct {
+	password     string
+	bmpPassword  []byte
+	keys         []crypto.Signer
+	certificates []*x509.Certificate
+}
+
+func (d *p12Decoder) readSafeContents(data []byte) error {
+	var bags []p12SafeBag
+	_, err := asn1.Unmarshal(data, &bags)
+	if err != nil {
+		return fmt.Errorf("failed parsing p12 safe contents: %w", err)
+	}
+	for _, bag := range bags {
+		switch {
+		case bag.ID.Equal(oidCertBag):
+			var certBag p12CertBag
+			_, err = asn1.Unmarshal(bag.Value.Bytes, &certBag)
+			if err != nil {
+				return fmt.Errorf("failed parsing p12 certificate bag: %w", err)
+			}
+			if !certBag.ID.Equal(oidX509CertificateBag) {
+				continue
+			}
+			cert, err := x509.ParseCertificate(certBag.Data)
+			if err != nil {
+				return fmt.Errorf("failed parsing p12 certificate: %w", err)
+			}
+			d.certificates = append(d.certificates, cert)
+		case bag.ID.Equal(oidKeyBag):
+			err = d.addKey(bag.Value.Bytes)
+		case bag.ID.Equal(oidPKCS8ShroudedKeyBag):
+			var encrypted p12EncryptedPrivateKeyInfo
+			_, err = asn1.Unmarshal(bag.Value.Bytes, &encrypted)
+			if err != nil {
+				return fmt.Errorf("failed parsing p12 key bag: %w", err)
+			}
+			var keyBytes []byte
+			keyBytes, err = d.decrypt(encrypted.Algorithm, encrypted.EncryptedData)
+			if err == nil {
+				err = d.addKey(keyBytes)
+			}
+		case bag.ID.Equal(oidSafeContentsBag):
+			err = d.readSafeContents(bag.Value.Bytes)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *p12Decoder) addKey(pkcs8 []byte) error {
+	key, err := x509.ParsePKCS8PrivateKey(pkcs8)
+	if err != nil {
+		return fmt.Errorf("failed parsing p12 private key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported private key type %T in p12", key)
+	}
+	d.keys = append(d.keys, signer)
+	return nil
+}
+
+func (d *p12Decoder) contents() (P12Contents, error) {
+	contents := P12Contents{Identities: []P12Identity{}, Certificates: d.certificates}
+	for _, key := range d.keys {
+		for _, cert := range d.certificates {
+			if publicKeysEqual(cert.PublicKey, key.Public()) {
+				contents.Identities = append(contents.Identities, P12Identity{Certificate: cert, PrivateKey: key})
+				break
+			}
+		}
+	}
+	if len(contents.Certificates) == 0 {
+		return contents, fmt.Errorf("p12 does not contain a certificate")
+	}
+	return contents, nil
+}
+
+//decrypt decrypts data with one of the password based encryption schemes of PKCS#12 or PKCS#5
+func (d *p12Decoder) decrypt(algorithm pkix.AlgorithmIdentifier, data []byte) ([]byte, error) {
+	var block cipher.Block
+	var iv []byte
+	switch {
+	case algorithm.Algorithm.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC), algorithm.Algorithm.Equal(oidPBEWithSHAAnd40BitRC2CBC):
+		var params p12PBEParams
+		_, err := asn1.Unmarshal(algorithm.Parameters.FullBytes, &params)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing p12 encryption parameters: %w", err)
+		}
+		if algorithm.Algorithm.Equal(oidPBEWithSHAAnd40BitRC2CBC) {
+			key := pkcs12KDF(sha1.New, 64, params.Salt, d.bmpPassword, params.Iterations, 1, 5)
+			block = newRC2Cipher(key, 40)
+		} else {
+			key := pkcs12KDF(sha1.New, 64, params.Salt, d.bmpPassword, params.Iterations, 1, 24)
+			block, err = des.NewTripleDESCipher(key)
+			if err != nil {
+				return nil, err
+			}
+		}
+		iv = pkcs12KDF(sha1.New, 64, params.Salt, d.bmpPassword, params.Iterations, 2, 8)
+	case algorithm.Algorithm.Equal(oidPBES2):
+		var err error
+		block, iv, err = pbes2Cipher(algorithm.Parameters.FullBytes, d.password)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported p12 encryption algorithm %s", algorithm.Algorithm)
+	}
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("failed decrypting p12: invalid length %d", len(data))
+	}
+	decrypted := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, data)
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > block.BlockSize() || !bytes.Equal(decrypted[len(decrypted)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, ErrP12Password
+	}
+	return decrypted[:len(decrypted)-padding], nil
+}
+
+//pbes2Cipher derives the key of a PBES2 scheme, see RFC 8018, with PBKDF2 from the UTF-8 password.
+func pbes2Cipher(parameters []byte, password string) (cipher.Block, []byte, error) {
+	var params p12PBES2Params
+	_, err := asn1.Unmarshal(parameters, &params)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed parsing PBES2 parameters: %w", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, nil, fmt.Errorf("unsupported PBES2 key derivation %s", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf p12PBKDF2Params
+	_, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed parsing PBKDF2 parameters: %w", err)
+	}
+	prf := sha1.New
+	switch {
+	case len(kdf.PRF.Algorithm) == 0, kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA384):
+		prf = sha512.New384
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, nil, fmt.Errorf("unsupported PBKDF2 function %s", kdf.PRF.Algorithm)
+	}
+
+	var iv []byte
+	_, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed parsing PBES2 iv: %w", err)
+	}
+	scheme := params.EncryptionScheme.Algorithm
+	keyLength := 0
+	switch {
+	case scheme.Equal(oidAES128CBC):
+		keyLength = 16
+	case scheme.Equal(oidAES192CBC):
+		keyLength = 24
+	case scheme.Equal(oidAES256CBC):
+		keyLength = 32
+	case scheme.Equal(oidDESEDE3CBC):
+		keyLength = 24
+	default:
+		return nil, nil, fmt.Errorf("unsupported PBES2 encryption %s", scheme)
+	}
+	if kdf.KeyLength != 0 && kdf.KeyLength != keyLength {
+		return nil, nil, fmt.Errorf("invalid PBES2 key length %d for %s", kdf.KeyLength, scheme)
+	}
+	key := pbkdf2.Key([]byte(password), kdf.Salt, kdf.Iterations, keyLength, prf)
+	var block cipher.Block
+	if scheme.Equal(oidDESEDE3CBC) {
+		block, err = des.NewTripleDESCipher(key)
+	} else {
+		block, err = aes.NewCipher(key)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, nil, fmt.Errorf("invalid PBES2 iv length %d", len(iv))
+	}
+	return block, iv, nil
+}
+
+//verifyP12Mac checks the HMAC over the content, its key is derived with the PKCS#12 key derivation.
+func verifyP12Mac(macData p12MacData, content []byte, bmpPassword []byte) error {
+	var hashFunc func() hash.Hash
+	blockSize := 64
+	algorithm := macData.Mac.Algorithm.Algorithm
+	switch {
+	case algorithm.Equal(oidSHA1):
+		hashFunc = sha1.New
+	case algorithm.Equal(oidSHA256):
+		hashFunc = sha256.New
+	case algorithm.Equal(oidSHA384):
+		hashFunc, blockSize = sha512.New384, 128
+	case algorithm.Equal(oidSHA512):
+		hashFunc, blockSize = sha512.New, 128
+	default:
+		return fmt.Errorf("unsupported p12 MAC algorithm %s", algorithm)
+	}
+	key := pkcs12KDF(hashFunc, blockSize, macData.MacSalt, bmpPassword, macData.Iterations, 3, hashFunc().Size())
+	mac := hmac.New(hashFunc, key)
+	mac.Write(content)
+	if !hmac.Equal(mac.Sum(nil), macData.Mac.Digest) {
+		return ErrP12Password
+	}
+	return nil
+}
+
+//pkcs12KDF derives size bytes of key material for the purpose id, 1 for keys, 2 for ivs and 3 for MACs,
+//see RFC 7292 appendix B.2. v is the block size of the hash function.
+func pkcs12KDF(hashFunc func() hash.Hash, v int, salt []byte, password []byte, iterations int, id byte, size int) []byte {
+	fill := func(data []byte) []byte {
+		if len(data) == 0 {
+			return nil
+		}
+		length := v * ((len(data) + v - 1) / v)
+		result := make([]byte, length)
+		for i := range result {
+			result[i] = data[i%len(data)]
+		}
+		return result
+	}
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt), fill(password)...)
+
+	result := []byte{}
+	for len(result) < size {
+		h := hashFunc()
+		h.Write(d)
+		h.Write(i)
+		a := h.Sum(nil)
+		for iteration := 1; iteration < iterations; iteration++ {
+			h.Reset()
+			h.Write(a)
+			a = h.Sum(a[:0])
+		}
+		result = append(result, a...)
+
+		//I_j = (I_j + B + 1) mod 2^v for every v byte block of I
+		b := fill(a)[:v]
+		for j := 0; j < len(i); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				sum := int(i[j+k]) + int(b[k]) + carry
+				i[j+k] = byte(sum)
+				carry = sum >> 8
+			}
+		}
+	}
+	return result[:size]
+}
+
+//bmpString encodes the password as big endian UTF-16 with a terminating null character, see RFC 7292 appendix B.1
+func bmpString(password string) ([]byte, error) {
+	result := make([]byte, 0, 2*len(password)+2)
+	for _, r := range password {
+		if r > 0xffff {
+			return nil, fmt.Errorf("p12 passwords cannot contain the character %q", r)
+		}
+		result = append(result, byte(r>>8), byte(r))
+	}
+	return append(result, 0, 0), nil
+}
@@ -0,0 +1,93 @@
+package codesign_test
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/danielpaulus/app-signer/codesign"
+	"github.com/stretchr/testify/assert"
+)
+
+func readFixtureCertificate(t *testing.T, name string) *x509.Certificate {
+	data, err := ioutil.ReadFile("fixtures/p12/" + name)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	block, _ := pem.Decode(data)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return cert
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	return fmt.Sprintf("%x", sha1.Sum(cert.Raw))
+}
+
+func TestDecodeP12(t *testing.T) {
+	leaf := readFixtureCertificate(t, "leaf.pem")
+	ca := readFixtureCertificate(t, "ca.pem")
+	for _, file := range []string{"chain-aes.p12", "chain-3des.p12", "chain-legacy.p12"} {
+		data := readBytes("fixtures/p12/" + file)
+		contents, err := codesign.DecodeP12(data, "test")
+		if !assert.NoError(t, err, file) {
+			continue
+		}
+		assert.Len(t, contents.Certificates, 2, file)
+		if assert.Len(t, contents.Identities, 1, file) {
+			assert.Equal(t, leaf.Raw, contents.Identities[0].Certificate.Raw, file)
+		}
+
+		identity, err := contents.SigningIdentity([]string{fingerprint(ca), fingerprint(leaf)})
+		if assert.NoError(t, err, file) {
+			assert.Equal(t, leaf.Raw, identity.Certificate.Raw, file)
+			assert.NotNil(t, identity.PrivateKey)
+		}
+		_, err = contents.SigningIdentity([]string{fingerprint(ca)})
+		assert.Error(t, err, file)
+
+		_, err = codesign.DecodeP12(data, "wrong")
+		assert.ErrorIs(t, err, codesign.ErrP12Password, file)
+	}
+
+	contents, err := codesign.DecodeP12(readBytes("fixtures/p12/nopass.p12"), "")
+	if assert.NoError(t, err) {
+		assert.Len(t, contents.Identities, 1)
+	}
+	_, err = codesign.DecodeP12([]byte("no p12"), "")
+	assert.Error(t, err)
+}
+
+func TestParseProfileWithChainP12(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p12profiles")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	leaf := readFixtureCertificate(t, "leaf.pem")
+	ca := readFixtureCertificate(t, "ca.pem")
+	profile := testProfile("chain", "TEAMID.*", leaf.NotAfter, "device1").MobileProvisioningProfile
+	profile.DeveloperCertificates = [][]byte{ca.Raw, leaf.Raw}
+	writeSignedProfile(t, path.Join(dir, "chain.mobileprovision"), profile)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "chain.p12"), readBytes("fixtures/p12/chain-aes.p12"), 0600))
+
+	parsed, err := codesign.ParseProfileWithTrust(path.Join(dir, "chain.mobileprovision"), "test", testProfileTrust())
+	if assert.NoError(t, err) {
+		assert.Equal(t, leaf.Raw, parsed.SigningCert.Raw)
+		assert.Equal(t, fingerprint(leaf), parsed.CertificateSha1)
+	}
+	_, err = codesign.ParseProfileWithTrust(path.Join(dir, "chain.mobileprovision"), "wrong", testProfileTrust())
+	assert.ErrorIs(t, err, codesign.ErrP12Password)
+
+	profile.DeveloperCertificates = [][]byte{ca.Raw}
+	writeSignedProfile(t, path.Join(dir, "chain.mobileprovision"), profile)
+	_, err = codesign.ParseProfileWithTrust(path.Join(dir, "chain.mobileprovision"), "test", testProfileTrust())
+	assert.Error(t, err)
+}
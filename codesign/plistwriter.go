@@ -0,0 +1,114 @@
+package codesign
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//base64LineLength is where CoreFoundation wraps base64 encoded data in XML plists
+const base64LineLength = 76
+
+//marshalApplePlist writes an XML plist formatted exactly like CoreFoundation does it.
+//howett.net/plist writes equivalent plists, but with differently indented <data> elements.
+//Files like CodeResources are hashed into the signature, so we want them to be byte compatible with
+//what codesign produces for the same input.
+//Supported values are map[string]interface{}, []interface{}, string, bool, []byte, float64 and ints.
+func marshalApplePlist(value interface{}) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	buffer.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	buffer.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	buffer.WriteString(`<plist version="1.0">` + "\n")
+	err := writeApplePlistValue(buffer, value, 0)
+	if err != nil {
+		return nil, err
+	}
+	buffer.WriteString("</plist>\n")
+	return buffer.Bytes(), nil
+}
+
+func writeApplePlistValue(buffer *bytes.Buffer, value interface{}, depth int) error {
+	indent := strings.Repeat("\t", depth)
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			buffer.WriteString(indent + "<dict/>\n")
+			return nil
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buffer.WriteString(indent + "<dict>\n")
+		for _, key := range keys {
+			buffer.WriteString(indent + "\t<key>" + escapeXML(key) + "</key>\n")
+			err := writeApplePlistValue(buffer, v[key], depth+1)
+			if err != nil {
+				return err
+			}
+		}
+		buffer.WriteString(indent + "</dict>\n")
+	case []interface{}:
+		if len(v) == 0 {
+			buffer.WriteString(indent + "<array/>\n")
+			return nil
+		}
+		buffer.WriteString(indent + "<array>\n")
+		for _, element := range v {
+			err := writeApplePlistValue(buffer, element, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+		buffer.WriteString(indent + "</array>\n")
+	case []string:
+		elements := make([]interface{}, len(v))
+		for i, s := range v {
+			elements[i] = s
+		}
+		return writeApplePlistValue(buffer, elements, depth)
+	case string:
+		buffer.WriteString(indent + "<string>" + escapeXML(v) + "</string>\n")
+	case bool:
+		if v {
+			buffer.WriteString(indent + "<true/>\n")
+		} else {
+			buffer.WriteString(indent + "<false/>\n")
+		}
+	case []byte:
+		encoded := base64.StdEncoding.EncodeToString(v)
+		buffer.WriteString(indent + "<data>\n")
+		for len(encoded) > base64LineLength {
+			buffer.WriteString(indent + encoded[:base64LineLength] + "\n")
+			encoded = encoded[base64LineLength:]
+		}
+		buffer.WriteString(indent + encoded + "\n")
+		buffer.WriteString(indent + "</data>\n")
+	case float64:
+		buffer.WriteString(indent + "<real>" + strconv.FormatFloat(v, 'f', -1, 64) + "</real>\n")
+	case int:
+		buffer.WriteString(indent + "<integer>" + strconv.Itoa(v) + "</integer>\n")
+	case uint64:
+		buffer.WriteString(indent + "<integer>" + strconv.FormatUint(v, 10) + "</integer>\n")
+	case int64:
+		buffer.WriteString(indent + "<integer>" + strconv.FormatInt(v, 10) + "</integer>\n")
+	default:
+		return fmt.Errorf("unsupported plist value type %T", value)
+	}
+	return nil
+}
+
+func escapeXML(s string) string {
+	buffer := &bytes.Buffer{}
+	xml.EscapeText(buffer, []byte(s))
+	//CoreFoundation does not escape quotes and newlines
+	escaped := strings.ReplaceAll(buffer.String(), "&#34;", `"`)
+	escaped = strings.ReplaceAll(escaped, "&#39;", "'")
+	escaped = strings.ReplaceAll(escaped, "&#xA;", "\n")
+	return strings.ReplaceAll(escaped, "&#x9;", "\t")
+}
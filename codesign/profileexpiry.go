@@ -0,0 +1,32 @@
+package codesign
+
+import (
+	"fmt"
+	"time"
+)
+
+//DefaultExpiryWarning is how long before a profile or certificate expires signing starts to warn about it
+const DefaultExpiryWarning = 14 * 24 * time.Hour
+
+const expiryDateFormat = "2006-01-02"
+
+//CheckExpiry checks the expiration dates of the profile and its signing certificate at the time now.
+//Expired contains a message for each of them that already expired, expiring one for each that expires within window.
+//Profiles without expiration date never expire.
+func (p ProfileAndCertificate) CheckExpiry(now time.Time, window time.Duration) (expired []string, expiring []string) {
+	check := func(what string, expiresAt time.Time) {
+		switch {
+		case expiresAt.IsZero():
+		case !now.Before(expiresAt):
+			expired = append(expired, fmt.Sprintf("%s expired on %s", what, expiresAt.Format(expiryDateFormat)))
+		case expiresAt.Sub(now) <= window:
+			days := int(expiresAt.Sub(now).Hours() / 24)
+			expiring = append(expiring, fmt.Sprintf("%s expires in %d days on %s", what, days, expiresAt.Format(expiryDateFormat)))
+		}
+	}
+	check(fmt.Sprintf("profile '%s'", p.MobileProvisioningProfile.Name), p.MobileProvisioningProfile.ExpirationDate)
+	if p.SigningCert != nil {
+		check(fmt.Sprintf("certificate '%s'", p.SigningCert.Subject.CommonName), p.SigningCert.NotAfter)
+	}
+	return expired, expiring
+}
@@ -0,0 +1,145 @@
+package codesign
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Distribution types of provisioning profiles, see ProfileType
+const (
+	ProfileTypeDevelopment = "development"
+	ProfileTypeAdHoc       = "ad-hoc"
+	ProfileTypeEnterprise  = "enterprise"
+	ProfileTypeAppStore    = "app-store"
+)
+
+//Expiry states of a ProfileInfo
+const (
+	ProfileStatusValid    = "valid"
+	ProfileStatusExpiring = "expiring"
+	ProfileStatusExpired  = "expired"
+)
+
+//ProfileInfo summarizes a provisioning profile for listing it. CertificateSha1 contains the fingerprints of
+//all developer certificates in the profile. Status is one of the ProfileStatus* values.
+type ProfileInfo struct {
+	Path            string    `json:"path"`
+	Name            string    `json:"name"`
+	UUID            string    `json:"uuid"`
+	TeamID          string    `json:"teamId"`
+	TeamName        string    `json:"teamName"`
+	AppID           string    `json:"appId"`
+	Platform        []string  `json:"platform"`
+	Type            string    `json:"type"`
+	CreationDate    time.Time `json:"creationDate"`
+	ExpirationDate  time.Time `json:"expirationDate"`
+	DeviceCount     int       `json:"deviceCount"`
+	CertificateSha1 []string  `json:"certificateSha1"`
+	Status          string    `json:"status"`
+}
+
+//ProfileFile is a parsed provisioning profile and the path it was read from
+type ProfileFile struct {
+	Path    string
+	Profile MobileProvisioningProfile
+}
+
+//ReadProfiles parses all profiles in profilesPath without needing their p12 files.
+//profilesPath can be a list of directories, see ProfileDirectories.
+//Profiles whose signature trust does not accept are logged and left out, so tampered device lists are never reported.
+func ReadProfiles(profilesPath string, trust ProfileTrust) ([]ProfileFile, error) {
+	files := []string{}
+	for _, dir := range ProfileDirectories(profilesPath) {
+		found, err := findProfiles(dir)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, found...)
+	}
+	result := []ProfileFile{}
+	for _, file := range files {
+		profileBytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := trust.Verify(profileBytes); err != nil {
+			log.WithFields(log.Fields{"profile": file, "reason": err.Error()}).Error("rejected profile")
+			continue
+		}
+		profile, err := ParseMobileProvision(profileBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing profile %s: %w", file, err)
+		}
+		result = append(result, ProfileFile{Path: file, Profile: profile})
+	}
+	return result, nil
+}
+
+//ListProfiles reads all profiles in profilesPath that trust accepts without needing their p12 files. Profiles expiring
+//within window after now get the status ProfileStatusExpiring.
+func ListProfiles(profilesPath string, trust ProfileTrust, now time.Time, window time.Duration) ([]ProfileInfo, error) {
+	files, err := ReadProfiles(profilesPath, trust)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]ProfileInfo, len(files))
+	for i, file := range files {
+		result[i] = NewProfileInfo(file.Profile, now, window)
+		result[i].Path = file.Path
+	}
+	return result, nil
+}
+
+//NewProfileInfo summarizes the profile, its status is determined for the time now and the warning window
+func NewProfileInfo(profile MobileProvisioningProfile, now time.Time, window time.Duration) ProfileInfo {
+	info := ProfileInfo{
+		Name:            profile.Name,
+		UUID:            profile.UUID,
+		TeamID:          ProfileTeamID(profile),
+		TeamName:        profile.TeamName,
+		AppID:           ProfileApplicationIdentifier(profile),
+		Platform:        profile.Platform,
+		Type:            ProfileType(profile),
+		CreationDate:    profile.CreationDate,
+		ExpirationDate:  profile.ExpirationDate,
+		DeviceCount:     len(profile.ProvisionedDevices),
+		CertificateSha1: []string{},
+	}
+	for _, certBytes := range profile.DeveloperCertificates {
+		cert, err := x509.ParseCertificate(certBytes)
+		if err != nil {
+			continue
+		}
+		info.CertificateSha1 = append(info.CertificateSha1, getSha1Fingerprint(cert))
+	}
+	expired, expiring := ProfileAndCertificate{MobileProvisioningProfile: profile}.CheckExpiry(now, window)
+	switch {
+	case len(expired) > 0:
+		info.Status = ProfileStatusExpired
+	case len(expiring) > 0:
+		info.Status = ProfileStatusExpiring
+	default:
+		info.Status = ProfileStatusValid
+	}
+	return info
+}
+
+//ProfileType tells what the profile can be used for. Profiles provisioning all devices are enterprise profiles,
+//profiles without devices are for the App Store. Profiles with devices are development profiles if they allow
+//debugging with get-task-allow, otherwise ad-hoc profiles.
+func ProfileType(profile MobileProvisioningProfile) string {
+	switch {
+	case profile.ProvisionsAllDevices:
+		return ProfileTypeEnterprise
+	case len(profile.ProvisionedDevices) == 0:
+		return ProfileTypeAppStore
+	}
+	if getTaskAllow, ok := profile.Entitlements[getTaskAllowEntitlement].(bool); ok && getTaskAllow {
+		return ProfileTypeDevelopment
+	}
+	return ProfileTypeAdHoc
+}
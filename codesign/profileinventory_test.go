@@ -0,0 +1,117 @@
+package codesign_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/app-signer/codesign"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now().UTC().Truncate(time.Second)
+	cert, _ := makeSigningCertificate("Apple Development: Test (ABC)", "TEAMID")
+
+	writeSignedProfile(t, path.Join(dir, "dev.mobileprovision"), codesign.MobileProvisioningProfile{
+		Name: "dev", UUID: "uuid-dev", TeamIdentifier: []string{"TEAMID"}, Platform: []string{"iOS"},
+		Entitlements:          map[string]interface{}{"application-identifier": "TEAMID.*", "get-task-allow": true},
+		ProvisionedDevices:    []string{"device1", "device2"},
+		DeveloperCertificates: [][]byte{cert.Raw},
+		CreationDate:          now.Add(-24 * time.Hour), ExpirationDate: now.Add(300 * 24 * time.Hour),
+	})
+	writeSignedProfile(t, path.Join(dir, "enterprise.mobileprovision"), codesign.MobileProvisioningProfile{
+		Name: "enterprise", UUID: "uuid-enterprise", TeamIdentifier: []string{"TEAMID"}, ProvisionsAllDevices: true,
+		Entitlements:   map[string]interface{}{"application-identifier": "TEAMID.com.acme.app"},
+		ExpirationDate: now.Add(3 * 24 * time.Hour),
+	})
+	writeSignedProfile(t, path.Join(dir, "store.mobileprovision"), codesign.MobileProvisioningProfile{
+		Name: "store", ExpirationDate: now.Add(-time.Hour),
+	})
+
+	profiles, err := codesign.ListProfiles(dir, testProfileTrust(), now, codesign.DefaultExpiryWarning)
+	if !assert.NoError(t, err) || !assert.Len(t, profiles, 3) {
+		return
+	}
+	assert.Equal(t, codesign.ProfileInfo{
+		Path: path.Join(dir, "dev.mobileprovision"), Name: "dev", UUID: "uuid-dev", TeamID: "TEAMID", AppID: "TEAMID.*",
+		Platform: []string{"iOS"}, Type: codesign.ProfileTypeDevelopment, CreationDate: now.Add(-24 * time.Hour), ExpirationDate: now.Add(300 * 24 * time.Hour),
+		DeviceCount: 2, CertificateSha1: []string{fmt.Sprintf("%x", sha1.Sum(cert.Raw))}, Status: codesign.ProfileStatusValid,
+	}, profiles[0])
+	assert.Equal(t, codesign.ProfileTypeEnterprise, profiles[1].Type)
+	assert.Equal(t, codesign.ProfileStatusExpiring, profiles[1].Status)
+	assert.Equal(t, codesign.ProfileTypeAppStore, profiles[2].Type)
+	assert.Equal(t, codesign.ProfileStatusExpired, profiles[2].Status)
+
+	profiles, _ = codesign.ListProfiles(dir, testProfileTrust(), now, 0)
+	assert.Equal(t, codesign.ProfileStatusValid, profiles[1].Status)
+
+	devProfile := path.Join(dir, "dev.mobileprovision")
+	tampered := bytes.Replace(readBytes(devProfile), []byte("device1"), []byte("device9"), 1)
+	assert.NoError(t, ioutil.WriteFile(devProfile, tampered, 0644))
+	files, err := codesign.ReadProfiles(dir, testProfileTrust())
+	if assert.NoError(t, err) && assert.Len(t, files, 2, "the tampered profile is left out") {
+		assert.Equal(t, "enterprise", files[0].Profile.Name)
+	}
+	coverage := codesign.CheckCoverage([]string{"device9"}, files, now, 0).Devices[0]
+	if assert.Len(t, coverage.Profiles, 1) {
+		assert.Equal(t, "enterprise", coverage.Profiles[0].Name, "only the enterprise profile covers all devices")
+	}
+	files, _ = codesign.ReadProfiles(dir, codesign.ProfileTrust{Skip: true})
+	assert.Len(t, files, 3)
+	files, _ = codesign.ReadProfiles(dir, codesign.ProfileTrust{})
+	assert.Empty(t, files, "only Apple's roots are trusted by default")
+}
+
+func TestProfileType(t *testing.T) {
+	adhoc := codesign.MobileProvisioningProfile{ProvisionedDevices: []string{"device1"}, Entitlements: map[string]interface{}{"get-task-allow": false}}
+	assert.Equal(t, codesign.ProfileTypeAdHoc, codesign.ProfileType(adhoc))
+}
+
+//writeSignedProfile stores the profile as pkcs7 signed plist like Apple's mobileprovision files,
+//signed by the test chain that testProfileTrust trusts
+func writeSignedProfile(t *testing.T, profilePath string, profile codesign.MobileProvisioningProfile) {
+	chain := testProfileChain()
+	signed := signProfile(t, profile, chain.signer, chain.signerKey, chain.intermediate, chain.root)
+	assert.NoError(t, ioutil.WriteFile(profilePath, signed, 0644))
+}
+
+func TestReadProfilesRecursive(t *testing.T) {
+	home, err := ioutil.TempDir("", "home")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(home)
+	t.Setenv("HOME", home)
+	installed := path.Join(home, "Library", "MobileDevice", "Provisioning Profiles")
+	nested := path.Join(home, "profiles", "tvos")
+	for _, dir := range []string{installed, nested} {
+		assert.NoError(t, os.MkdirAll(dir, 0755))
+	}
+	writeSignedProfile(t, path.Join(installed, "8c1e-uuid.mobileprovision"), codesign.MobileProvisioningProfile{Name: "installed", UUID: "8c1e-uuid"})
+	writeSignedProfile(t, path.Join(nested, "tv.provisionprofile"), codesign.MobileProvisioningProfile{Name: "tv", UUID: "tv-uuid"})
+	assert.NoError(t, ioutil.WriteFile(path.Join(nested, "notes.txt"), []byte("no profile"), 0644))
+
+	assert.Equal(t, []string{installed}, codesign.InstalledProfileDirectories())
+	assert.Equal(t, []string{installed, path.Join(home, "profiles"), "relative"},
+		codesign.ProfileDirectories(codesign.InstalledProfilesPath+string(os.PathListSeparator)+"~/profiles"+string(os.PathListSeparator)+"relative"))
+
+	profiles, err := codesign.ReadProfiles(codesign.InstalledProfilesPath+string(os.PathListSeparator)+"~/profiles", testProfileTrust())
+	if assert.NoError(t, err) && assert.Len(t, profiles, 2) {
+		assert.Equal(t, "installed", profiles[0].Profile.Name)
+		assert.Equal(t, path.Join(nested, "tv.provisionprofile"), profiles[1].Path)
+	}
+	profiles, err = codesign.ReadProfiles(path.Join(home, "does-not-exist"), testProfileTrust())
+	assert.NoError(t, err)
+	assert.Empty(t, profiles)
+}
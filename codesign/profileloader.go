@@ -0,0 +1,245 @@
+package codesign
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//CertificateFile is a signing certificate and its private key read from a p12 or PEM file.
+//P12Bytes and Password are set for p12 files, PEMBytes for PEM files.
+type CertificateFile struct {
+	Path        string
+	Certificate *x509.Certificate
+	PrivateKey  crypto.Signer
+	P12Bytes    []byte
+	PEMBytes    []byte
+	Password    string
+}
+
+//UnpairedFile is a profile or certificate file LoadProfiles could not use, Reason tells why.
+type UnpairedFile struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+//LoadedProfiles are the profiles LoadProfiles paired with a certificate and the files it could not pair.
+//RejectedProfiles were not loaded because their signature is not trusted.
+type LoadedProfiles struct {
+	Profiles             []ProfileAndCertificate
+	UnpairedProfiles     []UnpairedFile
+	UnpairedCertificates []UnpairedFile
+	RejectedProfiles     []UnpairedFile
+}
+
+//LoadProfiles reads every profile and every certificate, .p12 files or .pem files with an optional .key next to them,
+//in dirs and their subdirectories and pairs them by the SHA-1 fingerprints of the profiles' DeveloperCertificates.
+//File names do not matter, so profiles exported by Xcode as <UUID>.mobileprovision work, and one certificate can be
+//used by many profiles.
+//If several certificates fit a profile, the one with the same file name is preferred.
+//p12 files are decrypted with their own password if they have one, see P12Passwords.ResolveCertificate, otherwise
+//with the passwords resolved for the profiles and the default password. Profiles found twice are loaded once.
+//Profiles whose signature trust does not accept are rejected before their certificates are looked at.
+//Only unreadable profiles are an error, files that cannot be paired are returned as unpaired.
+func LoadProfiles(dirs []string, passwords P12Passwords, trust ProfileTrust) (LoadedProfiles, error) {
+	result := LoadedProfiles{Profiles: []ProfileAndCertificate{}, UnpairedProfiles: []UnpairedFile{}, UnpairedCertificates: []UnpairedFile{}, RejectedProfiles: []UnpairedFile{}}
+	profiles := []ProfileFile{}
+	rawProfiles := [][]byte{}
+	seen := map[string]bool{}
+	candidates := []string{}
+	for _, dir := range dirs {
+		files, err := findProfiles(dir)
+		if err != nil {
+			return result, err
+		}
+		for _, file := range files {
+			profileBytes, err := ioutil.ReadFile(file)
+			if err != nil {
+				return result, err
+			}
+			err = trust.Verify(profileBytes)
+			if err != nil {
+				result.RejectedProfiles = append(result.RejectedProfiles, UnpairedFile{Path: file, Reason: err.Error()})
+				continue
+			}
+			profile, err := ParseMobileProvision(profileBytes)
+			if err != nil {
+				return result, fmt.Errorf("failed parsing profile %s: %w", file, err)
+			}
+			if profile.UUID != "" && seen[profile.UUID] {
+				log.WithFields(log.Fields{"profile": file, "uuid": profile.UUID}).Debug("skipping duplicate profile")
+				continue
+			}
+			seen[profile.UUID] = true
+			password, source, err := passwords.Resolve(file, profile)
+			if err != nil {
+				return result, err
+			}
+			log.WithFields(log.Fields{"profile": file, "source": source}).Info("resolved p12 password")
+			candidates = appendUnique(candidates, password)
+			profiles = append(profiles, ProfileFile{Path: file, Profile: profile})
+			rawProfiles = append(rawProfiles, profileBytes)
+		}
+	}
+	candidates = appendUnique(candidates, passwords.Default)
+
+	certificates := []CertificateFile{}
+	for _, dir := range dirs {
+		files, unpaired, err := readCertificateFiles(dir, passwords, candidates)
+		if err != nil {
+			return result, err
+		}
+		certificates = append(certificates, files...)
+		result.UnpairedCertificates = append(result.UnpairedCertificates, unpaired...)
+	}
+
+	used := map[string]bool{}
+	for i, file := range profiles {
+		certificate, ok := pairCertificate(file, certificates)
+		if !ok {
+			result.UnpairedProfiles = append(result.UnpairedProfiles, UnpairedFile{
+				Path:   file.Path,
+				Reason: fmt.Sprintf("none of its %d developer certificates was found", len(file.Profile.DeveloperCertificates)),
+			})
+			continue
+		}
+		used[certificate.Path] = true
+		result.Profiles = append(result.Profiles, ProfileAndCertificate{
+			RawData:                   rawProfiles[i],
+			MobileProvisioningProfile: file.Profile,
+			CertificateSha1:           getSha1Fingerprint(certificate.Certificate),
+			SigningCert:               certificate.Certificate,
+			PrivateKey:                certificate.PrivateKey,
+			P12Bytes:                  certificate.P12Bytes,
+			P12Password:               certificate.Password,
+			PEMBytes:                  certificate.PEMBytes,
+		})
+	}
+	for _, certificate := range certificates {
+		if used[certificate.Path] {
+			continue
+		}
+		used[certificate.Path] = true
+		result.UnpairedCertificates = append(result.UnpairedCertificates, UnpairedFile{Path: certificate.Path, Reason: "not contained in any profile"})
+	}
+	sort.Slice(result.UnpairedCertificates, func(i, j int) bool {
+		return result.UnpairedCertificates[i].Path < result.UnpairedCertificates[j].Path
+	})
+	return result, nil
+}
+
+//pairCertificate returns the certificate for the profile, preferring the one with the same file name
+func pairCertificate(file ProfileFile, certificates []CertificateFile) (CertificateFile, bool) {
+	fingerprints := map[string]bool{}
+	for _, certBytes := range file.Profile.DeveloperCertificates {
+		cert, err := x509.ParseCertificate(certBytes)
+		if err != nil {
+			continue
+		}
+		fingerprints[getSha1Fingerprint(cert)] = true
+	}
+	name := strings.TrimSuffix(file.Path, filepath.Ext(file.Path))
+	var result CertificateFile
+	found := false
+	for _, certificate := range certificates {
+		if !fingerprints[getSha1Fingerprint(certificate.Certificate)] {
+			continue
+		}
+		if strings.TrimSuffix(certificate.Path, filepath.Ext(certificate.Path)) == name {
+			return certificate, true
+		}
+		if !found {
+			result, found = certificate, true
+		}
+	}
+	return result, found
+}
+
+//readCertificateFiles reads all .p12 and .pem files in dir and its subdirectories.
+//A p12 can contain several certificates with keys.
+//Files that cannot be read or decrypted with any of the passwords are returned as unpaired.
+func readCertificateFiles(dir string, passwords P12Passwords, candidates []string) ([]CertificateFile, []UnpairedFile, error) {
+	certificates := []CertificateFile{}
+	unpaired := []UnpairedFile{}
+	p12Files, err := findFiles(dir, ".p12")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, file := range p12Files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		tried := candidates
+		password, ok, err := passwords.ResolveCertificate(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			tried = []string{password}
+		}
+		contents, password, err := decodeP12WithPasswords(data, tried)
+		if err != nil {
+			unpaired = append(unpaired, UnpairedFile{Path: file, Reason: err.Error()})
+			continue
+		}
+		if len(contents.Identities) == 0 {
+			unpaired = append(unpaired, UnpairedFile{Path: file, Reason: "contains no private key"})
+			continue
+		}
+		for _, identity := range contents.Identities {
+			certificates = append(certificates, CertificateFile{Path: file, Certificate: identity.Certificate, PrivateKey: identity.PrivateKey, P12Bytes: data, Password: password})
+		}
+	}
+
+	pemFiles, err := findFiles(dir, ".pem")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, file := range pemFiles {
+		keyFile := strings.TrimSuffix(file, ".pem") + ".key"
+		if _, err := os.Stat(keyFile); err != nil {
+			keyFile = ""
+		}
+		cert, key, err := readPEMCertificate(file, keyFile)
+		if err != nil {
+			unpaired = append(unpaired, UnpairedFile{Path: file, Reason: err.Error()})
+			continue
+		}
+		pemBytes, err := EncodePEMCertificate(cert, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		certificates = append(certificates, CertificateFile{Path: file, Certificate: cert, PrivateKey: key, PEMBytes: pemBytes})
+	}
+	return certificates, unpaired, nil
+}
+
+//decodeP12WithPasswords tries each password until the p12 can be decoded and returns the one that worked
+func decodeP12WithPasswords(data []byte, passwords []string) (P12Contents, string, error) {
+	for _, password := range passwords {
+		contents, err := DecodeP12(data, password)
+		if errors.Is(err, ErrP12Password) {
+			continue
+		}
+		return contents, password, err
+	}
+	return P12Contents{}, "", fmt.Errorf("%w, none of the %d passwords matches", ErrP12Password, len(passwords))
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, existing := range values {
+		if existing == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
@@ -0,0 +1,96 @@
+package codesign_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/danielpaulus/app-signer/codesign"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadProfiles(t *testing.T) {
+	profilesDir, err := ioutil.TempDir("", "profiles")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(profilesDir)
+	certificatesDir, err := ioutil.TempDir("", "certificates")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(certificatesDir)
+
+	leaf := readFixtureCertificate(t, "leaf.pem")
+	ca := readFixtureCertificate(t, "ca.pem")
+	unknown, _ := makeSigningCertificate("Apple Development: Unknown (ABC)", "TEAMID")
+	orphan, orphanKey := makeSigningCertificate("Apple Development: Orphan (ABC)", "TEAMID")
+	for name, certificates := range map[string][][]byte{
+		"4f5a9a0e-uuid": {ca.Raw, leaf.Raw},
+		"shared":        {leaf.Raw},
+		"lonely":        {unknown.Raw},
+	} {
+		profile := testProfile(name, "TEAMID.*", leaf.NotAfter, "device1").MobileProvisioningProfile
+		profile.UUID = name
+		profile.DeveloperCertificates = certificates
+		writeSignedProfile(t, path.Join(profilesDir, name+".mobileprovision"), profile)
+	}
+	assert.NoError(t, ioutil.WriteFile(path.Join(certificatesDir, "team.p12"), readBytes("fixtures/p12/chain-aes.p12"), 0600))
+	assert.NoError(t, ioutil.WriteFile(path.Join(certificatesDir, "broken.p12"), readBytes("fixtures/p12/chain-3des.p12"), 0600))
+	assert.NoError(t, ioutil.WriteFile(path.Join(certificatesDir, "broken"+codesign.P12PasswordSidecarExtension), []byte("wrong"), 0600))
+	orphanPEM, err := codesign.EncodePEMCertificate(orphan, orphanKey)
+	if assert.NoError(t, err) {
+		assert.NoError(t, ioutil.WriteFile(path.Join(certificatesDir, "orphan.pem"), orphanPEM, 0600))
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	loaded, err := codesign.LoadProfiles([]string{profilesDir, certificatesDir}, codesign.P12Passwords{Default: "test"}, testProfileTrust())
+	log.SetOutput(os.Stderr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, logs.String(), "source=\"default password\"")
+	if assert.Len(t, loaded.Profiles, 2) {
+		for _, profile := range loaded.Profiles {
+			assert.Equal(t, leaf.Raw, profile.SigningCert.Raw)
+			assert.Equal(t, "test", profile.P12Password)
+			assert.NotEmpty(t, profile.P12Bytes)
+		}
+	}
+	if assert.Len(t, loaded.UnpairedProfiles, 1) {
+		assert.Equal(t, path.Join(profilesDir, "lonely.mobileprovision"), loaded.UnpairedProfiles[0].Path)
+	}
+	if assert.Len(t, loaded.UnpairedCertificates, 2) {
+		assert.Equal(t, path.Join(certificatesDir, "broken.p12"), loaded.UnpairedCertificates[0].Path)
+		assert.Contains(t, loaded.UnpairedCertificates[0].Reason, codesign.ErrP12Password.Error())
+		assert.Equal(t, path.Join(certificatesDir, "orphan.pem"), loaded.UnpairedCertificates[1].Path)
+		assert.Equal(t, "not contained in any profile", loaded.UnpairedCertificates[1].Reason)
+	}
+
+	assert.Empty(t, loaded.RejectedProfiles)
+
+	profiles, err := codesign.ParseProfilesWithPasswords(strings.Join([]string{profilesDir, certificatesDir}, string(os.PathListSeparator)), codesign.P12Passwords{Default: "test"}, testProfileTrust())
+	assert.NoError(t, err)
+	assert.Len(t, profiles, 2)
+	_, err = codesign.ParseProfilesWithPasswords(profilesDir, codesign.P12Passwords{Default: "test"}, testProfileTrust())
+	assert.EqualError(t, err, "none of the 3 profiles in path "+profilesDir+" could be paired with a certificate")
+
+	tampered, err := ioutil.ReadFile(path.Join(profilesDir, "shared.mobileprovision"))
+	if assert.NoError(t, err) {
+		tampered = bytes.Replace(tampered, []byte("device1"), []byte("device2"), 1)
+		assert.NoError(t, ioutil.WriteFile(path.Join(profilesDir, "shared.mobileprovision"), tampered, 0644))
+	}
+	loaded, err = codesign.LoadProfiles([]string{profilesDir, certificatesDir}, codesign.P12Passwords{Default: "test"}, testProfileTrust())
+	if assert.NoError(t, err) && assert.Len(t, loaded.RejectedProfiles, 1) {
+		assert.Len(t, loaded.Profiles, 1)
+		assert.Equal(t, path.Join(profilesDir, "shared.mobileprovision"), loaded.RejectedProfiles[0].Path)
+		assert.Contains(t, loaded.RejectedProfiles[0].Reason, codesign.ErrUntrustedProfile.Error())
+	}
+	_, err = codesign.ParseProfiles(strings.Join([]string{profilesDir, certificatesDir}, string(os.PathListSeparator)), "test")
+	assert.ErrorIs(t, err, codesign.ErrUntrustedProfile, "the test root is not trusted by default")
+}
@@ -2,17 +2,18 @@ package codesign
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/sha1"
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/pkcs12"
 
 	"github.com/fullsailor/pkcs7"
 	plist "howett.net/plist"
@@ -20,14 +21,18 @@ import (
 
 //ProfileAndCertificate contains a profiles raw bytes,
 //a parsed MobileProvisioningProfile struct to access the fields,
-//the p12 sha1 fingerprint, x509.Certificate and the raw p12 bytes
-//belonging to this profile.
+//the p12 sha1 fingerprint, x509.Certificate, its private key, the raw p12 bytes
+//and the password they were decoded with belonging to this profile.
+//If the certificate was read from PEM files, P12Bytes is empty and PEMBytes contains certificate and key instead.
 type ProfileAndCertificate struct {
 	RawData                   []byte
 	MobileProvisioningProfile MobileProvisioningProfile
 	CertificateSha1           string
 	SigningCert               *x509.Certificate
+	PrivateKey                crypto.Signer
 	P12Bytes                  []byte
+	P12Password               string
+	PEMBytes                  []byte
 }
 
 //MobileProvisioningProfile is an exact representation of a *.mobileprovision plist
@@ -42,6 +47,7 @@ type MobileProvisioningProfile struct {
 	ExpirationDate              time.Time
 	Name                        string
 	ProvisionedDevices          []string
+	ProvisionsAllDevices        bool
 	TeamIdentifier              []string
 	TeamName                    string
 	TimeToLive                  int
@@ -50,9 +56,14 @@ type MobileProvisioningProfile struct {
 }
 
 //FindProfileForDevice finds the correct profile for a given device udid out of an array
-//of profiles and returns the index of the correct profile or -1 if the device is not in any of them
+//of profiles and returns the index of the correct profile or -1 if the device is not in any of them.
+//Profiles that expired or whose certificate expired are skipped, SelectProfiles explains why a profile is not used.
 func FindProfileForDevice(udid string, profileAndCertificates []ProfileAndCertificate) int {
+	now := time.Now()
 	for profileIndex, profileAndCertificate := range profileAndCertificates {
+		if expired, _ := profileAndCertificate.CheckExpiry(now, 0); len(expired) > 0 {
+			continue
+		}
 		for _, profileUdid := range profileAndCertificate.MobileProvisioningProfile.ProvisionedDevices {
 			if profileUdid == udid {
 				return profileIndex
@@ -75,13 +86,21 @@ func verifyP12CertIsInProfile(p12cert *x509.Certificate, certificates []*x509.Ce
 	return false
 }
 
-//IsEnterpriseProfile returns true if there is an enterprise profile at profilePath and
+//IsEnterpriseProfile returns true if there is an enterprise profile signed by Apple at profilePath and
 //false otherwise.
 func IsEnterpriseProfile(profilePath string) bool {
+	return IsEnterpriseProfileWithTrust(profilePath, ProfileTrust{})
+}
+
+//IsEnterpriseProfileWithTrust works like IsEnterpriseProfile but accepts profiles trust accepts.
+func IsEnterpriseProfileWithTrust(profilePath string, trust ProfileTrust) bool {
 	profileBytes, err := ioutil.ReadFile(profilePath)
 	if err != nil {
 		return false
 	}
+	if trust.Verify(profileBytes) != nil {
+		return false
+	}
 	p7, err := pkcs7.Parse(profileBytes)
 	if err != nil {
 		return false
@@ -100,80 +119,209 @@ func IsEnterpriseProfile(profilePath string) bool {
 	return false
 }
 
-//ParseProfiles looks for *.mobileprovision in the given path and parses each of them.
+//ParseProfiles looks for *.mobileprovision and *.provisionprofile files in the given path and its subdirectories and
+//pairs each of them with its certificate, see LoadProfiles. The path can be a list of directories, see ProfileDirectories.
+//profilePassword is used for every p12 file without a password of its own, see LoadP12Passwords.
 //It returns an error if the path does not contain any profiles.
 func ParseProfiles(profilesPath string, profilePassword string) ([]ProfileAndCertificate, error) {
-	result := []ProfileAndCertificate{}
-	profiles, err := filepath.Glob(path.Join(profilesPath, "*.mobileprovision"))
+	passwords, err := LoadP12Passwords(profilesPath, profilePassword, "")
 	if err != nil {
-		return result, err
+		return []ProfileAndCertificate{}, err
 	}
-	for _, file := range profiles {
-		log.Infof("parsing profile '%s'", file)
-		profile, err := ParseProfile(file, profilePassword)
-		if err != nil {
-			return result, err
-		}
-		result = append(result, profile)
+	return ParseProfilesWithPasswords(profilesPath, passwords, ProfileTrust{})
+}
 
+//ParseProfilesWithPasswords works like ParseProfiles but resolves the password of each p12 file with passwords and
+//only loads profiles whose signature is trusted by trust.
+//Profiles and certificates that could not be paired are logged, it is an error if no profile could be paired.
+func ParseProfilesWithPasswords(profilesPath string, passwords P12Passwords, trust ProfileTrust) ([]ProfileAndCertificate, error) {
+	loaded, err := LoadProfiles(ProfileDirectories(profilesPath), passwords, trust)
+	if err != nil {
+		return []ProfileAndCertificate{}, err
 	}
-	if len(result) == 0 {
-		return result, fmt.Errorf("no profiles found in path %s", profilesPath)
+	for _, profile := range loaded.Profiles {
+		log.WithFields(log.Fields{"profile": profile.MobileProvisioningProfile.Name, "cert": profile.CertificateSha1}).Info("paired profile with certificate")
 	}
-	return result, nil
+	for _, file := range loaded.RejectedProfiles {
+		log.WithFields(log.Fields{"profile": file.Path, "reason": file.Reason}).Error("rejected profile")
+	}
+	for _, file := range loaded.UnpairedProfiles {
+		log.WithFields(log.Fields{"profile": file.Path, "reason": file.Reason}).Warn("profile has no certificate")
+	}
+	for _, file := range loaded.UnpairedCertificates {
+		log.WithFields(log.Fields{"certificate": file.Path, "reason": file.Reason}).Warn("certificate has no profile")
+	}
+	if len(loaded.Profiles) == 0 {
+		if len(loaded.RejectedProfiles) > 0 && len(loaded.UnpairedProfiles) == 0 {
+			return loaded.Profiles, fmt.Errorf("%w: all %d profiles in path %s were rejected", ErrUntrustedProfile, len(loaded.RejectedProfiles), profilesPath)
+		}
+		if len(loaded.UnpairedProfiles) > 0 {
+			return loaded.Profiles, fmt.Errorf("none of the %d profiles in path %s could be paired with a certificate", len(loaded.UnpairedProfiles), profilesPath)
+		}
+		return loaded.Profiles, fmt.Errorf("no profiles found in path %s", profilesPath)
+	}
+	return loaded.Profiles, nil
 }
 
 //ParseProfile extracts the plist from a pkcs7 signed mobileprovision file.
 //It decodes the plist into a go struct. Additionally, a p12 certificate
 //must be present next to the profile with the same filename.
 // Example: test.mobileprovision and test.p12 must both be present or the parser will fail.
+// Instead of the p12, test.pem and test.key or a single test.pem containing certificate and key can be used.
+// If the p12 contains several certificates, f.ex. the chain, the one contained in the profile is used.
 // The parser also checks if the p12 certificate is contained in the profile to prevent errors.
+// Profiles that are not signed by Apple are rejected, see ProfileTrust.
 //It returns a ProfileAndCertificate struct containing everything needed for signing.
 func ParseProfile(profilePath string, profilePassword string) (ProfileAndCertificate, error) {
+	return ParseProfileWithTrust(profilePath, profilePassword, ProfileTrust{})
+}
+
+//ParseProfileWithTrust works like ParseProfile but verifies the profile's signature with trust.
+func ParseProfileWithTrust(profilePath string, profilePassword string, trust ProfileTrust) (ProfileAndCertificate, error) {
 	profileBytes, err := ioutil.ReadFile(profilePath)
 	if err != nil {
 		return ProfileAndCertificate{}, err
 	}
-	p12bytes, err := ioutil.ReadFile(strings.Replace(profilePath, ".mobileprovision", ".p12", 1))
+	err = trust.Verify(profileBytes)
 	if err != nil {
-		return ProfileAndCertificate{}, fmt.Errorf("Failed reading p12 file for %s with err: %+v", profilePath, err)
+		return ProfileAndCertificate{}, fmt.Errorf("failed verifying profile %s: %w", profilePath, err)
 	}
-
-	_, cert, err := pkcs12.Decode(p12bytes, profilePassword)
+	profile, err := ParseMobileProvision(profileBytes)
 	if err != nil {
-		return ProfileAndCertificate{}, fmt.Errorf("Failed parsing p12 certificate with: %+v", err)
+		return ProfileAndCertificate{}, err
+	}
+
+	parsedDeveloperCertificates := make([]*x509.Certificate, len(profile.DeveloperCertificates))
+	fingerprints := make([]string, len(profile.DeveloperCertificates))
+	for i, certBytes := range profile.DeveloperCertificates {
+		cert, err := x509.ParseCertificate(certBytes)
+		parsedDeveloperCertificates[i] = cert
+		if err != nil {
+			return ProfileAndCertificate{}, err
+		}
+		fingerprints[i] = getSha1Fingerprint(cert)
+	}
+
+	result := ProfileAndCertificate{MobileProvisioningProfile: profile, RawData: profileBytes, P12Password: profilePassword}
+	p12Path, pemPath, keyPath := signingCertificateFiles(profilePath)
+	if pemPath != "" {
+		result.SigningCert, result.PrivateKey, err = readPEMCertificate(pemPath, keyPath)
+		if err != nil {
+			return ProfileAndCertificate{}, err
+		}
+		if !verifyP12CertIsInProfile(result.SigningCert, parsedDeveloperCertificates) {
+			return ProfileAndCertificate{}, fmt.Errorf("PEM certificate %s is not contained in provisioning profile, wrong profile file for this certificate", pemPath)
+		}
+		result.PEMBytes, err = EncodePEMCertificate(result.SigningCert, result.PrivateKey)
+		if err != nil {
+			return ProfileAndCertificate{}, err
+		}
+	} else {
+		result.P12Bytes, err = ioutil.ReadFile(p12Path)
+		if err != nil {
+			return ProfileAndCertificate{}, fmt.Errorf("Failed reading p12 file for %s with err: %+v", profilePath, err)
+		}
+		contents, err := DecodeP12(result.P12Bytes, profilePassword)
+		if err != nil {
+			return ProfileAndCertificate{}, fmt.Errorf("Failed parsing p12 certificate for %s with: %w", profilePath, err)
+		}
+		identity, err := contents.SigningIdentity(fingerprints)
+		if err != nil {
+			return ProfileAndCertificate{}, fmt.Errorf("p12 certificate is not contained in provisioning profile, wrong profile file for this p12: %w", err)
+		}
+		result.SigningCert = identity.Certificate
+		result.PrivateKey = identity.PrivateKey
 	}
+	result.CertificateSha1 = getSha1Fingerprint(result.SigningCert)
+	return result, nil
+}
 
+//ParseMobileProvision decodes the plist contained in the pkcs7 signed bytes of a mobileprovision file.
+func ParseMobileProvision(profileBytes []byte) (MobileProvisioningProfile, error) {
 	p7, err := pkcs7.Parse(profileBytes)
 	if err != nil {
-		return ProfileAndCertificate{}, err
+		return MobileProvisioningProfile{}, err
 	}
-
 	decoder := plist.NewDecoder(bytes.NewReader(p7.Content))
-
 	var profile MobileProvisioningProfile
 	err = decoder.Decode(&profile)
+	return profile, err
+}
 
-	parsedDeveloperCertificates := make([]*x509.Certificate, len(profile.DeveloperCertificates))
+//InstalledProfilesPath can be used in a profiles path list instead of a directory to read the profiles installed by
+//Xcode, see InstalledProfileDirectories.
+const InstalledProfilesPath = "installed"
 
-	for i, certBytes := range profile.DeveloperCertificates {
-		cert, err := x509.ParseCertificate(certBytes)
-		parsedDeveloperCertificates[i] = cert
-		if err != nil {
-			return ProfileAndCertificate{}, err
+//profileExtensions are the extensions of iOS and watchOS profiles and of tvOS and macOS profiles
+var profileExtensions = []string{".mobileprovision", ".provisionprofile"}
+
+//InstalledProfileDirectories returns the directories Xcode and the MobileDevice framework install profiles to,
+//~/Library/MobileDevice/Provisioning Profiles and ~/Library/Developer/Xcode/UserData/Provisioning Profiles.
+//Only existing directories are returned.
+func InstalledProfileDirectories() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return []string{}
+	}
+	result := []string{}
+	for _, dir := range []string{
+		path.Join(home, "Library", "MobileDevice", "Provisioning Profiles"),
+		path.Join(home, "Library", "Developer", "Xcode", "UserData", "Provisioning Profiles"),
+	} {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			result = append(result, dir)
 		}
 	}
+	return result
+}
 
-	if !verifyP12CertIsInProfile(cert, parsedDeveloperCertificates) {
-		return ProfileAndCertificate{}, fmt.Errorf("p12 certificate is not contained in provisioning profile, wrong profile file for this p12")
+//ProfileDirectories splits a list of directories separated by the OS path list separator, ':' on macOS.
+//A leading ~ is replaced by the home directory and InstalledProfilesPath by InstalledProfileDirectories.
+func ProfileDirectories(profilesPath string) []string {
+	result := []string{}
+	for _, dir := range filepath.SplitList(profilesPath) {
+		if dir == InstalledProfilesPath {
+			result = append(result, InstalledProfileDirectories()...)
+			continue
+		}
+		if dir == "~" || strings.HasPrefix(dir, "~/") {
+			if home, err := os.UserHomeDir(); err == nil {
+				dir = path.Join(home, strings.TrimPrefix(dir, "~"))
+			}
+		}
+		result = append(result, dir)
 	}
+	return result
+}
+
+//findProfiles returns the paths of all .mobileprovision and .provisionprofile files in profilesPath and its
+//subdirectories. A directory that does not exist contains no profiles.
+func findProfiles(profilesPath string) ([]string, error) {
+	return findFiles(profilesPath, profileExtensions...)
+}
 
-	return ProfileAndCertificate{MobileProvisioningProfile: profile,
-		RawData:         profileBytes,
-		CertificateSha1: getSha1Fingerprint(cert),
-		P12Bytes:        p12bytes,
-		SigningCert:     cert,
-	}, err
+//findFiles returns all files in dir and its subdirectories with one of the extensions, sorted by path.
+func findFiles(dir string, extensions ...string) ([]string, error) {
+	result := []string{}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return result, nil
+	}
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		for _, extension := range extensions {
+			if filepath.Ext(file) == extension {
+				result = append(result, file)
+				break
+			}
+		}
+		return nil
+	})
+	return result, err
 }
 
 func getSha1Fingerprint(cert *x509.Certificate) string {
@@ -1,7 +1,10 @@
 package codesign_test
 
 import (
+	"io/ioutil"
 	"log"
+	"os"
+	"path"
 	"testing"
 	"time"
 
@@ -17,6 +20,17 @@ func TestDirWithoutProfiles(t *testing.T) {
 func TestEnterpriseProfileDetection(t *testing.T) {
 	shouldBeFalse := codesign.IsEnterpriseProfile("fixtures/embedded.mobileprovision")
 	assert.False(t, shouldBeFalse)
+
+	dir, err := ioutil.TempDir("", "enterprise")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	enterprise := path.Join(dir, "enterprise.mobileprovision")
+	writeSignedProfile(t, enterprise, codesign.MobileProvisioningProfile{Name: "enterprise", ProvisionsAllDevices: true})
+	assert.True(t, codesign.IsEnterpriseProfileWithTrust(enterprise, testProfileTrust()))
+	assert.True(t, codesign.IsEnterpriseProfileWithTrust(enterprise, codesign.ProfileTrust{Skip: true}))
+	assert.False(t, codesign.IsEnterpriseProfile(enterprise), "the test root is not an Apple root")
 }
 
 func TestParsing(t *testing.T) {
@@ -34,6 +48,16 @@ func TestParsing(t *testing.T) {
 
 }
 
+func TestFindProfileForDeviceSkipsExpired(t *testing.T) {
+	now := time.Now()
+	profiles := []codesign.ProfileAndCertificate{
+		testProfile("expired", "TEAMID.*", now.Add(-time.Hour), "device1"),
+		testProfile("valid", "TEAMID.*", now.Add(time.Hour), "device1"),
+	}
+	assert.Equal(t, 1, codesign.FindProfileForDevice("device1", profiles))
+	assert.Equal(t, -1, codesign.FindProfileForDevice("device1", profiles[:1]))
+}
+
 func TestFindDeviceInProfile(t *testing.T) {
 	profileAndCertificates, err := codesign.ParseProfiles("../provisioningprofiles", testProfilePassword)
 	if err != nil {
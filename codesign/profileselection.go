@@ -0,0 +1,231 @@
+package codesign
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//applicationIdentifierKey is the entitlement containing the team prefixed App ID of a profile
+const applicationIdentifierKey = "application-identifier"
+
+//Ranks used to order candidates in SelectProfiles. An exact App ID beats every wildcard,
+//longer wildcard prefixes beat shorter ones and the full wildcard '*' comes last.
+const (
+	rankExactAppID    = 1 << 20
+	rankWildcardAppID = 1 << 10
+)
+
+//ProfileCandidate is the result of checking one profile in SelectProfiles.
+//Index is the position of the profile in the list passed to SelectProfiles, Reasons explains
+//why the profile was accepted or rejected. Rank is only meaningful for accepted profiles, higher is better.
+//Expired is true if the profile or its signing certificate expired, such profiles are always rejected.
+type ProfileCandidate struct {
+	Index                 int
+	Name                  string
+	UUID                  string
+	ApplicationIdentifier string
+	DeviceProvisioned     bool
+	AppIDMatches          bool
+	Expired               bool
+	Rank                  int
+	Reasons               []string
+}
+
+func (c ProfileCandidate) String() string {
+	return fmt.Sprintf("'%s' (%s): %s", c.Name, c.ApplicationIdentifier, strings.Join(c.Reasons, ", "))
+}
+
+//ProfileSelection contains the profiles usable for a device and bundle identifier in Candidates, best one first,
+//and all other profiles in Rejected. UDIDs contains all checked devices, UDID is only set if it was one.
+type ProfileSelection struct {
+	UDID       string
+	UDIDs      []string
+	BundleID   string
+	Candidates []ProfileCandidate
+	Rejected   []ProfileCandidate
+}
+
+//Best returns the highest ranked candidate, ok is false if no profile can be used.
+func (s ProfileSelection) Best() (ProfileCandidate, bool) {
+	if len(s.Candidates) == 0 {
+		return ProfileCandidate{}, false
+	}
+	return s.Candidates[0], true
+}
+
+//DeviceProvisioned returns true if at least one of the checked profiles contains the device, or all devices,
+//even if it was rejected because of its App ID or because it expired.
+func (s ProfileSelection) DeviceProvisioned() bool {
+	if len(s.Candidates) > 0 {
+		return true
+	}
+	for _, rejected := range s.Rejected {
+		if rejected.DeviceProvisioned {
+			return true
+		}
+	}
+	return false
+}
+
+//Explain lists all candidates and rejected profiles with their reasons, one per line.
+func (s ProfileSelection) Explain() string {
+	lines := []string{}
+	for _, candidate := range s.Candidates {
+		lines = append(lines, "candidate "+candidate.String())
+	}
+	for _, rejected := range s.Rejected {
+		lines = append(lines, "rejected "+rejected.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+//SelectProfiles finds the profiles that can be used to sign the app with bundleID for the device with udid.
+//A profile is a candidate if it provisions the device and its application-identifier covers the bundle id,
+//either exactly or with a wildcard App ID like TEAMID.com.acme.*. Candidates are ranked by how specific their App ID is,
+//profiles with the same App ID by their expiration date. If bundleID is empty, App IDs are not checked.
+//Profiles that expired or whose signing certificate expired are rejected.
+func SelectProfiles(udid string, bundleID string, profiles []ProfileAndCertificate) ProfileSelection {
+	return SelectProfilesForDevices([]string{udid}, bundleID, profiles)
+}
+
+//SelectProfilesForDevices works like SelectProfiles, but profiles are only candidates if they provision all devices.
+func SelectProfilesForDevices(udids []string, bundleID string, profiles []ProfileAndCertificate) ProfileSelection {
+	now := time.Now()
+	selection := ProfileSelection{UDIDs: udids, BundleID: bundleID, Candidates: []ProfileCandidate{}, Rejected: []ProfileCandidate{}}
+	if len(udids) == 1 {
+		selection.UDID = udids[0]
+	}
+	for i, profile := range profiles {
+		candidate := ProfileCandidate{
+			Index:                 i,
+			Name:                  profile.MobileProvisioningProfile.Name,
+			UUID:                  profile.MobileProvisioningProfile.UUID,
+			ApplicationIdentifier: ProfileApplicationIdentifier(profile.MobileProvisioningProfile),
+		}
+		deviceReason, provisioned := checkDevices(udids, profile.MobileProvisioningProfile)
+		candidate.DeviceProvisioned = provisioned
+		candidate.Reasons = append(candidate.Reasons, deviceReason)
+		if bundleID == "" {
+			candidate.AppIDMatches = true
+			candidate.Reasons = append(candidate.Reasons, "App ID not checked because no bundle id was given")
+		} else {
+			rank, appIDReason := rankAppID(candidate.ApplicationIdentifier, profile.MobileProvisioningProfile, bundleID)
+			candidate.AppIDMatches = rank > 0
+			candidate.Rank = rank
+			candidate.Reasons = append(candidate.Reasons, appIDReason)
+		}
+		expired, _ := profile.CheckExpiry(now, 0)
+		candidate.Expired = len(expired) > 0
+		candidate.Reasons = append(candidate.Reasons, expired...)
+		if candidate.DeviceProvisioned && candidate.AppIDMatches && !candidate.Expired {
+			selection.Candidates = append(selection.Candidates, candidate)
+		} else {
+			selection.Rejected = append(selection.Rejected, candidate)
+		}
+	}
+	sort.SliceStable(selection.Candidates, func(i, j int) bool {
+		a, b := selection.Candidates[i], selection.Candidates[j]
+		if a.Rank != b.Rank {
+			return a.Rank > b.Rank
+		}
+		return profiles[a.Index].MobileProvisioningProfile.ExpirationDate.After(profiles[b.Index].MobileProvisioningProfile.ExpirationDate)
+	})
+	return selection
+}
+
+//ProfileApplicationIdentifier returns the application-identifier entitlement of the profile, f.ex. TEAMID.com.acme.*
+func ProfileApplicationIdentifier(profile MobileProvisioningProfile) string {
+	appID, _ := profile.Entitlements[applicationIdentifierKey].(string)
+	return appID
+}
+
+//ProfileTeamID returns the id of the team the profile belongs to
+func ProfileTeamID(profile MobileProvisioningProfile) string {
+	if len(profile.TeamIdentifier) > 0 {
+		return profile.TeamIdentifier[0]
+	}
+	if teamID, ok := profile.Entitlements[teamIdentifierEntitlement].(string); ok {
+		return teamID
+	}
+	if len(profile.ApplicationIdentifierPrefix) > 0 {
+		return profile.ApplicationIdentifierPrefix[0]
+	}
+	return ""
+}
+
+//MatchAppID checks if the App ID, without team prefix, covers the bundle identifier.
+//Like on Apple's side, the wildcard App ID com.acme.* covers com.acme itself and everything below it.
+//Exact is true if they are equal, ok is false if the App ID does not cover the bundle identifier.
+func MatchAppID(appID string, bundleID string) (exact bool, ok bool) {
+	if appID == bundleID {
+		return true, true
+	}
+	if appID == "*" {
+		return false, true
+	}
+	if prefix := strings.TrimSuffix(appID, ".*"); prefix != appID && (bundleID == prefix || strings.HasPrefix(bundleID, prefix+".")) {
+		return false, true
+	}
+	return false, false
+}
+
+func checkDevice(udid string, profile MobileProvisioningProfile) (string, bool) {
+	if profile.ProvisionsAllDevices {
+		return "provisions all devices", true
+	}
+	for _, device := range profile.ProvisionedDevices {
+		if device == udid {
+			return fmt.Sprintf("device '%s' is provisioned", udid), true
+		}
+	}
+	return fmt.Sprintf("device '%s' is not one of the %d provisioned devices", udid, len(profile.ProvisionedDevices)), false
+}
+
+func checkDevices(udids []string, profile MobileProvisioningProfile) (string, bool) {
+	if len(udids) == 1 {
+		return checkDevice(udids[0], profile)
+	}
+	if profile.ProvisionsAllDevices {
+		return "provisions all devices", true
+	}
+	missing := []string{}
+	for _, udid := range udids {
+		if _, ok := checkDevice(udid, profile); !ok {
+			missing = append(missing, "'"+udid+"'")
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Sprintf("%d of %d devices are not provisioned: %s", len(missing), len(udids), strings.Join(missing, ", ")), false
+	}
+	return fmt.Sprintf("all %d devices are provisioned", len(udids)), true
+}
+
+func rankAppID(applicationIdentifier string, profile MobileProvisioningProfile, bundleID string) (int, string) {
+	if applicationIdentifier == "" {
+		return 0, "profile has no application-identifier entitlement"
+	}
+	appID := stripTeamPrefix(applicationIdentifier, profile)
+	exact, ok := MatchAppID(appID, bundleID)
+	switch {
+	case !ok:
+		return 0, fmt.Sprintf("App ID '%s' does not match '%s'", appID, bundleID)
+	case exact:
+		return rankExactAppID, fmt.Sprintf("App ID '%s' matches exactly", appID)
+	}
+	return rankWildcardAppID + len(appID), fmt.Sprintf("wildcard App ID '%s' matches '%s'", appID, bundleID)
+}
+
+//stripTeamPrefix removes the team or app id prefix from an application-identifier
+func stripTeamPrefix(applicationIdentifier string, profile MobileProvisioningProfile) string {
+	for _, prefix := range append(profile.ApplicationIdentifierPrefix, profile.TeamIdentifier...) {
+		if strings.HasPrefix(applicationIdentifier, prefix+".") {
+			return strings.TrimPrefix(applicationIdentifier, prefix+".")
+		}
+	}
+	if index := strings.Index(applicationIdentifier, "."); index != -1 {
+		return applicationIdentifier[index+1:]
+	}
+	return applicationIdentifier
+}
@@ -0,0 +1,123 @@
+package codesign_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/app-signer/codesign"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchAppID(t *testing.T) {
+	testCases := []struct {
+		appID    string
+		bundleID string
+		exact    bool
+		ok       bool
+	}{
+		{"com.acme.app", "com.acme.app", true, true},
+		{"com.acme.*", "com.acme.app", false, true},
+		{"com.acme.*", "com.acme.app.widget", false, true},
+		{"*", "org.other", false, true},
+		{"com.acme.*", "com.acmeapp", false, false},
+		{"com.acme.*", "com.acme", false, true},
+		{"com.acme.*", "com", false, false},
+		{"com.acme.app", "com.acme.app.widget", false, false},
+	}
+	for _, testCase := range testCases {
+		exact, ok := codesign.MatchAppID(testCase.appID, testCase.bundleID)
+		assert.Equal(t, testCase.exact, exact, testCase.appID+" "+testCase.bundleID)
+		assert.Equal(t, testCase.ok, ok, testCase.appID+" "+testCase.bundleID)
+	}
+}
+
+func TestSelectProfiles(t *testing.T) {
+	now := time.Now()
+	profiles := []codesign.ProfileAndCertificate{
+		testProfile("wildcard", "TEAMID.*", now.Add(48*time.Hour), "device1"),
+		testProfile("acme wildcard", "TEAMID.com.acme.*", now.Add(24*time.Hour), "device1"),
+		testProfile("exact", "TEAMID.com.acme.app", now.Add(24*time.Hour), "device1"),
+		testProfile("other device", "TEAMID.com.acme.app", now.Add(24*time.Hour), "device2"),
+		testProfile("other app", "TEAMID.com.other.app", now.Add(24*time.Hour), "device1"),
+		testProfile("acme wildcard newer", "TEAMID.com.acme.*", now.Add(72*time.Hour), "device1"),
+	}
+
+	selection := codesign.SelectProfiles("device1", "com.acme.app", profiles)
+	names := []string{}
+	for _, candidate := range selection.Candidates {
+		names = append(names, candidate.Name)
+	}
+	assert.Equal(t, []string{"exact", "acme wildcard newer", "acme wildcard", "wildcard"}, names)
+	best, ok := selection.Best()
+	assert.True(t, ok)
+	assert.Equal(t, 2, best.Index)
+	assert.Equal(t, []string{"device 'device1' is provisioned", "App ID 'com.acme.app' matches exactly"}, best.Reasons)
+
+	if assert.Len(t, selection.Rejected, 2) {
+		assert.Equal(t, "other device", selection.Rejected[0].Name)
+		assert.False(t, selection.Rejected[0].DeviceProvisioned)
+		assert.Equal(t, "other app", selection.Rejected[1].Name)
+		assert.Contains(t, selection.Rejected[1].Reasons, "App ID 'com.other.app' does not match 'com.acme.app'")
+	}
+	assert.Contains(t, selection.Explain(), "rejected 'other device' (TEAMID.com.acme.app): device 'device1' is not one of the 1 provisioned devices")
+
+	selection = codesign.SelectProfiles("device2", "com.other.app", profiles)
+	assert.True(t, selection.DeviceProvisioned())
+	_, ok = selection.Best()
+	assert.False(t, ok)
+
+	selection = codesign.SelectProfiles("device3", "", profiles)
+	assert.False(t, selection.DeviceProvisioned())
+}
+
+func testProfile(name string, applicationIdentifier string, expiration time.Time, devices ...string) codesign.ProfileAndCertificate {
+	return codesign.ProfileAndCertificate{MobileProvisioningProfile: codesign.MobileProvisioningProfile{
+		Name:                        name,
+		ApplicationIdentifierPrefix: []string{"TEAMID"},
+		TeamIdentifier:              []string{"TEAMID"},
+		Entitlements:                map[string]interface{}{"application-identifier": applicationIdentifier},
+		ExpirationDate:              expiration,
+		ProvisionedDevices:          devices,
+	}}
+}
+
+func TestSelectProfilesRejectsExpired(t *testing.T) {
+	now := time.Now()
+	expiredCert, _ := makeSigningCertificate("Apple Development: Expired (ABC)", "TEAMID")
+	expiredCert.NotAfter = now.Add(-time.Hour)
+	withExpiredCert := testProfile("expired cert", "TEAMID.*", now.Add(24*time.Hour), "device1")
+	withExpiredCert.SigningCert = expiredCert
+	profiles := []codesign.ProfileAndCertificate{
+		testProfile("expired", "TEAMID.com.acme.app", now.Add(-24*time.Hour), "device1"),
+		withExpiredCert,
+		testProfile("valid", "TEAMID.*", now.Add(24*time.Hour), "device1"),
+	}
+
+	selection := codesign.SelectProfiles("device1", "com.acme.app", profiles)
+	best, ok := selection.Best()
+	if assert.True(t, ok) {
+		assert.Equal(t, "valid", best.Name)
+	}
+	if assert.Len(t, selection.Rejected, 2) {
+		assert.True(t, selection.Rejected[0].Expired)
+		assert.Contains(t, selection.Rejected[0].Reasons, "profile 'expired' expired on "+now.Add(-24*time.Hour).Format("2006-01-02"))
+		assert.Contains(t, selection.Rejected[1].Reasons, "certificate 'Apple Development: Expired (ABC)' expired on "+now.Add(-time.Hour).Format("2006-01-02"))
+	}
+	assert.True(t, codesign.SelectProfiles("device1", "com.other.app", profiles[:2]).DeviceProvisioned())
+}
+
+func TestCheckExpiry(t *testing.T) {
+	now := time.Now()
+	profile := testProfile("soon", "TEAMID.*", now.Add(10*24*time.Hour+time.Hour), "device1")
+	expired, expiring := profile.CheckExpiry(now, codesign.DefaultExpiryWarning)
+	assert.Empty(t, expired)
+	assert.Equal(t, []string{"profile 'soon' expires in 10 days on " + now.Add(10*24*time.Hour+time.Hour).Format("2006-01-02")}, expiring)
+
+	expired, expiring = profile.CheckExpiry(now, 7*24*time.Hour)
+	assert.Empty(t, expired)
+	assert.Empty(t, expiring)
+
+	expired, expiring = codesign.ProfileAndCertificate{}.CheckExpiry(now, codesign.DefaultExpiryWarning)
+	assert.Empty(t, expired)
+	assert.Empty(t, expiring)
+}
@@ -0,0 +1,174 @@
+package codesign
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/fullsailor/pkcs7"
+)
+
+//appleRootFingerprints are the SHA-256 fingerprints of the Apple roots provisioning profiles chain up to.
+//Profiles contain their whole chain including the root, so pinning the fingerprint is enough to trust it.
+var appleRootFingerprints = []string{
+	//Apple Root CA
+	"b0b1730ecbc7ff4505142c49f1295e6eda6bcaed7e2c68c5be91b5a11001f024",
+}
+
+//Apple signs profiles with a certificate named like 'Apple iPhone OS Provisioning Profile Signing' for Apple Inc.
+//Developer certificates chain up to the same root, so the signer is checked as well.
+const (
+	profileSignerOrganization = "Apple Inc."
+	profileSignerSuffix       = "Provisioning Profile Signing"
+)
+
+//maxProfileChainLength limits the certificates between the signer and the root
+const maxProfileChainLength = 5
+
+//ErrUntrustedProfile is returned for profiles without a valid signature by Apple, f.ex. because they were modified.
+var ErrUntrustedProfile = errors.New("provisioning profile is not signed by Apple")
+
+//ProfileTrust decides which provisioning profile signatures are trusted. The zero value trusts the embedded Apple
+//roots, Roots adds more roots, f.ex. for profiles of a private test CA. Skip disables the verification.
+type ProfileTrust struct {
+	Roots []*x509.Certificate
+	Skip  bool
+}
+
+//LoadProfileTrust trusts the Apple roots and all certificates in the PEM file at rootsPath.
+//An empty rootsPath only trusts the Apple roots.
+func LoadProfileTrust(rootsPath string) (ProfileTrust, error) {
+	trust := ProfileTrust{Roots: []*x509.Certificate{}}
+	if rootsPath == "" {
+		return trust, nil
+	}
+	data, err := ioutil.ReadFile(rootsPath)
+	if err != nil {
+		return trust, fmt.Errorf("failed reading profile roots: %w", err)
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return trust, fmt.Errorf("failed parsing profile root in %s: %w", rootsPath, err)
+		}
+		trust.Roots = append(trust.Roots, cert)
+	}
+	if len(trust.Roots) == 0 {
+		return trust, fmt.Errorf("no certificates found in profile roots %s", rootsPath)
+	}
+	return trust, nil
+}
+
+//Verify checks the CMS signature of the profile. The content must match the signature, the signer must be Apple's
+//provisioning profile signing certificate and it must chain up to a trusted root. Certificates are checked for the
+//signing time of the profile, so profiles signed by certificates that expired since are still trusted.
+//Errors wrap ErrUntrustedProfile.
+func (t ProfileTrust) Verify(profileBytes []byte) error {
+	if t.Skip {
+		return nil
+	}
+	p7, err := pkcs7.Parse(profileBytes)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUntrustedProfile, err)
+	}
+	err = p7.Verify()
+	if err != nil {
+		return fmt.Errorf("%w: invalid signature: %v", ErrUntrustedProfile, err)
+	}
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return fmt.Errorf("%w: expected exactly one signer", ErrUntrustedProfile)
+	}
+	if !isProfileSigner(signer) {
+		return fmt.Errorf("%w: signed by '%s'", ErrUntrustedProfile, signer.Subject.CommonName)
+	}
+	signingTime := time.Now()
+	var signed time.Time
+	if p7.UnmarshalSignedAttribute(oidAttributeSigningTime, &signed) == nil {
+		signingTime = signed
+	}
+
+	roots := append([]*x509.Certificate{}, t.Roots...)
+	for _, cert := range p7.Certificates {
+		if isAppleRoot(cert) {
+			roots = append(roots, cert)
+		}
+	}
+	return verifyProfileChain(signer, p7.Certificates, roots, signingTime)
+}
+
+//verifyProfileChain walks from cert up to one of the roots. Signatures are checked with CheckSignature, because
+//x509.Certificate.Verify rejects the SHA-1 signatures of Apple's older intermediates.
+func verifyProfileChain(cert *x509.Certificate, intermediates []*x509.Certificate, roots []*x509.Certificate, at time.Time) error {
+	for depth := 0; depth <= maxProfileChainLength; depth++ {
+		if at.Before(cert.NotBefore) || at.After(cert.NotAfter) {
+			return fmt.Errorf("%w: certificate '%s' was not valid at %s", ErrUntrustedProfile, cert.Subject.CommonName, at.Format(time.RFC3339))
+		}
+		for _, root := range roots {
+			if bytes.Equal(root.Raw, cert.Raw) {
+				return nil
+			}
+		}
+		parent := findIssuer(cert, roots)
+		if parent == nil {
+			parent = findIssuer(cert, intermediates)
+		}
+		if parent == nil {
+			return fmt.Errorf("%w: no trusted issuer for '%s'", ErrUntrustedProfile, cert.Subject.CommonName)
+		}
+		cert = parent
+	}
+	return fmt.Errorf("%w: certificate chain is longer than %d", ErrUntrustedProfile, maxProfileChainLength)
+}
+
+//findIssuer returns the CA certificate among candidates that signed cert
+func findIssuer(cert *x509.Certificate, candidates []*x509.Certificate) *x509.Certificate {
+	for _, candidate := range candidates {
+		if bytes.Equal(candidate.Raw, cert.Raw) || !bytes.Equal(candidate.RawSubject, cert.RawIssuer) {
+			continue
+		}
+		if !candidate.BasicConstraintsValid || !candidate.IsCA {
+			continue
+		}
+		if candidate.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil {
+			return candidate
+		}
+	}
+	return nil
+}
+
+func isProfileSigner(cert *x509.Certificate) bool {
+	if !strings.HasSuffix(cert.Subject.CommonName, profileSignerSuffix) {
+		return false
+	}
+	for _, organization := range cert.Subject.Organization {
+		if organization == profileSignerOrganization {
+			return true
+		}
+	}
+	return false
+}
+
+func isAppleRoot(cert *x509.Certificate) bool {
+	fingerprint := fmt.Sprintf("%x", sha256.Sum256(cert.Raw))
+	for _, root := range appleRootFingerprints {
+		if fingerprint == root {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package codesign_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/app-signer/codesign"
+	"github.com/fullsailor/pkcs7"
+	"github.com/stretchr/testify/assert"
+	"howett.net/plist"
+)
+
+//profileChain is a test CA that mimics Apple's profile signing chain
+type profileChain struct {
+	root            *x509.Certificate
+	intermediate    *x509.Certificate
+	intermediateKey *rsa.PrivateKey
+	signer          *x509.Certificate
+	signerKey       *rsa.PrivateKey
+}
+
+var testChain profileChain
+var testChainOnce sync.Once
+
+func testProfileChain() profileChain {
+	testChainOnce.Do(func() {
+		root, rootKey := makeCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "Test Root CA", Organization: []string{"Apple Inc."}}, IsCA: true}, nil, nil)
+		intermediate, intermediateKey := makeCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "Test Worldwide Developer Relations", Organization: []string{"Apple Inc."}}, IsCA: true}, root, rootKey)
+		signer, signerKey := makeCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "Apple iPhone OS Provisioning Profile Signing", Organization: []string{"Apple Inc."}}}, intermediate, intermediateKey)
+		testChain = profileChain{root: root, intermediate: intermediate, intermediateKey: intermediateKey, signer: signer, signerKey: signerKey}
+	})
+	return testChain
+}
+
+//testProfileTrust trusts profiles written by writeSignedProfile
+func testProfileTrust() codesign.ProfileTrust {
+	return codesign.ProfileTrust{Roots: []*x509.Certificate{testProfileChain().root}}
+}
+
+//makeCertificate creates a certificate from template signed by parent, or a self-signed one if parent is nil
+func makeCertificate(template *x509.Certificate, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(24 * time.Hour)
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if template.IsCA {
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cert, key
+}
+
+//signProfile signs the profile like Apple does, signer's chain is embedded in the signature
+func signProfile(t *testing.T, profile codesign.MobileProvisioningProfile, signer *x509.Certificate, key *rsa.PrivateKey, chain ...*x509.Certificate) []byte {
+	content, err := plist.Marshal(profile, plist.XMLFormat)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	signedData, err := pkcs7.NewSignedData(content)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	assert.NoError(t, signedData.AddSigner(signer, key, pkcs7.SignerInfoConfig{}))
+	for _, cert := range chain {
+		signedData.AddCertificate(cert)
+	}
+	signed, err := signedData.Finish()
+	assert.NoError(t, err)
+	return signed
+}
+
+func TestVerifyProfile(t *testing.T) {
+	chain := testProfileChain()
+	trust := testProfileTrust()
+	profile := codesign.MobileProvisioningProfile{Name: "verified", UUID: "verified-uuid", ProvisionedDevices: []string{"device1"}}
+	signed := signProfile(t, profile, chain.signer, chain.signerKey, chain.intermediate, chain.root)
+	assert.NoError(t, trust.Verify(signed))
+	assert.ErrorIs(t, codesign.ProfileTrust{}.Verify(signed), codesign.ErrUntrustedProfile, "test root is not an Apple root")
+
+	tampered := bytes.Replace(signed, []byte("device1"), []byte("device2"), 1)
+	err := trust.Verify(tampered)
+	assert.ErrorIs(t, err, codesign.ErrUntrustedProfile)
+	assert.Contains(t, err.Error(), "invalid signature")
+
+	err = trust.Verify(signProfile(t, profile, chain.signer, chain.signerKey))
+	assert.ErrorIs(t, err, codesign.ErrUntrustedProfile, "intermediate is missing")
+
+	developer, developerKey := makeCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "Apple Development: Test (ABC)", OrganizationalUnit: []string{"TEAMID"}}}, chain.intermediate, chain.intermediateKey)
+	err = trust.Verify(signProfile(t, profile, developer, developerKey, chain.intermediate, chain.root))
+	assert.ErrorIs(t, err, codesign.ErrUntrustedProfile, "developer certificates chain up to the same root")
+	assert.Contains(t, err.Error(), "Apple Development: Test (ABC)")
+
+	selfSigned, selfSignedKey := makeSigningCertificate("Apple iPhone OS Provisioning Profile Signing", "APPLE")
+	err = trust.Verify(signProfile(t, profile, selfSigned, selfSignedKey))
+	assert.ErrorIs(t, err, codesign.ErrUntrustedProfile)
+
+	otherRoot, otherRootKey := makeCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "Test Root CA", Organization: []string{"Apple Inc."}}, IsCA: true}, nil, nil)
+	forged, forgedKey := makeCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "Apple iPhone OS Provisioning Profile Signing", Organization: []string{"Apple Inc."}}}, otherRoot, otherRootKey)
+	err = trust.Verify(signProfile(t, profile, forged, forgedKey, otherRoot))
+	assert.ErrorIs(t, err, codesign.ErrUntrustedProfile, "root with the same name is not trusted")
+
+	assert.ErrorIs(t, trust.Verify([]byte("no profile")), codesign.ErrUntrustedProfile)
+	assert.NoError(t, codesign.ProfileTrust{Skip: true}.Verify(tampered))
+}
+
+func TestLoadProfileTrust(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roots")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	trust, err := codesign.LoadProfileTrust("")
+	if assert.NoError(t, err) {
+		assert.Empty(t, trust.Roots)
+	}
+
+	chain := testProfileChain()
+	rootsPath := path.Join(dir, "roots.pem")
+	assert.NoError(t, ioutil.WriteFile(rootsPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chain.root.Raw}), 0644))
+	trust, err = codesign.LoadProfileTrust(rootsPath)
+	if assert.NoError(t, err) && assert.Len(t, trust.Roots, 1) {
+		assert.Equal(t, chain.root.Raw, trust.Roots[0].Raw)
+		assert.NoError(t, trust.Verify(signProfile(t, codesign.MobileProvisioningProfile{Name: "roots"}, chain.signer, chain.signerKey, chain.intermediate)))
+	}
+
+	assert.NoError(t, ioutil.WriteFile(rootsPath, []byte("no pem"), 0644))
+	_, err = codesign.LoadProfileTrust(rootsPath)
+	assert.Error(t, err)
+}
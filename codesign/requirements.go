@@ -0,0 +1,118 @@
+package codesign
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+)
+
+//Opcodes of the code requirement language as compiled by csreq, see requirement.h in the Security framework.
+const (
+	reqOpIdent              = 2
+	reqOpAnd                = 6
+	reqOpCertField          = 11
+	reqOpCertGeneric        = 14
+	reqOpAppleGenericAnchor = 15
+	reqMatchExists          = 0
+	reqMatchEqual           = 1
+	reqExprForm             = 1
+	reqTypeDesignated       = 3
+	reqCertLeaf             = 0
+)
+
+//oidAppleDeveloperCertificate marks intermediate certificates issued by Apple for developer and distribution certificates.
+var oidAppleDeveloperCertificate = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 2, 1}
+
+//DesignatedRequirement returns the requirement text codesign would generate for a binary with the
+//given identifier signed by an Apple issued certificate, f.ex.
+//identifier "com.app" and anchor apple generic and certificate leaf[subject.CN] = "Apple Development: ..." and certificate 1[field.1.2.840.113635.100.6.2.1] /* exists */
+func DesignatedRequirement(identifier string, cert *x509.Certificate) string {
+	return fmt.Sprintf(`identifier "%s" and anchor apple generic and certificate leaf[subject.CN] = "%s" and certificate 1[field.%s] /* exists */`,
+		identifier, cert.Subject.CommonName, oidAppleDeveloperCertificate)
+}
+
+//buildRequirementsBlob compiles the designated requirement for identifier and cert into a requirements set blob.
+//Without a certificate, like for ad-hoc signatures, the set is empty.
+func buildRequirementsBlob(identifier string, cert *x509.Certificate) ([]byte, error) {
+	if cert == nil {
+		return newRequirementsSet(nil), nil
+	}
+	expression := &bytes.Buffer{}
+	//"a and b and c and d" is compiled left associative: and(and(and(a, b), c), d)
+	writeUint32s(expression, reqOpAnd, reqOpAnd, reqOpAnd)
+	writeUint32s(expression, reqOpIdent)
+	writeRequirementData(expression, []byte(identifier))
+	writeUint32s(expression, reqOpAppleGenericAnchor)
+	writeUint32s(expression, reqOpCertField, reqCertLeaf)
+	writeRequirementData(expression, []byte("subject.CN"))
+	writeUint32s(expression, reqMatchEqual)
+	writeRequirementData(expression, []byte(cert.Subject.CommonName))
+	writeUint32s(expression, reqOpCertGeneric, 1)
+	oid, err := asn1.Marshal(oidAppleDeveloperCertificate)
+	if err != nil {
+		return nil, err
+	}
+	//only the content octets of the OID are stored, without tag and length
+	writeRequirementData(expression, oid[2:])
+	writeUint32s(expression, reqMatchExists)
+
+	requirement := &bytes.Buffer{}
+	writeUint32s(requirement, csMagicRequirement, uint32(12+expression.Len()), reqExprForm)
+	requirement.Write(expression.Bytes())
+	return newRequirementsSet(map[uint32][]byte{reqTypeDesignated: requirement.Bytes()}), nil
+}
+
+func newRequirementsSet(requirements map[uint32][]byte) []byte {
+	return newSuperBlob(csMagicRequirements, requirementTypes(requirements), requirements)
+}
+
+func requirementTypes(requirements map[uint32][]byte) []uint32 {
+	if _, ok := requirements[reqTypeDesignated]; ok {
+		return []uint32{reqTypeDesignated}
+	}
+	return []uint32{}
+}
+
+//newSuperBlob creates a blob of type magic that contains an index of all the given blobs in order,
+//followed by the blobs themselves. It is used for the embedded signature as well as for requirement sets.
+func newSuperBlob(magic uint32, order []uint32, blobs map[uint32][]byte) []byte {
+	length := 12 + 8*len(order)
+	for _, slot := range order {
+		length += len(blobs[slot])
+	}
+	result := &bytes.Buffer{}
+	writeUint32s(result, magic, uint32(length), uint32(len(order)))
+	offset := 12 + 8*len(order)
+	for _, slot := range order {
+		writeUint32s(result, slot, uint32(offset))
+		offset += len(blobs[slot])
+	}
+	for _, slot := range order {
+		result.Write(blobs[slot])
+	}
+	return result.Bytes()
+}
+
+//newBlob prefixes data with magic and the total length
+func newBlob(magic uint32, data []byte) []byte {
+	result := &bytes.Buffer{}
+	writeUint32s(result, magic, uint32(8+len(data)))
+	result.Write(data)
+	return result.Bytes()
+}
+
+func writeRequirementData(buffer *bytes.Buffer, data []byte) {
+	writeUint32s(buffer, uint32(len(data)))
+	buffer.Write(data)
+	if padding := len(data) % 4; padding != 0 {
+		buffer.Write(make([]byte, 4-padding))
+	}
+}
+
+func writeUint32s(buffer *bytes.Buffer, values ...uint32) {
+	for _, value := range values {
+		binary.Write(buffer, binary.BigEndian, value)
+	}
+}
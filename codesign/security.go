@@ -1,7 +1,6 @@
 package codesign
 
 import (
-	"os/exec"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -112,6 +111,13 @@ func AddX509CertificateToKeychain(keychain string, certificate string, profilePa
 	return err
 }
 
+//AddPEMToKeychain installs a certificate and its private key from a single PEM file, see EncodePEMCertificate,
+//into the given keychain.
+func AddPEMToKeychain(keychain string, certificate string) error {
+	_, err := executeSecurity("import", certificate, "-k", keychain, "-t", "agg", "-f", "pemseq", "-T", codesignPath)
+	return err
+}
+
 //KeychainHasCertificate looks for the sha1hash to be present in the given keychain.
 //It uses "security find-certificate -Z keychainpath" which prints cert output and SHA1 hash.
 func KeychainHasCertificate(keychain string, sha1hash string) bool {
@@ -122,14 +128,3 @@ func KeychainHasCertificate(keychain string, sha1hash string) bool {
 	}
 	return strings.Contains(output, strings.ToUpper(sha1hash))
 }
-
-func executeSecurity(args ...string) (string, error) {
-	cmd := exec.Command(securityPath, args...)
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		log.WithFields(log.Fields{"cmd": cmd, "output": string(output)}).Errorf("security failed")
-	}
-	log.WithFields(log.Fields{"cmd": cmd, "output": string(output)}).Debugf("security invoked")
-	return string(output), err
-}
@@ -1,18 +1,30 @@
 package codesign_test
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 
 	"os"
 	"path"
+	"runtime"
 	"testing"
 
 	"github.com/danielpaulus/app-signer/codesign"
+	"github.com/danielpaulus/app-signer/runner"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
+//skipUnlessMacOS skips tests that run the real security command against a keychain
+func skipUnlessMacOS(t *testing.T) {
+	if runtime.GOOS != "darwin" {
+		t.Skip("needs /usr/bin/security and a keychain, only available on macOS")
+	}
+}
+
 func TestCreateKeychain(t *testing.T) {
+	skipUnlessMacOS(t)
 	directory, err := ioutil.TempDir("", "appsigner-test")
 	if err != nil {
 		log.Fatalf("Failed with %+v", err)
@@ -31,6 +43,7 @@ func TestCreateKeychain(t *testing.T) {
 }
 
 func TestInstallCertificate(t *testing.T) {
+	skipUnlessMacOS(t)
 	directory, err := ioutil.TempDir("", "appsigner-test")
 	if err != nil {
 		log.Fatalf("Failed with %+v", err)
@@ -72,6 +85,7 @@ func extractFixtureCertificate(tempdir string) (string, string, error) {
 //the keychain search list. So if you work on this code, be sure to call
 //"security list-keychain" first and write your current list down somewhere :-)
 func TestGetAndSetChangesNothing(t *testing.T) {
+	skipUnlessMacOS(t)
 	originalList, err := codesign.GetKeychainSearchList()
 	if err != nil {
 		log.Fatalf("Test failed getting keychain list %+v", err)
@@ -88,6 +102,7 @@ func TestGetAndSetChangesNothing(t *testing.T) {
 }
 
 func TestAddRemoveKeychain(t *testing.T) {
+	skipUnlessMacOS(t)
 	originalList, err := codesign.GetKeychainSearchList()
 	if err != nil {
 		log.Fatalf("Test failed getting keychain list %+v", err)
@@ -118,6 +133,7 @@ func TestAddRemoveKeychain(t *testing.T) {
 }
 
 func TestRemoveNonPresentItemDoesNothing(t *testing.T) {
+	skipUnlessMacOS(t)
 	originalList, err := codesign.GetKeychainSearchList()
 	if err != nil {
 		log.Fatalf("Test failed getting keychain list %+v", err)
@@ -130,3 +146,62 @@ func TestRemoveNonPresentItemDoesNothing(t *testing.T) {
 	}
 	assert.ElementsMatch(t, originalList, listAfterTesting)
 }
+
+//fakeSecurity simulates the keychain search list of the security command, so the keychain handling
+//can be tested on any OS.
+func fakeSecurity(searchList []string) *runner.FakeRunner {
+	fake := runner.NewFakeRunner()
+	fake.Fallback = func(cmd runner.Command) (runner.Result, error) {
+		if len(cmd.Args) == 0 || cmd.Args[0] != "list-keychain" {
+			return runner.Result{}, nil
+		}
+		if len(cmd.Args) > 2 && cmd.Args[1] == "-s" {
+			searchList = append([]string{}, cmd.Args[2:]...)
+			return runner.Result{}, nil
+		}
+		output := ""
+		for _, entry := range searchList {
+			output += fmt.Sprintf("    \"%s\"\n", entry)
+		}
+		return runner.Output(output), nil
+	}
+	return fake
+}
+
+func TestKeychainSearchListWithFakeRunner(t *testing.T) {
+	fake := fakeSecurity([]string{"/Users/test/Library/Keychains/login.keychain-db"})
+	defer codesign.SetCommandRunner(codesign.SetCommandRunner(fake))
+
+	err := codesign.AddKeychainToSearchList("/tmp/app.keychain")
+	if assert.NoError(t, err) {
+		list, _ := codesign.GetKeychainSearchList()
+		assert.Equal(t, []string{"/Users/test/Library/Keychains/login.keychain-db", "/tmp/app.keychain"}, list)
+	}
+	err = codesign.RemoveFromKeychainSearchList("/tmp/app.keychain")
+	if assert.NoError(t, err) {
+		list, _ := codesign.GetKeychainSearchList()
+		assert.Equal(t, []string{"/Users/test/Library/Keychains/login.keychain-db"}, list)
+	}
+	assert.Equal(t, "/usr/bin/security list-keychain -s /Users/test/Library/Keychains/login.keychain-db /tmp/app.keychain", fake.CommandLines()[1])
+}
+
+func TestKeychainCommandsWithFakeRunner(t *testing.T) {
+	fake := runner.NewFakeRunner()
+	fake.Respond(runner.Output("SHA-1 hash: ABCDEF\n"), nil, "/usr/bin/security", "find-certificate")
+	fake.Respond(runner.Result{ExitCode: 51}, errors.New("exit status 51"), "/usr/bin/security", "unlock-keychain")
+	defer codesign.SetCommandRunner(codesign.SetCommandRunner(fake))
+
+	assert.NoError(t, codesign.CreateKeychain("/tmp/test.keychain"))
+	assert.Error(t, codesign.UnlockKeychain("/tmp/test.keychain"))
+	assert.NoError(t, codesign.AddX509CertificateToKeychain("/tmp/test.keychain", "/tmp/cert.p12", "pwd"))
+	assert.True(t, codesign.KeychainHasCertificate("/tmp/test.keychain", "abcdef"))
+	assert.False(t, codesign.KeychainHasCertificate("/tmp/test.keychain", "012345"))
+
+	assert.Equal(t, []string{
+		"/usr/bin/security create-keychain -p random-pwd /tmp/test.keychain",
+		"/usr/bin/security unlock-keychain -p random-pwd /tmp/test.keychain",
+		"/usr/bin/security import /tmp/cert.p12 -k /tmp/test.keychain -P pwd -T /usr/bin/codesign",
+		"/usr/bin/security find-certificate -Z /tmp/test.keychain",
+		"/usr/bin/security find-certificate -Z /tmp/test.keychain",
+	}, fake.CommandLines())
+}
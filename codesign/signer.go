@@ -0,0 +1,82 @@
+package codesign
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+//Names of the available signing backends for NewSigner
+const (
+	//BackendCodesign uses /usr/bin/codesign and a keychain and therefore only works on macOS
+	BackendCodesign = "codesign"
+	//BackendNative writes signatures in Go with the key of the p12 file and works on any OS
+	BackendNative = "native"
+)
+
+//Signer signs the components of an app. The bundle walker in SignWithSigner calls SignFramework
+//for every .framework, innermost ones first, and SignBundle for every .app, .appex and .xctest
+//directory after the frameworks it contains are signed.
+type Signer interface {
+	SignFramework(frameworkPath string, config SigningConfig) error
+	SignBundle(bundlePath string, config SigningConfig) error
+}
+
+//NewSigner returns the Signer for the given backend name
+func NewSigner(backend string) (Signer, error) {
+	switch backend {
+	case BackendCodesign, "":
+		return CodesignSigner{}, nil
+	case BackendNative:
+		return NativeSigner{}, nil
+	}
+	return nil, fmt.Errorf("unknown signing backend '%s', use '%s' or '%s'", backend, BackendCodesign, BackendNative)
+}
+
+//CodesignSigner invokes /usr/bin/codesign with the certificate from the keychain in the SigningConfig.
+//The commands are run by the runner set with SetCommandRunner. --deep is never used, the walker signs nested
+//bundles first and every bundle needs its own entitlements. Loose Mach-O files like dylibs are signed one by one
+//before the bundle containing them.
+type CodesignSigner struct{}
+
+//SignFramework runs "codesign --force --sign" on the dylibs in the framework and then on the framework
+func (CodesignSigner) SignFramework(frameworkPath string, config SigningConfig) error {
+	err := signNestedMachOsWithCodesign(frameworkPath, config)
+	if err != nil {
+		return err
+	}
+	_, err = executeCodesignContext(config.signingContext(), "-vv", "--keychain", config.KeychainPath, "--force", "--sign", config.CertSha1, frameworkPath)
+	return err
+}
+
+//SignBundle runs "codesign --force --sign" on the dylibs in the bundle and then with the entitlements of the
+//SigningConfig on the bundle
+func (CodesignSigner) SignBundle(bundlePath string, config SigningConfig) error {
+	err := signNestedMachOsWithCodesign(bundlePath, config)
+	if err != nil {
+		return err
+	}
+	_, err = executeCodesignContext(config.signingContext(), "-vv", "--keychain", config.KeychainPath, "--force", "--sign", config.CertSha1, "--entitlements", config.EntitlementsFilePath, bundlePath)
+	return err
+}
+
+//signNestedMachOsWithCodesign signs the loose Mach-O files of the bundle without entitlements. Bundles without
+//CFBundleExecutable are assumed to follow the convention of naming the executable like the bundle.
+func signNestedMachOsWithCodesign(bundlePath string, config SigningConfig) error {
+	executable, err := getBundleExecutable(bundlePath)
+	if err != nil {
+		name := filepath.Base(bundlePath)
+		executable = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return signNestedMachOs(bundlePath, executable, func(file string) error {
+		_, err := executeCodesignContext(config.signingContext(), "-vv", "--keychain", config.KeychainPath, "--force", "--sign", config.CertSha1, file)
+		return err
+	})
+}
+
+//SignFileWithKeychain runs "codesign --force --sign" with the keychain certificate of the SigningConfig on
+//a single file. It is used to check that the keychain is usable before signing apps.
+func SignFileWithKeychain(filePath string, config SigningConfig) error {
+	_, err := executeCodesign("-vv", "--keychain", config.KeychainPath, "--force", "--sign", config.CertSha1, filePath)
+	return err
+}
@@ -0,0 +1,192 @@
+package codesign_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/danielpaulus/app-signer/codesign"
+	"github.com/danielpaulus/app-signer/runner"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"howett.net/plist"
+)
+
+func TestNewSigner(t *testing.T) {
+	signer, err := codesign.NewSigner(codesign.BackendCodesign)
+	assert.NoError(t, err)
+	assert.IsType(t, codesign.CodesignSigner{}, signer)
+
+	signer, err = codesign.NewSigner(codesign.BackendNative)
+	assert.NoError(t, err)
+	assert.IsType(t, codesign.NativeSigner{}, signer)
+
+	_, err = codesign.NewSigner("unknown")
+	assert.Error(t, err)
+}
+
+//TestNativeSigner signs the simulator fixture with an embedded framework using the native backend.
+func TestNativeSigner(t *testing.T) {
+	appdir, cleanup := extractSimulatorApp()
+	defer cleanup()
+	root := filepath.Dir(appdir)
+	payloadApp := path.Join(root, "Payload", "bla.app")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(payloadApp), 0755))
+	assert.NoError(t, os.Rename(appdir, payloadApp))
+
+	framework := path.Join(payloadApp, "Frameworks", "Test.framework")
+	assert.NoError(t, os.MkdirAll(framework, 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(framework, "Test"), readBytes(path.Join(payloadApp, "bla")), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(framework, "libNested.dylib"), readBytes(path.Join(payloadApp, "bla")), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(framework, "notes.txt"), []byte("no binary"), 0644))
+	frameworkInfo, _ := plist.Marshal(map[string]interface{}{"CFBundleIdentifier": "d.test", "CFBundleExecutable": "Test"}, plist.XMLFormat)
+	assert.NoError(t, ioutil.WriteFile(path.Join(framework, "Info.plist"), frameworkInfo, 0644))
+
+	entitlementsFile := path.Join(root, "entitlements.plist")
+	assert.NoError(t, ioutil.WriteFile(entitlementsFile, []byte(entitlementsFixture), 0644))
+	cert, key := makeSigningCertificate("Apple Development: Test (ABC)", "TEAMID1234")
+	config := codesign.SigningConfig{
+		EntitlementsFilePath: entitlementsFile,
+		ProfileBytes:         []byte("profile"),
+		SigningCert:          cert,
+		PrivateKey:           key,
+	}
+
+	err := codesign.SignWithSigner(root, config, codesign.NativeSigner{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, []byte("profile"), readBytes(path.Join(payloadApp, codesign.EmbeddedProfileName)))
+	frameworkSignature, err := codesign.ReadEmbeddedSignatures(path.Join(framework, "Test"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "d.test", frameworkSignature[0].CodeDirectories[0].Identifier)
+		assert.Nil(t, frameworkSignature[0].Entitlements)
+	}
+	dylibSignature, err := codesign.ReadEmbeddedSignatures(path.Join(framework, "libNested.dylib"))
+	if assert.NoError(t, err, "dylibs inside frameworks are signed too") {
+		assert.Equal(t, "libNested", dylibSignature[0].CodeDirectories[0].Identifier)
+	}
+	appSignature, err := codesign.ReadEmbeddedSignatures(path.Join(payloadApp, "bla"))
+	if assert.NoError(t, err) {
+		cd := appSignature[0].BestCodeDirectory()
+		assert.Equal(t, "TEAMID1234", cd.TeamID)
+		assert.Equal(t, entitlementsFixture, string(appSignature[0].Entitlements))
+		codeResources := readBytes(path.Join(payloadApp, codesign.CodeSignatureDir, codesign.CodeResourcesFile))
+		assert.Contains(t, string(codeResources), "Frameworks/Test.framework/_CodeSignature/CodeResources")
+	}
+}
+
+func TestCodesignSignerWithFakeRunner(t *testing.T) {
+	root, err := ioutil.TempDir("", "signer-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	app := path.Join(root, "Payload", "test.app")
+	assert.NoError(t, os.MkdirAll(path.Join(app, "Frameworks", "Outer.framework", "Frameworks", "Inner.framework"), 0755))
+	assert.NoError(t, os.MkdirAll(path.Join(app, "PlugIns", "ext.appex"), 0755))
+
+	fake := runner.NewFakeRunner()
+	defer codesign.SetCommandRunner(codesign.SetCommandRunner(fake))
+	config := codesign.SigningConfig{CertSha1: "ABCDEF", KeychainPath: "/tmp/test.keychain", EntitlementsFilePath: "/tmp/ent.plist", ProfileBytes: []byte("profile")}
+
+	err = codesign.Sign(root, config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	prefix := "/usr/bin/codesign -vv --keychain /tmp/test.keychain --force --sign ABCDEF "
+	assert.Equal(t, []string{
+		prefix + "--entitlements /tmp/ent.plist " + path.Join(app, "PlugIns", "ext.appex"),
+		prefix + path.Join(app, "Frameworks", "Outer.framework", "Frameworks", "Inner.framework"),
+		prefix + path.Join(app, "Frameworks", "Outer.framework"),
+		prefix + "--entitlements /tmp/ent.plist " + app,
+	}, fake.CommandLines())
+	assert.Equal(t, []byte("profile"), readBytes(path.Join(app, codesign.EmbeddedProfileName)))
+
+	assert.NoError(t, codesign.SignFileWithKeychain("/tmp/test.txt", config))
+	lines := fake.CommandLines()
+	assert.Equal(t, "/usr/bin/codesign -vv --keychain /tmp/test.keychain --force --sign ABCDEF /tmp/test.txt", lines[len(lines)-1])
+
+	fake.Respond(runner.Output("code object is not signed at all"), errors.New("exit status 1"), "/usr/bin/codesign")
+	assert.Error(t, codesign.Sign(root, config))
+}
+
+func TestCodesignSignerSignsNestedDylibs(t *testing.T) {
+	root, err := ioutil.TempDir("", "signer-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	app := path.Join(root, "Payload", "test.app")
+	framework := path.Join(app, "Frameworks", "Vendor.framework")
+	writeInfoPlist(t, app, map[string]interface{}{"CFBundleIdentifier": "com.acme.app", "CFBundleExecutable": "test"})
+	writeInfoPlist(t, framework, map[string]interface{}{"CFBundleIdentifier": "com.vendor", "CFBundleExecutable": "Vendor"})
+	machO := []byte{0xcf, 0xfa, 0xed, 0xfe, 0, 0, 0, 0}
+	for _, file := range []string{
+		path.Join(app, "test"),
+		path.Join(app, "Frameworks", "libfoo.dylib"),
+		path.Join(framework, "Vendor"),
+		path.Join(framework, "libbar.dylib"),
+	} {
+		assert.NoError(t, ioutil.WriteFile(file, machO, 0755))
+	}
+	assert.NoError(t, ioutil.WriteFile(path.Join(app, "Frameworks", "notes.txt"), []byte("no mach-o"), 0644))
+
+	fake := runner.NewFakeRunner()
+	defer codesign.SetCommandRunner(codesign.SetCommandRunner(fake))
+	config := codesign.SigningConfig{CertSha1: "ABCDEF", KeychainPath: "/tmp/test.keychain", EntitlementsFilePath: "/tmp/ent.plist"}
+	err = codesign.Sign(root, config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	prefix := "/usr/bin/codesign -vv --keychain /tmp/test.keychain --force --sign ABCDEF "
+	assert.Equal(t, []string{
+		prefix + path.Join(framework, "libbar.dylib"),
+		prefix + framework,
+		prefix + path.Join(app, "Frameworks", "libfoo.dylib"),
+		prefix + "--entitlements /tmp/ent.plist " + app,
+	}, fake.CommandLines())
+}
+
+func TestCodesignSignerUsesEntitlementsOfEachBundle(t *testing.T) {
+	root, err := ioutil.TempDir("", "signer-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	app := path.Join(root, "Payload", "main.app")
+	extension := path.Join(app, "PlugIns", "widget.appex")
+	watch := path.Join(app, "Watch", "watch.app")
+	writeInfoPlist(t, app, map[string]interface{}{"CFBundleIdentifier": "com.acme.app"})
+	writeInfoPlist(t, extension, map[string]interface{}{"CFBundleIdentifier": "com.acme.app.widget"})
+	writeInfoPlist(t, watch, map[string]interface{}{"CFBundleIdentifier": "com.acme.app.watch"})
+
+	fake := runner.NewFakeRunner()
+	defer codesign.SetCommandRunner(codesign.SetCommandRunner(fake))
+	configs := codesign.BundleConfigs{
+		"com.acme.app":        {CertSha1: "APP", KeychainPath: "/tmp/test.keychain", EntitlementsFilePath: "/tmp/app.plist"},
+		"com.acme.app.widget": {CertSha1: "WIDGET", KeychainPath: "/tmp/test.keychain", EntitlementsFilePath: "/tmp/widget.plist"},
+		"com.acme.app.watch":  {CertSha1: "WATCH", KeychainPath: "/tmp/test.keychain", EntitlementsFilePath: "/tmp/watch.plist"},
+	}
+	err = codesign.SignBundles(root, configs, codesign.CodesignSigner{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	lines := fake.CommandLines()
+	assert.ElementsMatch(t, []string{
+		"/usr/bin/codesign -vv --keychain /tmp/test.keychain --force --sign WIDGET --entitlements /tmp/widget.plist " + extension,
+		"/usr/bin/codesign -vv --keychain /tmp/test.keychain --force --sign WATCH --entitlements /tmp/watch.plist " + watch,
+		"/usr/bin/codesign -vv --keychain /tmp/test.keychain --force --sign APP --entitlements /tmp/app.plist " + app,
+	}, lines)
+	if assert.Len(t, lines, 3) {
+		assert.True(t, strings.HasSuffix(lines[2], " "+app), "the app is signed after its nested bundles")
+	}
+	for _, line := range lines {
+		assert.NotContains(t, line, "--deep")
+	}
+}
@@ -0,0 +1,480 @@
+package codesign
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"debug/macho"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/danielpaulus/app-signer/architecturecheck"
+	"howett.net/plist"
+)
+
+//VerifyOptions configures the native signature verification.
+//Certificate is the certificate the code must be signed with, if it is nil every signer with a valid
+//CMS signature is accepted. AllowAdhoc accepts ad-hoc signatures, which have no CMS signature at all.
+type VerifyOptions struct {
+	Certificate *x509.Certificate
+	AllowAdhoc  bool
+}
+
+//VerificationError describes why a signature is invalid. Path is the file that failed verification.
+//Architecture and Page are only set if the error concerns a specific slice or code page of a binary, Page is -1 otherwise.
+type VerificationError struct {
+	Path         string
+	Architecture string
+	Page         int
+	Reason       string
+}
+
+func (e *VerificationError) Error() string {
+	location := e.Path
+	if e.Architecture != "" {
+		location += fmt.Sprintf(" (%s)", e.Architecture)
+	}
+	if e.Page >= 0 {
+		location += fmt.Sprintf(" page %d", e.Page)
+	}
+	return location + ": " + e.Reason
+}
+
+func verificationError(path string, reason string, args ...interface{}) *VerificationError {
+	return &VerificationError{Path: path, Page: -1, Reason: fmt.Sprintf(reason, args...)}
+}
+
+//specialSlotNames are used in error messages for mismatching special slot hashes
+var specialSlotNames = map[int]string{
+	csSlotInfoPlist:       "Info.plist",
+	csSlotRequirements:    "requirements",
+	csSlotResourceDir:     "CodeResources",
+	csSlotEntitlements:    "entitlements",
+	csSlotDerEntitlements: "DER entitlements",
+}
+
+//VerifyApp verifies the signatures of all apps in the Payload directory below root,
+//including all nested bundles and binaries, without using the codesign command.
+func VerifyApp(root string, options VerifyOptions) error {
+	if !strings.HasSuffix(root, "Payload") {
+		root = path.Join(root, "Payload")
+	}
+	files, err := ioutil.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, file := range files {
+		if !file.IsDir() || !strings.HasSuffix(file.Name(), appSuffix) {
+			continue
+		}
+		found = true
+		err := VerifyBundle(path.Join(root, file.Name()), options)
+		if err != nil {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("no .app found in %s", root)
+	}
+	return nil
+}
+
+//VerifyBundle verifies the .app, .appex or .framework at bundlePath. It checks the main executable, recursively
+//all nested bundles and Mach-O files with the same options and the resource seal in _CodeSignature/CodeResources.
+//Failures are returned as *VerificationError naming the file that is broken.
+func VerifyBundle(bundlePath string, options VerifyOptions) error {
+	executable, err := getBundleExecutable(bundlePath)
+	if err != nil {
+		return verificationError(bundlePath, "bundle has no executable: %v", err)
+	}
+	infoPlistData, err := ioutil.ReadFile(path.Join(bundlePath, infoPlist))
+	if err != nil {
+		return verificationError(path.Join(bundlePath, infoPlist), "failed reading Info.plist: %v", err)
+	}
+	codeResourcesPath := path.Join(bundlePath, CodeSignatureDir, CodeResourcesFile)
+	codeResources, err := ioutil.ReadFile(codeResourcesPath)
+	if err != nil && !os.IsNotExist(err) {
+		return verificationError(codeResourcesPath, "failed reading: %v", err)
+	}
+	err = verifyMachO(path.Join(bundlePath, executable), options, infoPlistData, codeResources)
+	if err != nil {
+		return err
+	}
+	//nested code is checked explicitly, seals written without cdhash entries do not reference it
+	err = walkNestedCode(bundlePath, executable, func(nestedBundle string) error {
+		return VerifyBundle(nestedBundle, options)
+	}, func(machO string) error {
+		return VerifyMachO(machO, options)
+	})
+	if err != nil {
+		return err
+	}
+	if codeResources == nil {
+		return nil
+	}
+	return verifyResources(bundlePath, codeResources, options)
+}
+
+//VerifyMachO verifies the embedded signature of a standalone binary like a dylib.
+//All slices are checked: the page hashes of every CodeDirectory, the requirements and entitlements
+//special slots and the CMS signature.
+func VerifyMachO(binaryPath string, options VerifyOptions) error {
+	return verifyMachO(binaryPath, options, nil, nil)
+}
+
+func verifyMachO(binaryPath string, options VerifyOptions, infoPlist []byte, codeResources []byte) error {
+	data, err := ioutil.ReadFile(binaryPath)
+	if err != nil {
+		return verificationError(binaryPath, "failed reading: %v", err)
+	}
+	slices, err := splitMachO(data)
+	if err != nil {
+		return verificationError(binaryPath, "not a mach-o binary: %v", err)
+	}
+	for _, slice := range slices {
+		architecture := architecturecheck.Architecture{Cpu: macho.Cpu(slice.cpuType), SubCpu: slice.cpuSubtype}.String()
+		err := verifySlice(slice.data, options, infoPlist, codeResources)
+		if err != nil {
+			err.Path = binaryPath
+			err.Architecture = architecture
+			return err
+		}
+	}
+	return nil
+}
+
+func verifySlice(data []byte, options VerifyOptions, infoPlist []byte, codeResources []byte) *VerificationError {
+	m, err := parseMachOSlice(data)
+	if err != nil {
+		return verificationError("", "invalid mach-o: %v", err)
+	}
+	offset, size, ok := m.codeSignatureRange()
+	if !ok {
+		return verificationError("", "code object is not signed at all")
+	}
+	if uint64(offset)+uint64(size) > uint64(len(data)) {
+		return verificationError("", "code signature out of bounds")
+	}
+	signature, err := parseEmbeddedSignature(data[offset : offset+size])
+	if err != nil {
+		return verificationError("", "invalid code signature: %v", err)
+	}
+	specialData := map[int][]byte{
+		csSlotInfoPlist:       infoPlist,
+		csSlotRequirements:    signature.RawBlobs[csSlotRequirements],
+		csSlotResourceDir:     codeResources,
+		csSlotEntitlements:    signature.RawBlobs[csSlotEntitlements],
+		csSlotDerEntitlements: signature.RawBlobs[csSlotDerEntitlements],
+	}
+	for _, cd := range signature.CodeDirectories {
+		if cd.CodeLimit != uint64(offset) {
+			return verificationError("", "CodeDirectory code limit %d does not match signature offset %d", cd.CodeLimit, offset)
+		}
+		if verr := verifyCodeSlots(data[:offset], cd); verr != nil {
+			return verr
+		}
+		if verr := verifySpecialSlots(cd, specialData); verr != nil {
+			return verr
+		}
+	}
+	cd := signature.CodeDirectories[0]
+	if cd.Flags&csAdhoc != 0 {
+		if !options.AllowAdhoc {
+			return verificationError("", "code is ad-hoc signed")
+		}
+		return nil
+	}
+	signer, err := verifyCMSSignature(signature.CMSSignature, signature.CodeDirectories)
+	if err != nil {
+		return verificationError("", "invalid CMS signature: %v", err)
+	}
+	if options.Certificate != nil && !signer.Equal(options.Certificate) {
+		return verificationError("", "signed by '%s' instead of '%s'", signer.Subject.CommonName, options.Certificate.Subject.CommonName)
+	}
+	return nil
+}
+
+func verifyCodeSlots(code []byte, cd CodeDirectory) *VerificationError {
+	pageSize := cd.PageSize
+	if pageSize == 0 {
+		pageSize = len(code)
+	}
+	expectedPages := (len(code) + pageSize - 1) / pageSize
+	if len(cd.CodeSlots) != expectedPages {
+		return verificationError("", "CodeDirectory has %d code slots but the code has %d pages", len(cd.CodeSlots), expectedPages)
+	}
+	for i, slot := range cd.CodeSlots {
+		end := (i + 1) * pageSize
+		if end > len(code) {
+			end = len(code)
+		}
+		hash, ok := hashBytes(cd.HashType, code[i*pageSize:end])
+		if !ok {
+			return verificationError("", "unsupported hash type %d", cd.HashType)
+		}
+		if len(slot) > len(hash) || !bytes.Equal(hash[:len(slot)], slot) {
+			err := verificationError("", "page hash mismatch in %s CodeDirectory", hashTypeName(cd.HashType))
+			err.Page = i
+			return err
+		}
+	}
+	return nil
+}
+
+func verifySpecialSlots(cd CodeDirectory, specialData map[int][]byte) *VerificationError {
+	for slot, data := range specialData {
+		expected := cd.SpecialSlot(slot)
+		if expected == nil || isZero(expected) {
+			if data != nil && slot != csSlotInfoPlist && slot != csSlotResourceDir {
+				return verificationError("", "%s present but not bound to the CodeDirectory", specialSlotNames[slot])
+			}
+			continue
+		}
+		if data == nil {
+			return verificationError("", "%s is sealed in the CodeDirectory but missing", specialSlotNames[slot])
+		}
+		hash, ok := hashBytes(cd.HashType, data)
+		if !ok {
+			return verificationError("", "unsupported hash type %d", cd.HashType)
+		}
+		if len(expected) > len(hash) || !bytes.Equal(hash[:len(expected)], expected) {
+			return verificationError("", "%s hash does not match special slot -%d of the %s CodeDirectory", specialSlotNames[slot], slot, hashTypeName(cd.HashType))
+		}
+	}
+	return nil
+}
+
+//verifyCMSSignature checks the detached CMS signature over the first CodeDirectory and returns the signing certificate.
+//If the signed attributes contain the cdhashes of the alternate CodeDirectories, those are checked too.
+func verifyCMSSignature(cms []byte, codeDirectories []CodeDirectory) (*x509.Certificate, error) {
+	if len(cms) == 0 {
+		return nil, fmt.Errorf("signature is missing")
+	}
+	var contentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue `asn1:"explicit,tag:0"`
+	}
+	_, err := asn1.Unmarshal(cms, &contentInfo)
+	if err != nil {
+		return nil, err
+	}
+	if !contentInfo.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("content type is %v and not signed data", contentInfo.ContentType)
+	}
+	var signedData cmsSignedData
+	_, err = asn1.Unmarshal(contentInfo.Content.Bytes, &signedData)
+	if err != nil {
+		return nil, err
+	}
+	certificates, err := x509.ParseCertificates(signedData.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing certificates: %w", err)
+	}
+	if len(signedData.SignerInfos) != 1 {
+		return nil, fmt.Errorf("expected one signer but found %d", len(signedData.SignerInfos))
+	}
+	signerInfo := signedData.SignerInfos[0]
+	var signer *x509.Certificate
+	for _, cert := range certificates {
+		if bytes.Equal(cert.RawIssuer, signerInfo.Sid.Issuer.FullBytes) && cert.SerialNumber.Cmp(signerInfo.Sid.SerialNumber) == 0 {
+			signer = cert
+		}
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("certificate of the signer is not included")
+	}
+
+	attributes := []cmsAttribute{}
+	rest := signerInfo.SignedAttributes.Bytes
+	for len(rest) > 0 {
+		var attribute cmsAttribute
+		rest, err = asn1.Unmarshal(rest, &attribute)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing signed attributes: %w", err)
+		}
+		attributes = append(attributes, attribute)
+	}
+	var messageDigest []byte
+	if _, err := asn1.Unmarshal(findCMSAttribute(attributes, oidAttributeMessageDigest), &messageDigest); err != nil {
+		return nil, fmt.Errorf("message digest attribute missing")
+	}
+	var digest []byte
+	var algorithm x509.SignatureAlgorithm
+	switch {
+	case signerInfo.DigestAlgorithm.Algorithm.Equal(oidSHA256):
+		sum := sha256.Sum256(codeDirectories[0].Raw)
+		digest = sum[:]
+		algorithm = signatureAlgorithm(signer, x509.SHA256WithRSA, x509.ECDSAWithSHA256)
+	case signerInfo.DigestAlgorithm.Algorithm.Equal(oidSHA1):
+		sum := sha1.Sum(codeDirectories[0].Raw)
+		digest = sum[:]
+		algorithm = signatureAlgorithm(signer, x509.SHA1WithRSA, x509.ECDSAWithSHA1)
+	default:
+		return nil, fmt.Errorf("unsupported digest algorithm %v", signerInfo.DigestAlgorithm.Algorithm)
+	}
+	if algorithm == x509.UnknownSignatureAlgorithm {
+		return nil, fmt.Errorf("unsupported signer key type %v", signer.PublicKeyAlgorithm)
+	}
+	if !bytes.Equal(digest, messageDigest) {
+		return nil, fmt.Errorf("message digest does not match the CodeDirectory")
+	}
+	//the signature is calculated over the DER encoding of the attributes as SET OF, not the implicitly tagged field
+	toBeSigned := append([]byte{}, signerInfo.SignedAttributes.FullBytes...)
+	toBeSigned[0] = 0x31
+	err = signer.CheckSignature(algorithm, toBeSigned, signerInfo.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if cdhashesPlist := findCMSAttribute(attributes, oidAppleCDHashes); cdhashesPlist != nil {
+		if err := verifyCDHashesAttribute(cdhashesPlist, codeDirectories); err != nil {
+			return nil, err
+		}
+	}
+	return signer, nil
+}
+
+//signatureAlgorithm picks the RSA or ECDSA variant of the digest depending on the signer's key.
+//The algorithm in the signer info is not used, it is often just rsaEncryption.
+func signatureAlgorithm(signer *x509.Certificate, rsaAlgorithm x509.SignatureAlgorithm, ecdsaAlgorithm x509.SignatureAlgorithm) x509.SignatureAlgorithm {
+	switch signer.PublicKeyAlgorithm {
+	case x509.RSA:
+		return rsaAlgorithm
+	case x509.ECDSA:
+		return ecdsaAlgorithm
+	}
+	return x509.UnknownSignatureAlgorithm
+}
+
+func findCMSAttribute(attributes []cmsAttribute, oid asn1.ObjectIdentifier) []byte {
+	for _, attribute := range attributes {
+		if attribute.Type.Equal(oid) {
+			return attribute.Values.Bytes
+		}
+	}
+	return nil
+}
+
+func verifyCDHashesAttribute(attribute []byte, codeDirectories []CodeDirectory) error {
+	var encoded []byte
+	if _, err := asn1.Unmarshal(attribute, &encoded); err != nil {
+		return fmt.Errorf("invalid cdhashes attribute: %w", err)
+	}
+	var cdhashes struct {
+		CDHashes [][]byte `plist:"cdhashes"`
+	}
+	if _, err := plist.Unmarshal(encoded, &cdhashes); err != nil {
+		return fmt.Errorf("invalid cdhashes attribute: %w", err)
+	}
+	if len(cdhashes.CDHashes) != len(codeDirectories) {
+		return fmt.Errorf("signed attributes contain %d cdhashes for %d CodeDirectories", len(cdhashes.CDHashes), len(codeDirectories))
+	}
+	for i, cd := range codeDirectories {
+		cdhash := cd.CDHash()
+		if len(cdhash) < 20 || !bytes.Equal(cdhash[:20], cdhashes.CDHashes[i]) {
+			return fmt.Errorf("cdhash of the %s CodeDirectory is not signed", hashTypeName(cd.HashType))
+		}
+	}
+	return nil
+}
+
+//verifyResources compares the seal in CodeResources with the current contents of the bundle.
+//Nested code has to be verified before, only its cdhash is compared here.
+func verifyResources(bundlePath string, codeResources []byte, options VerifyOptions) error {
+	codeResourcesPath := path.Join(bundlePath, CodeSignatureDir, CodeResourcesFile)
+	var sealed struct {
+		Files2 map[string]interface{} `plist:"files2"`
+		Rules  map[string]interface{} `plist:"rules"`
+		Rules2 map[string]interface{} `plist:"rules2"`
+	}
+	_, err := plist.Unmarshal(codeResources, &sealed)
+	if err != nil {
+		return verificationError(codeResourcesPath, "invalid plist: %v", err)
+	}
+	actualResources, err := GenerateCodeResources(bundlePath, CodeResourcesOptions{
+		Rules:       parseResourceRules(sealed.Rules),
+		Rules2:      parseResourceRules(sealed.Rules2),
+		Certificate: options.Certificate,
+	})
+	if err != nil {
+		return verificationError(bundlePath, "failed hashing resources: %v", err)
+	}
+	var actual struct {
+		Files2 map[string]interface{} `plist:"files2"`
+	}
+	_, err = plist.Unmarshal(actualResources, &actual)
+	if err != nil {
+		return err
+	}
+	for relative, value := range sealed.Files2 {
+		entry, _ := value.(map[string]interface{})
+		actualEntry, ok := actual.Files2[relative].(map[string]interface{})
+		if !ok {
+			if optional, _ := entry["optional"].(bool); optional {
+				continue
+			}
+			return verificationError(path.Join(bundlePath, relative), "sealed resource is missing")
+		}
+		for _, key := range []string{"hash2", "symlink", "cdhash"} {
+			if fmt.Sprint(entry[key]) != fmt.Sprint(actualEntry[key]) {
+				return verificationError(path.Join(bundlePath, relative), "sealed resource was modified, %s does not match", key)
+			}
+		}
+	}
+	for relative := range actual.Files2 {
+		if _, ok := sealed.Files2[relative]; !ok {
+			return verificationError(path.Join(bundlePath, relative), "file added to the bundle after signing")
+		}
+	}
+	return nil
+}
+
+//parseResourceRules converts the rules dictionaries of a CodeResources file back into ResourceRules
+func parseResourceRules(rules map[string]interface{}) []ResourceRule {
+	result := []ResourceRule{}
+	for pattern, value := range rules {
+		rule := ResourceRule{Pattern: pattern}
+		if properties, ok := value.(map[string]interface{}); ok {
+			rule.Omit, _ = properties["omit"].(bool)
+			rule.Optional, _ = properties["optional"].(bool)
+			rule.Nested, _ = properties["nested"].(bool)
+			switch weight := properties["weight"].(type) {
+			case float64:
+				rule.Weight = weight
+			case uint64:
+				rule.Weight = float64(weight)
+			case int64:
+				rule.Weight = float64(weight)
+			}
+		}
+		result = append(result, rule)
+	}
+	//map order is random, sort to match rules of equal weight deterministically
+	sort.Slice(result, func(i, j int) bool { return result[i].Pattern < result[j].Pattern })
+	return result
+}
+
+func hashTypeName(hashType uint8) string {
+	switch hashType {
+	case csHashTypeSha1:
+		return "SHA-1"
+	case csHashTypeSha256:
+		return "SHA-256"
+	}
+	return fmt.Sprintf("hash type %d", hashType)
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
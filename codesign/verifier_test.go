@@ -0,0 +1,188 @@
+package codesign_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/app-signer/codesign"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyAdhocFixture(t *testing.T) {
+	appdir, cleanup := extractSimulatorApp()
+	defer cleanup()
+
+	assert.NoError(t, codesign.VerifyBundle(appdir, codesign.VerifyOptions{AllowAdhoc: true}))
+	err := codesign.VerifyBundle(appdir, codesign.VerifyOptions{})
+	assert.EqualError(t, err, path.Join(appdir, "bla")+" (x86_64): code is ad-hoc signed")
+}
+
+func TestVerifyNativelySignedApp(t *testing.T) {
+	root, app, cleanup := nativelySignedApp(t)
+	defer cleanup()
+	cert, _ := makeSigningCertificate("Apple Development: Test (ABC)", "TEAMID1234")
+
+	err := codesign.VerifyApp(root, codesign.VerifyOptions{})
+	assert.NoError(t, err)
+	err = codesign.VerifyApp(root, codesign.VerifyOptions{Certificate: cert})
+	assert.Contains(t, err.Error(), path.Join(app, "bla"))
+	assert.Contains(t, err.Error(), "signed by 'Apple Development: Test (ABC)'")
+}
+
+func TestVerifyECDSASignature(t *testing.T) {
+	appdir, cleanup := extractSimulatorApp()
+	defer cleanup()
+	binary := path.Join(appdir, "bla")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Apple Development: ECDSA (ABC)", OrganizationalUnit: []string{"TEAMID1234"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	err = codesign.SignMachO(binary, codesign.MachOSigningOptions{Identifier: "d.bla", Certificate: cert, PrivateKey: key})
+	if assert.NoError(t, err) {
+		assert.NoError(t, codesign.VerifyMachO(binary, codesign.VerifyOptions{Certificate: cert}))
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	root, app, cleanup := nativelySignedApp(t)
+	defer cleanup()
+	pkgInfo := path.Join(app, "PkgInfo")
+	assert.NoError(t, ioutil.WriteFile(pkgInfo, []byte("APPL????changed"), 0644))
+	assert.NoError(t, codesign.VerifyApp(root, codesign.VerifyOptions{}), "PkgInfo is omitted from the seal")
+
+	resource := path.Join(app, "Base.lproj", "LaunchScreen.storyboardc", "Info.plist")
+	original := readBytes(resource)
+	assert.NoError(t, ioutil.WriteFile(resource, []byte("changed"), 0644))
+	var verificationError *codesign.VerificationError
+	err := codesign.VerifyApp(root, codesign.VerifyOptions{})
+	if assert.True(t, errors.As(err, &verificationError)) {
+		assert.Equal(t, resource, verificationError.Path)
+		assert.Equal(t, -1, verificationError.Page)
+	}
+	assert.NoError(t, ioutil.WriteFile(resource, original, 0644))
+
+	added := path.Join(app, "added.txt")
+	assert.NoError(t, ioutil.WriteFile(added, []byte("added"), 0644))
+	err = codesign.VerifyApp(root, codesign.VerifyOptions{})
+	assert.EqualError(t, err, added+": file added to the bundle after signing")
+	assert.NoError(t, os.Remove(added))
+
+	binary := path.Join(app, "bla")
+	data := readBytes(binary)
+	data[0x4000+5*4096+17] ^= 0xff
+	assert.NoError(t, ioutil.WriteFile(binary, data, 0755))
+	err = codesign.VerifyApp(root, codesign.VerifyOptions{})
+	if assert.True(t, errors.As(err, &verificationError)) {
+		assert.Equal(t, binary, verificationError.Path)
+		assert.NotEmpty(t, verificationError.Architecture)
+		assert.Equal(t, 5, verificationError.Page)
+	}
+}
+
+func TestVerifyChecksNestedFrameworks(t *testing.T) {
+	appdir, cleanup := extractSimulatorApp()
+	defer cleanup()
+	root := filepath.Dir(appdir)
+	app := path.Join(root, "Payload", "bla.app")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(app), 0755))
+	assert.NoError(t, os.Rename(appdir, app))
+	framework := path.Join(app, "Frameworks", "Test.framework")
+	writeInfoPlist(t, framework, map[string]interface{}{"CFBundleIdentifier": "d.test", "CFBundleExecutable": "Test"})
+	frameworkBinary := path.Join(framework, "Test")
+	assert.NoError(t, ioutil.WriteFile(frameworkBinary, readBytes(path.Join(app, "bla")), 0755))
+	entitlementsFile := path.Join(root, "entitlements.plist")
+	assert.NoError(t, ioutil.WriteFile(entitlementsFile, []byte(entitlementsFixture), 0644))
+	cert, key := makeSigningCertificate("Apple Development: Test (ABC)", "TEAMID1234")
+	config := codesign.SigningConfig{EntitlementsFilePath: entitlementsFile, ProfileBytes: []byte("profile"), SigningCert: cert, PrivateKey: key}
+	if !assert.NoError(t, codesign.SignWithSigner(root, config, codesign.NativeSigner{})) {
+		return
+	}
+	assert.NoError(t, codesign.VerifyApp(root, codesign.VerifyOptions{Certificate: cert}))
+
+	data := readBytes(frameworkBinary)
+	data[0x4000+2*4096+17] ^= 0xff
+	assert.NoError(t, ioutil.WriteFile(frameworkBinary, data, 0755))
+	var verificationError *codesign.VerificationError
+	err := codesign.VerifyApp(root, codesign.VerifyOptions{Certificate: cert})
+	if assert.True(t, errors.As(err, &verificationError)) {
+		assert.Equal(t, frameworkBinary, verificationError.Path)
+		assert.Equal(t, 2, verificationError.Page, "the framework's own signature is checked, not only the seal")
+	}
+}
+
+func TestVerifyRejectsCorruptedCodeDirectory(t *testing.T) {
+	_, app, cleanup := nativelySignedApp(t)
+	defer cleanup()
+	binary := path.Join(app, "bla")
+	original := readBytes(binary)
+	codeDirectory := bytes.Index(original, []byte{0xfa, 0xde, 0x0c, 0x02})
+	if !assert.True(t, codeDirectory > 0) {
+		return
+	}
+	for name, corrupt := range map[string]func(data []byte){
+		"unknown hash type":  func(data []byte) { data[codeDirectory+37] = 4 },
+		"oversized hashSize": func(data []byte) { data[codeDirectory+36] = 0xff },
+	} {
+		data := append([]byte{}, original...)
+		corrupt(data)
+		assert.NoError(t, ioutil.WriteFile(binary, data, 0755))
+		var verificationError *codesign.VerificationError
+		err := codesign.VerifyMachO(binary, codesign.VerifyOptions{})
+		if assert.True(t, errors.As(err, &verificationError), name) {
+			assert.Equal(t, binary, verificationError.Path, name)
+		}
+	}
+}
+
+func TestVerifyDetectsChangedInfoPlist(t *testing.T) {
+	root, app, cleanup := nativelySignedApp(t)
+	defer cleanup()
+	infoPlist := path.Join(app, "Info.plist")
+	changed := bytes.Replace(readBytes(infoPlist), []byte("Default Configuration"), []byte("Changed Configuration"), 1)
+	assert.NoError(t, ioutil.WriteFile(infoPlist, changed, 0644))
+	err := codesign.VerifyApp(root, codesign.VerifyOptions{})
+	assert.Contains(t, err.Error(), "Info.plist hash does not match special slot -1")
+}
+
+//nativelySignedApp signs the simulator fixture app in a Payload folder with a generated certificate
+func nativelySignedApp(t *testing.T) (string, string, func()) {
+	appdir, cleanup := extractSimulatorApp()
+	root := filepath.Dir(appdir)
+	app := path.Join(root, "Payload", "bla.app")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(app), 0755))
+	assert.NoError(t, os.Rename(appdir, app))
+
+	entitlementsFile := path.Join(root, "entitlements.plist")
+	assert.NoError(t, ioutil.WriteFile(entitlementsFile, []byte(entitlementsFixture), 0644))
+	cert, key := makeSigningCertificate("Apple Development: Test (ABC)", "TEAMID1234")
+	config := codesign.SigningConfig{EntitlementsFilePath: entitlementsFile, ProfileBytes: []byte("profile"), SigningCert: cert, PrivateKey: key}
+	assert.NoError(t, codesign.SignWithSigner(root, config, codesign.NativeSigner{}))
+	return root, app, cleanup
+}
@@ -0,0 +1,376 @@
+//Package jobs runs long signing tasks asynchronously. Submitted tasks get an ID right away and are executed
+//by a fixed number of workers. Their state, logs and resulting artifact can be retrieved by ID until the
+//job expires.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//State of a job
+type State string
+
+//A job starts as StateQueued, is StateRunning while a worker executes it and ends
+//as StateSucceeded or StateFailed.
+const (
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+)
+
+//Defaults for Options
+const (
+	DefaultWorkers   = 2
+	DefaultQueueSize = 100
+	DefaultTTL       = time.Hour
+)
+
+var (
+	//ErrJobNotFound is returned for unknown or expired job IDs
+	ErrJobNotFound = errors.New("job not found")
+	//ErrQueueFull is returned by Submit if QueueSize jobs are already waiting
+	ErrQueueFull = errors.New("job queue is full")
+	//ErrNoArtifact is returned by Artifact for jobs that did not succeed (yet)
+	ErrNoArtifact = errors.New("job has no artifact")
+	//ErrQueueClosed is returned by Submit after Close was called
+	ErrQueueClosed = errors.New("job queue is closed")
+)
+
+//Task is the work done by a job. It must write its result to artifactPath and log to logger,
+//so the log can be retrieved with Queue.Logs. The context is cancelled when the queue is closed.
+type Task func(ctx context.Context, logger *log.Entry, artifactPath string) error
+
+//Options configures a Queue. Workers is the maximum number of jobs running at the same time,
+//QueueSize the maximum number of jobs waiting for a worker. Finished jobs are removed together with their
+//logs and artifacts TTL after they finished. Workdir is where job artifacts are stored, a temp dir is used if it is empty.
+type Options struct {
+	Workers   int
+	QueueSize int
+	TTL       time.Duration
+	Workdir   string
+}
+
+//Status is a snapshot of the state of a job. Err is the error the task returned for failed jobs.
+type Status struct {
+	ID         string     `json:"id"`
+	State      State      `json:"state"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Err        error      `json:"-"`
+}
+
+type job struct {
+	status  Status
+	task    Task
+	cleanup func()
+	dir     string
+	logs    *logBuffer
+}
+
+//Queue executes submitted tasks with a bounded number of workers. It is safe for concurrent use.
+type Queue struct {
+	options Options
+	mux     sync.Mutex
+	jobs    map[string]*job
+	pending chan *job
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+	closed  bool
+	ownDir  bool
+}
+
+//NewQueue creates a Queue and starts its workers and the cleanup of expired jobs.
+//Call Close to stop them and remove all job files.
+func NewQueue(options Options) (*Queue, error) {
+	if options.Workers <= 0 {
+		options.Workers = DefaultWorkers
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultQueueSize
+	}
+	if options.TTL <= 0 {
+		options.TTL = DefaultTTL
+	}
+	ownDir := false
+	if options.Workdir == "" {
+		dir, err := ioutil.TempDir("", "appsigner-jobs")
+		if err != nil {
+			return nil, err
+		}
+		options.Workdir = dir
+		ownDir = true
+	} else if err := os.MkdirAll(options.Workdir, 0755); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		options: options,
+		jobs:    map[string]*job{},
+		pending: make(chan *job, options.QueueSize),
+		ctx:     ctx,
+		cancel:  cancel,
+		ownDir:  ownDir,
+	}
+	for i := 0; i < options.Workers; i++ {
+		q.workers.Add(1)
+		go q.work()
+	}
+	go q.expireJobs()
+	return q, nil
+}
+
+//Submit queues the task and returns the ID of the new job.
+func (q *Queue) Submit(task Task) (string, error) {
+	return q.SubmitWithCleanup(task, nil)
+}
+
+//SubmitWithCleanup works like Submit, cleanup is called once the job finished, also if the queue was closed before
+//the task ran. It is not called if the job could not be queued.
+func (q *Queue) SubmitWithCleanup(task Task, cleanup func()) (string, error) {
+	id, err := newJobID()
+	if err != nil {
+		return "", err
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.closed {
+		return "", ErrQueueClosed
+	}
+	dir := path.Join(q.options.Workdir, id)
+	err = os.Mkdir(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	j := &job{
+		status:  Status{ID: id, State: StateQueued, CreatedAt: time.Now()},
+		task:    task,
+		cleanup: cleanup,
+		dir:     dir,
+		logs:    &logBuffer{},
+	}
+	select {
+	case q.pending <- j:
+	default:
+		os.RemoveAll(dir)
+		return "", ErrQueueFull
+	}
+	q.jobs[id] = j
+	log.WithFields(log.Fields{"job": id}).Info("job queued")
+	return id, nil
+}
+
+//Status returns the current state of the job
+func (q *Queue) Status(id string) (Status, error) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return Status{}, ErrJobNotFound
+	}
+	return j.status, nil
+}
+
+//List returns the status of all jobs that did not expire yet, oldest first
+func (q *Queue) List() []Status {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	result := make([]Status, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		result = append(result, j.status)
+	}
+	sort.Slice(result, func(i, k int) bool { return result[i].CreatedAt.Before(result[k].CreatedAt) })
+	return result
+}
+
+//Logs returns everything the task of the job logged so far
+func (q *Queue) Logs(id string) (string, error) {
+	q.mux.Lock()
+	j, ok := q.jobs[id]
+	q.mux.Unlock()
+	if !ok {
+		return "", ErrJobNotFound
+	}
+	return j.logs.String(), nil
+}
+
+//Artifact returns the path of the file the task of a succeeded job created.
+//The file is deleted when the job expires.
+func (q *Queue) Artifact(id string) (string, error) {
+	status, err := q.Status(id)
+	if err != nil {
+		return "", err
+	}
+	if status.State != StateSucceeded {
+		return "", fmt.Errorf("%w: job %s is %s", ErrNoArtifact, id, status.State)
+	}
+	return q.artifactPath(id), nil
+}
+
+//Close stops accepting jobs, cancels running tasks, waits for the workers to stop and removes all job files.
+func (q *Queue) Close() {
+	q.mux.Lock()
+	if q.closed {
+		q.mux.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.pending)
+	q.mux.Unlock()
+	q.cancel()
+	q.workers.Wait()
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for id, j := range q.jobs {
+		os.RemoveAll(j.dir)
+		delete(q.jobs, id)
+	}
+	if q.ownDir {
+		os.RemoveAll(q.options.Workdir)
+	}
+}
+
+func (q *Queue) artifactPath(id string) string {
+	return path.Join(q.options.Workdir, id, "artifact")
+}
+
+func (q *Queue) work() {
+	defer q.workers.Done()
+	for j := range q.pending {
+		if q.ctx.Err() != nil {
+			q.finish(j, q.ctx.Err())
+			continue
+		}
+		q.mux.Lock()
+		now := time.Now()
+		j.status.State = StateRunning
+		j.status.StartedAt = &now
+		q.mux.Unlock()
+
+		logger := newJobLogger(j.logs)
+		entry := logger.WithField("job", j.status.ID)
+		entry.Info("job started")
+		err := runTask(q.ctx, j.task, entry, q.artifactPath(j.status.ID))
+		if err != nil {
+			entry.WithFields(log.Fields{"err": err}).Error("job failed")
+		} else {
+			entry.Info("job succeeded")
+		}
+		q.finish(j, err)
+	}
+}
+
+//newJobLogger creates a logger that writes to the job's log and the output of the standard logger,
+//with the formatter and level of the standard logger
+func newJobLogger(logs io.Writer) *log.Logger {
+	standard := log.StandardLogger()
+	logger := log.New()
+	logger.SetOutput(io.MultiWriter(logs, standard.Out))
+	logger.SetFormatter(standard.Formatter)
+	logger.SetLevel(standard.GetLevel())
+	return logger
+}
+
+//runTask executes the task and turns panics into errors, so a broken task does not stop the worker.
+func runTask(ctx context.Context, task Task, logger *log.Entry, artifactPath string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("task panicked: %v", r)
+		}
+	}()
+	return task(ctx, logger, artifactPath)
+}
+
+func (q *Queue) finish(j *job, err error) {
+	if j.cleanup != nil {
+		j.cleanup()
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	now := time.Now()
+	expires := now.Add(q.options.TTL)
+	j.status.FinishedAt = &now
+	j.status.ExpiresAt = &expires
+	j.status.State = StateSucceeded
+	if err != nil {
+		j.status.State = StateFailed
+		j.status.Err = err
+		j.status.Error = err.Error()
+	}
+	j.task = nil
+	j.cleanup = nil
+}
+
+func (q *Queue) expireJobs() {
+	interval := q.options.TTL / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case now := <-ticker.C:
+			q.removeExpired(now)
+		}
+	}
+}
+
+func (q *Queue) removeExpired(now time.Time) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for id, j := range q.jobs {
+		if j.status.ExpiresAt != nil && now.After(*j.status.ExpiresAt) {
+			os.RemoveAll(j.dir)
+			delete(q.jobs, id)
+			log.WithFields(log.Fields{"job": id}).Debug("job expired")
+		}
+	}
+}
+
+func newJobID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+type logBuffer struct {
+	mux    sync.Mutex
+	buffer []byte
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.buffer = append(b.buffer, p...)
+	return len(p), nil
+}
+
+func (b *logBuffer) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return string(b.buffer)
+}
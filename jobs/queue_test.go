@@ -0,0 +1,210 @@
+package jobs_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/app-signer/jobs"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobSucceeds(t *testing.T) {
+	queue, err := jobs.NewQueue(jobs.Options{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer queue.Close()
+
+	id, err := queue.Submit(func(ctx context.Context, logger *log.Entry, artifactPath string) error {
+		logger.Info("writing artifact")
+		return ioutil.WriteFile(artifactPath, []byte("signed"), 0644)
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	status := waitForJob(t, queue, id)
+	assert.Equal(t, jobs.StateSucceeded, status.State)
+	assert.NotNil(t, status.StartedAt)
+	assert.NotNil(t, status.ExpiresAt)
+	assert.Empty(t, status.Error)
+
+	artifact, err := queue.Artifact(id)
+	if assert.NoError(t, err) {
+		content, _ := ioutil.ReadFile(artifact)
+		assert.Equal(t, "signed", string(content))
+	}
+	logs, err := queue.Logs(id)
+	assert.NoError(t, err)
+	assert.Contains(t, logs, "writing artifact")
+	assert.Contains(t, logs, "job="+id)
+}
+
+func TestJobLogUsesStandardFormatter(t *testing.T) {
+	defer log.SetFormatter(log.StandardLogger().Formatter)
+	log.SetFormatter(&log.JSONFormatter{})
+	queue, err := jobs.NewQueue(jobs.Options{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer queue.Close()
+
+	id, err := queue.Submit(func(ctx context.Context, logger *log.Entry, artifactPath string) error {
+		logger.Info("formatted")
+		return nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	waitForJob(t, queue, id)
+	logs, err := queue.Logs(id)
+	assert.NoError(t, err)
+	assert.Contains(t, logs, `"job":"`+id+`"`)
+}
+
+func TestCloseCancelsRunningJobs(t *testing.T) {
+	queue, err := jobs.NewQueue(jobs.Options{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	_, err = queue.Submit(func(ctx context.Context, logger *log.Entry, artifactPath string) error {
+		close(started)
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return ctx.Err()
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	<-started
+	queue.Close()
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+}
+
+func TestCloseCleansUpQueuedJobs(t *testing.T) {
+	queue, err := jobs.NewQueue(jobs.Options{Workers: 1})
+	if err != nil {
+		log.Fatal(err)
+	}
+	upload, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(upload)
+	started := make(chan struct{})
+	_, err = queue.Submit(func(ctx context.Context, logger *log.Entry, artifactPath string) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.NoError(t, err)
+	ran := false
+	_, err = queue.SubmitWithCleanup(func(ctx context.Context, logger *log.Entry, artifactPath string) error {
+		ran = true
+		return nil
+	}, func() { os.RemoveAll(upload) })
+	assert.NoError(t, err)
+	<-started
+	queue.Close()
+	assert.False(t, ran, "the queued job never started")
+	_, err = os.Stat(upload)
+	assert.True(t, os.IsNotExist(err), "the upload of the queued job is removed")
+}
+
+func TestJobFails(t *testing.T) {
+	queue, err := jobs.NewQueue(jobs.Options{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer queue.Close()
+	taskError := errors.New("broken ipa")
+
+	id, _ := queue.Submit(func(ctx context.Context, logger *log.Entry, artifactPath string) error {
+		return taskError
+	})
+	panicking, _ := queue.Submit(func(ctx context.Context, logger *log.Entry, artifactPath string) error {
+		panic("oops")
+	})
+
+	status := waitForJob(t, queue, id)
+	assert.Equal(t, jobs.StateFailed, status.State)
+	assert.Equal(t, "broken ipa", status.Error)
+	assert.True(t, errors.Is(status.Err, taskError))
+	_, err = queue.Artifact(id)
+	assert.True(t, errors.Is(err, jobs.ErrNoArtifact))
+
+	status = waitForJob(t, queue, panicking)
+	assert.Equal(t, jobs.StateFailed, status.State)
+	assert.Contains(t, status.Error, "oops")
+}
+
+func TestWorkerLimitAndQueueSize(t *testing.T) {
+	queue, err := jobs.NewQueue(jobs.Options{Workers: 1, QueueSize: 1})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer queue.Close()
+	release := make(chan struct{})
+	blocking := func(ctx context.Context, logger *log.Entry, artifactPath string) error {
+		<-release
+		return nil
+	}
+
+	first, _ := queue.Submit(blocking)
+	assert.Eventually(t, func() bool {
+		status, _ := queue.Status(first)
+		return status.State == jobs.StateRunning
+	}, time.Second, time.Millisecond)
+	second, err := queue.Submit(blocking)
+	assert.NoError(t, err)
+	_, err = queue.Submit(blocking)
+	assert.True(t, errors.Is(err, jobs.ErrQueueFull))
+
+	status, _ := queue.Status(second)
+	assert.Equal(t, jobs.StateQueued, status.State)
+	assert.Len(t, queue.List(), 2)
+	close(release)
+	assert.Equal(t, jobs.StateSucceeded, waitForJob(t, queue, second).State)
+}
+
+func TestJobsExpire(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "jobs-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+	queue, err := jobs.NewQueue(jobs.Options{TTL: 50 * time.Millisecond, Workdir: workdir})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer queue.Close()
+
+	id, _ := queue.Submit(func(ctx context.Context, logger *log.Entry, artifactPath string) error {
+		return ioutil.WriteFile(artifactPath, []byte("signed"), 0644)
+	})
+	waitForJob(t, queue, id)
+	artifact, _ := queue.Artifact(id)
+	assert.Eventually(t, func() bool {
+		_, err := queue.Status(id)
+		return errors.Is(err, jobs.ErrJobNotFound)
+	}, 2*time.Second, 10*time.Millisecond)
+	_, err = os.Stat(artifact)
+	assert.True(t, os.IsNotExist(err))
+	_, err = queue.Logs(id)
+	assert.True(t, errors.Is(err, jobs.ErrJobNotFound))
+}
+
+func waitForJob(t *testing.T, queue *jobs.Queue, id string) jobs.Status {
+	var status jobs.Status
+	assert.Eventually(t, func() bool {
+		status, _ = queue.Status(id)
+		return status.State == jobs.StateSucceeded || status.State == jobs.StateFailed
+	}, 5*time.Second, time.Millisecond)
+	return status
+}
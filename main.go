@@ -1,13 +1,25 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/danielpaulus/app-signer/api"
-	"github.com/danielpaulus/app-signer/architecturecheck"
+	"github.com/danielpaulus/app-signer/codesign"
+	"github.com/danielpaulus/app-signer/jobs"
+	"github.com/danielpaulus/app-signer/server"
 	"github.com/docopt/docopt-go"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 )
 
 func main() {
@@ -15,37 +27,423 @@ func main() {
 	usage := fmt.Sprintf(`sign %s
 
 Usage:
-  sign --udid=<udid> --p12password=<p12password> --profilespath=<profilespath> --ipa=<ipa> --output=<output> [options]
+  sign (--udid=<udid>... | --udidfile=<udidfile>) [--p12password=<p12password>] --profilespath=<profilespath> --ipa=<ipa> --output=<output> [--bundleid=<bundleid>] [--entitlements=<mode>] [--expirywarning=<days>] [--strictexpiry] [options]
+  sign verify --ipa=<ipa> [--adhoc] [options]
+  sign entitlements --udid=<udid> [--p12password=<p12password>] --profilespath=<profilespath> --ipa=<ipa> [--json] [options]
+  sign profiles list --profilespath=<profilespath> [--json] [--expirywarning=<days>] [options]
+  sign devices --profilespath=<profilespath> [--udidfile=<udidfile>] [--json] [--expirywarning=<days>] [<udid>...] [options]
+  sign serve [--p12password=<p12password>] --profilespath=<profilespath> [--address=<address>] [--workers=<workers>] [--jobttl=<jobttl>] [--expirywarning=<days>] [--strictexpiry] [options]
 
 Options:
+  --profilespath=<profilespath>  Directory with profiles and their certificates, several directories are separated by ':'.
+                         Subdirectories are searched too, 'installed' adds the profiles installed by Xcode.
+                         Certificates are .p12 files or .pem files with an optional .key and are paired with the
+                         profiles by fingerprint, so file names do not matter.
+  --p12password=<p12password>  Password of all p12 files that have no password of their own.
+  --p12passwords=<file>  JSON file mapping profile UUIDs, names or file names to the passwords of their p12 files.
+                         Defaults to p12passwords.json in the profiles path. A <name>.p12password file next to a
+                         profile or a SIGN_P12PASSWORD_<UUID or NAME> environment variable take precedence.
+  --profileroots=<file>  PEM file with root certificates trusted to sign profiles in addition to Apple's.
+  --skipprofileverification  Use profiles without checking that they are signed by Apple.
+  --backend=<backend>  Signing backend, 'codesign' needs macOS and a keychain, 'native' works everywhere [default: codesign].
+  --bundleid=<bundleid>  New bundle identifier of the app, nested extensions, watch apps and tests keep their suffix.
+  --entitlements=<mode>  'profile' signs with all entitlements of the profile, 'merge' keeps the entitlements of each binary
+                         that its profile grants [default: profile].
+  --expirywarning=<days>  Warn if the profile or certificate used for signing expires within this many days [default: 14].
+  --strictexpiry       Fail instead of warning if the profile or certificate expires within the warning period.
+  --adhoc              Accept ad-hoc signatures when verifying.
+  --json               Print the entitlements report, profile list or device coverage as JSON instead of text.
+  --udidfile=<udidfile>  File with one device UDID per line, the device list export of the developer portal works too.
+                         When signing for more than one device, --output is a directory.
+  --address=<address>  Address the signing service listens on [default: :8080].
+  --workers=<workers>  Number of signing jobs the service runs in parallel [default: 2].
+  --jobttl=<jobttl>    How long finished jobs and their signed ipas are kept [default: 1h].
   -v --verbose   Enable Debug Logging.
   -t --trace     Enable Trace Logging (dump every message).
   --nojson       Disable JSON output (default).
   -h --help      Show this screen.
 
 The commands work as following:
+  sign verify      Checks all code signatures of the ipa, .app or Payload directory without using codesign.
+                   Exits with 1 and prints the broken file or page if the signature is invalid.
+  sign entitlements  Compares the entitlements of the app and its extensions with the profiles they would be
+                   signed with for the device. Exits with 1 if a profile misses or changes entitlements the app uses.
+  sign profiles list  Prints name, UUID, team, App ID, platform, type, dates, device count and certificate SHA-1
+                   of every profile in the directory. Exits with 1 if a profile expired or expires within the
+                   warning period. Does not need the p12 files.
+  sign devices     Lists the profiles containing each of the given devices, with App ID and expiry date.
+                   Exits with 1 if any device is not covered by a profile that is still valid.
+  sign serve       Prepares the profiles and keychain once and starts a HTTP signing service.
+                   POST an ipa as multipart form field 'ipa' together with a 'udid' field to /sign
+                   to get the signed ipa back. An optional 'bundleid' field changes the bundle identifier,
+                   'entitlements' selects the entitlements mode.
+                   Errors are returned as JSON.
+                   POST to /jobs instead to sign in the background, then poll /jobs/<id> and
+                   download /jobs/<id>/artifact once the job succeeded.
   `, version)
 	arguments, err := docopt.ParseDoc(usage)
 	log.WithFields(log.Fields{"args": os.Args}).Infof("starting iOS appsigner")
-	udid, _ := arguments.String("--udid")
+	verify, _ := arguments.Bool("verify")
+	if verify {
+		ipaFile, _ := arguments.String("--ipa")
+		adhoc, _ := arguments.Bool("--adhoc")
+		err := api.VerifyIPA(ipaFile, codesign.VerifyOptions{AllowAdhoc: adhoc})
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		log.Infof("valid signature: %s", ipaFile)
+		return
+	}
+	entitlements, _ := arguments.Bool("entitlements")
+	if entitlements {
+		compatible, err := printEntitlementsReport(arguments)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		if !compatible {
+			os.Exit(1)
+		}
+		return
+	}
+	profiles, _ := arguments.Bool("profiles")
+	if profiles {
+		valid, err := printProfiles(arguments)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		if !valid {
+			os.Exit(1)
+		}
+		return
+	}
+	devices, _ := arguments.Bool("devices")
+	if devices {
+		covered, err := printDeviceCoverage(arguments)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		if !covered {
+			os.Exit(1)
+		}
+		return
+	}
+	serve, _ := arguments.Bool("serve")
+	if serve {
+		err := runServer(arguments)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		return
+	}
+	udids, err := udidsFromArguments(arguments, "--udid")
+	if err != nil {
+		log.Error(err)
+		return
+	}
 	profilePassword, _ := arguments.String("--p12password")
+	passwordManifest, _ := arguments.String("--p12passwords")
+	profileRoots, _ := arguments.String("--profileroots")
+	skipProfileVerification, _ := arguments.Bool("--skipprofileverification")
 	profilespath, _ := arguments.String("--profilespath")
 	outputFileName, _ := arguments.String("--output")
 	ipaFile, _ := arguments.String("--ipa")
-
-	err = architecturecheck.CheckLipo()
+	backend, _ := arguments.String("--backend")
+	bundleID, _ := arguments.String("--bundleid")
+	entitlementsMode, _ := arguments.String("--entitlements")
+	expiryWarning, strictExpiry, err := expiryOptions(arguments)
 	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Error("lipo is not installed, make sure xcode is installed or add lipo to /usr/bin")
+		log.Error(err)
 		return
 	}
+
 	workdir, err := ioutil.TempDir("", "pattern")
 	defer os.RemoveAll(workdir)
-	s, err := api.PrepareSigningWorkspace(workdir, profilePassword, profilespath)
-	defer s.Close()
-	_, err = api.ResignIPA(s, udid, ipaFile, outputFileName)
+	s, err := api.PrepareSigningWorkspaceWithOptions(workdir, profilePassword, profilespath, api.WorkspaceOptions{Backend: backend, PasswordManifest: passwordManifest, ProfileRoots: profileRoots, SkipProfileVerification: skipProfileVerification})
 	if err != nil {
 		log.Error(err)
 		return
 	}
-	log.Infof("resigned:")
+	defer s.Close()
+	options := api.ResignOptions{BundleID: bundleID, Entitlements: entitlementsMode, ExpiryWarning: expiryWarning, StrictExpiry: strictExpiry}
+	if len(udids) == 1 {
+		_, err = api.ResignIPAWithOptions(s, udids[0], ipaFile, outputFileName, options)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		log.Infof("resigned:")
+		return
+	}
+	err = resignForDevices(s, udids, ipaFile, outputFileName, options)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+//resignForDevices signs the ipa for many devices into outputDir and writes the device to ipa mapping
+//to devices.json in the same directory.
+func resignForDevices(s api.SigningWorkspace, udids []string, ipaFile string, outputDir string, options api.ResignOptions) error {
+	result, err := api.ResignIPAForDevices(s, udids, ipaFile, outputDir, options)
+	if err != nil {
+		return err
+	}
+	mapping, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path.Join(outputDir, "devices.json"), mapping, 0644)
+	if err != nil {
+		return err
+	}
+	for _, output := range result.Outputs {
+		log.WithFields(log.Fields{"profile": output.Profile, "udids": output.UDIDs}).Infof("resigned: %s", output.OutputPath)
+	}
+	return nil
+}
+
+//printEntitlementsReport prints the entitlements report for the ipa and returns false if any bundle uses
+//entitlements its profile does not grant.
+func printEntitlementsReport(arguments docopt.Opts) (bool, error) {
+	//--udid is repeatable in the sign command, so docopt always returns a list
+	udids, _ := arguments["--udid"].([]string)
+	if len(udids) != 1 {
+		return false, fmt.Errorf("pass exactly one --udid")
+	}
+	udid := udids[0]
+	profilePassword, _ := arguments.String("--p12password")
+	passwordManifest, _ := arguments.String("--p12passwords")
+	profileRoots, _ := arguments.String("--profileroots")
+	skipProfileVerification, _ := arguments.Bool("--skipprofileverification")
+	profilespath, _ := arguments.String("--profilespath")
+	ipaFile, _ := arguments.String("--ipa")
+	printJSON, _ := arguments.Bool("--json")
+
+	workdir, err := ioutil.TempDir("", "appsigner-entitlements")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(workdir)
+	s, err := api.NewSigningWorkspaceWithOptions(workdir, profilePassword, api.WorkspaceOptions{PasswordManifest: passwordManifest, ProfileRoots: profileRoots, SkipProfileVerification: skipProfileVerification})
+	if err != nil {
+		return false, err
+	}
+	err = s.PrepareProfiles(profilespath)
+	if err != nil {
+		return false, err
+	}
+	report, err := api.EntitlementsReport(s, udid, ipaFile)
+	if err != nil {
+		return false, err
+	}
+	compatible := true
+	for _, diff := range report {
+		compatible = compatible && diff.Compatible()
+	}
+	if printJSON {
+		output, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return false, err
+		}
+		fmt.Println(string(output))
+		return compatible, nil
+	}
+	for _, diff := range report {
+		fmt.Print(diff.String())
+	}
+	return compatible, nil
+}
+
+//printProfiles prints the profiles as table or JSON and returns false if any of them expired or expires soon.
+func printProfiles(arguments docopt.Opts) (bool, error) {
+	profilespath, _ := arguments.String("--profilespath")
+	printJSON, _ := arguments.Bool("--json")
+	expiryWarning, _, err := expiryOptions(arguments)
+	if err != nil {
+		return false, err
+	}
+	trust, err := profileTrust(arguments)
+	if err != nil {
+		return false, err
+	}
+	profiles, err := codesign.ListProfiles(profilespath, trust, time.Now(), expiryWarning)
+	if err != nil {
+		return false, err
+	}
+	valid := true
+	for _, profile := range profiles {
+		valid = valid && profile.Status == codesign.ProfileStatusValid
+	}
+	if printJSON {
+		output, err := json.MarshalIndent(profiles, "", "  ")
+		if err != nil {
+			return false, err
+		}
+		fmt.Println(string(output))
+		return valid, nil
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tUUID\tTEAM\tAPP ID\tPLATFORM\tTYPE\tCREATED\tEXPIRES\tDEVICES\tCERTIFICATE SHA-1\tSTATUS")
+	for _, profile := range profiles {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", profile.Name, profile.UUID, profile.TeamID, profile.AppID,
+			strings.Join(profile.Platform, ","), profile.Type, profile.CreationDate.Format("2006-01-02"), profile.ExpirationDate.Format("2006-01-02"),
+			profile.DeviceCount, strings.Join(profile.CertificateSha1, ","), profile.Status)
+	}
+	return valid, table.Flush()
+}
+
+//printDeviceCoverage prints which profiles cover the devices and returns false if any device is not covered.
+func printDeviceCoverage(arguments docopt.Opts) (bool, error) {
+	profilespath, _ := arguments.String("--profilespath")
+	printJSON, _ := arguments.Bool("--json")
+	expiryWarning, _, err := expiryOptions(arguments)
+	if err != nil {
+		return false, err
+	}
+	udids, err := udidsFromArguments(arguments, "<udid>")
+	if err != nil {
+		return false, err
+	}
+	if len(udids) == 0 {
+		return false, fmt.Errorf("no devices given, pass udids as arguments or with --udidfile")
+	}
+	trust, err := profileTrust(arguments)
+	if err != nil {
+		return false, err
+	}
+	profiles, err := codesign.ReadProfiles(profilespath, trust)
+	if err != nil {
+		return false, err
+	}
+	report := codesign.CheckCoverage(udids, profiles, time.Now(), expiryWarning)
+	if printJSON {
+		output, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return false, err
+		}
+		fmt.Println(string(output))
+		return len(report.Uncovered) == 0, nil
+	}
+	for _, device := range report.Devices {
+		fmt.Printf("%s: %d profiles\n", device.UDID, len(device.Profiles))
+		for _, profile := range device.Profiles {
+			fmt.Printf("  %s (%s) %s expires %s %s\n", profile.Name, profile.UUID, profile.AppID, profile.ExpirationDate.Format("2006-01-02"), profile.Status)
+		}
+	}
+	if len(report.Uncovered) > 0 {
+		fmt.Printf("%d of %d devices are not covered:\n", len(report.Uncovered), len(report.Devices))
+		for _, udid := range report.Uncovered {
+			fmt.Println("  " + udid)
+		}
+	}
+	return len(report.Uncovered) == 0, nil
+}
+
+//udidsFromArguments returns the udids passed with the repeatable argument key and the ones in --udidfile
+func udidsFromArguments(arguments docopt.Opts, key string) ([]string, error) {
+	udids, _ := arguments[key].([]string)
+	udidFile, _ := arguments.String("--udidfile")
+	if udidFile == "" {
+		return udids, nil
+	}
+	file, err := os.Open(udidFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fromFile, err := codesign.ReadUDIDs(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %s: %w", udidFile, err)
+	}
+	return append(udids, fromFile...), nil
+}
+
+//profileTrust creates the trust for checking profile signatures from --profileroots and --skipprofileverification
+func profileTrust(arguments docopt.Opts) (codesign.ProfileTrust, error) {
+	profileRoots, _ := arguments.String("--profileroots")
+	skipProfileVerification, _ := arguments.Bool("--skipprofileverification")
+	trust, err := codesign.LoadProfileTrust(profileRoots)
+	if err != nil {
+		return codesign.ProfileTrust{}, err
+	}
+	trust.Skip = skipProfileVerification
+	return trust, nil
+}
+
+//expiryOptions parses --expirywarning and --strictexpiry
+func expiryOptions(arguments docopt.Opts) (time.Duration, bool, error) {
+	daysArg, _ := arguments.String("--expirywarning")
+	strict, _ := arguments.Bool("--strictexpiry")
+	days, err := strconv.Atoi(daysArg)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid --expirywarning '%s': %w", daysArg, err)
+	}
+	if days == 0 {
+		//zero means the default in api.ResignOptions
+		return -1, strict, nil
+	}
+	return time.Duration(days) * 24 * time.Hour, strict, nil
+}
+
+//runServer prepares the workspace and serves signing requests until SIGINT or SIGTERM is received.
+//The keychain is removed from the search list again on shutdown.
+func runServer(arguments docopt.Opts) error {
+	profilePassword, _ := arguments.String("--p12password")
+	passwordManifest, _ := arguments.String("--p12passwords")
+	profileRoots, _ := arguments.String("--profileroots")
+	skipProfileVerification, _ := arguments.Bool("--skipprofileverification")
+	profilespath, _ := arguments.String("--profilespath")
+	backend, _ := arguments.String("--backend")
+	address, _ := arguments.String("--address")
+	workersArg, _ := arguments.String("--workers")
+	jobTTLArg, _ := arguments.String("--jobttl")
+	workers, err := strconv.Atoi(workersArg)
+	if err != nil {
+		return fmt.Errorf("invalid --workers '%s': %w", workersArg, err)
+	}
+	jobTTL, err := time.ParseDuration(jobTTLArg)
+	if err != nil {
+		return fmt.Errorf("invalid --jobttl '%s': %w", jobTTLArg, err)
+	}
+	expiryWarning, strictExpiry, err := expiryOptions(arguments)
+	if err != nil {
+		return err
+	}
+
+	workdir, err := ioutil.TempDir("", "appsigner-server")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workdir)
+	s, err := api.PrepareSigningWorkspaceWithOptions(path.Join(workdir, "workspace"), profilePassword, profilespath, api.WorkspaceOptions{Backend: backend, PasswordManifest: passwordManifest, ProfileRoots: profileRoots, SkipProfileVerification: skipProfileVerification})
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	queue, err := jobs.NewQueue(jobs.Options{Workers: workers, TTL: jobTTL, Workdir: path.Join(workdir, "jobs")})
+	if err != nil {
+		return err
+	}
+	defer queue.Close()
+
+	httpServer := &http.Server{Addr: address, Handler: server.NewServer(s, server.Options{Workdir: workdir, Jobs: queue, ExpiryWarning: expiryWarning, StrictExpiry: strictExpiry})}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-stop
+		log.Info("shutting down signing service")
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		httpServer.Shutdown(ctx)
+	}()
+	log.Infof("signing service listening on %s", address)
+	err = httpServer.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,129 @@
+package runner
+
+import (
+	"context"
+	"sync"
+)
+
+//FakeRunner records all commands it gets and answers them with scripted responses instead of running them.
+//Responses are matched by the start of the command line, so Respond(result, nil, "/usr/bin/security", "list-keychain")
+//matches every "security list-keychain" call no matter which arguments follow.
+//Commands without a matching response are answered by Fallback, or with an empty Result if Fallback is nil.
+type FakeRunner struct {
+	Fallback  func(cmd Command) (Result, error)
+	mux       sync.Mutex
+	calls     []Command
+	responses []*fakeResponse
+}
+
+type fakeResponse struct {
+	prefix []string
+	result Result
+	err    error
+	once   bool
+}
+
+//NewFakeRunner creates a FakeRunner without any responses
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{}
+}
+
+//Respond makes the runner answer all commands starting with commandLine with the given result and error.
+func (f *FakeRunner) Respond(result Result, err error, commandLine ...string) {
+	f.addResponse(&fakeResponse{prefix: commandLine, result: result, err: err})
+}
+
+//RespondOnce works like Respond but the response is only used for the next matching command.
+//Responses registered with RespondOnce are preferred over those registered with Respond.
+func (f *FakeRunner) RespondOnce(result Result, err error, commandLine ...string) {
+	f.addResponse(&fakeResponse{prefix: commandLine, result: result, err: err, once: true})
+}
+
+func (f *FakeRunner) addResponse(response *fakeResponse) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.responses = append(f.responses, response)
+}
+
+//Run records the command and returns the scripted response for it.
+func (f *FakeRunner) Run(ctx context.Context, cmd Command) (Result, error) {
+	f.mux.Lock()
+	f.calls = append(f.calls, cmd)
+	response := f.takeResponse(cmd)
+	fallback := f.Fallback
+	f.mux.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	if response != nil {
+		return response.result, response.err
+	}
+	if fallback != nil {
+		return fallback(cmd)
+	}
+	return Result{}, nil
+}
+
+func (f *FakeRunner) takeResponse(cmd Command) *fakeResponse {
+	commandLine := append([]string{cmd.Name}, cmd.Args...)
+	var permanent *fakeResponse
+	for i, response := range f.responses {
+		if !hasPrefix(commandLine, response.prefix) {
+			continue
+		}
+		if response.once {
+			f.responses = append(f.responses[:i], f.responses[i+1:]...)
+			return response
+		}
+		if permanent == nil {
+			permanent = response
+		}
+	}
+	return permanent
+}
+
+//Calls returns all commands the runner received so far in the order they were run.
+func (f *FakeRunner) Calls() []Command {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return append([]Command{}, f.calls...)
+}
+
+//CommandLines returns the calls formatted as space separated command lines.
+func (f *FakeRunner) CommandLines() []string {
+	calls := f.Calls()
+	lines := make([]string, len(calls))
+	for i, call := range calls {
+		lines[i] = call.String()
+	}
+	return lines
+}
+
+//Reset forgets all recorded calls and scripted responses.
+func (f *FakeRunner) Reset() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.calls = nil
+	f.responses = nil
+}
+
+func hasPrefix(commandLine []string, prefix []string) bool {
+	if len(prefix) > len(commandLine) {
+		return false
+	}
+	for i, element := range prefix {
+		if commandLine[i] != element {
+			return false
+		}
+	}
+	return true
+}
+
+//Output is a helper for scripting responses that only consist of combined output.
+func Output(output string) Result {
+	return Result{Stdout: []byte(output), Output: []byte(output)}
+}
+
+var _ Runner = &FakeRunner{}
+var _ Runner = ExecRunner{}
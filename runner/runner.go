@@ -0,0 +1,113 @@
+//Package runner executes the external tools app-signer depends on, like security and codesign.
+//All invocations go through the Runner interface so they can be replaced by a FakeRunner in tests
+//and the signing orchestration can be tested on machines without those tools.
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Command describes one invocation of an external tool. Env entries in the form "KEY=value"
+//are added to the environment of the current process. A Timeout of zero means the command
+//only stops when the context passed to Run is done.
+type Command struct {
+	Name    string
+	Args    []string
+	Env     []string
+	Dir     string
+	Timeout time.Duration
+}
+
+//String returns the command line of the Command for logging
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+//Result contains the captured output of a command. Output has stdout and stderr interleaved
+//in the order they were written, like exec.Cmd.CombinedOutput returns it.
+type Result struct {
+	Stdout   []byte
+	Stderr   []byte
+	Output   []byte
+	ExitCode int
+}
+
+//Runner runs external commands. Implementations must be safe for concurrent use.
+type Runner interface {
+	Run(ctx context.Context, cmd Command) (Result, error)
+}
+
+//ErrTimeout is returned, wrapped, when a command was killed because its Timeout expired.
+var ErrTimeout = errors.New("command timed out")
+
+//ExecRunner runs commands as processes on the local machine.
+//Env is added to the environment of every command, DefaultTimeout is used
+//for commands that do not specify their own Timeout.
+type ExecRunner struct {
+	Env            []string
+	DefaultTimeout time.Duration
+}
+
+//NewExecRunner creates an ExecRunner without default timeout and extra environment.
+func NewExecRunner() ExecRunner {
+	return ExecRunner{}
+}
+
+//Run executes the command and waits for it to finish. If the process exits with a non zero exit code,
+//the result contains its output and exit code and the returned error is an *exec.ExitError.
+func (r ExecRunner) Run(ctx context.Context, cmd Command) (Result, error) {
+	timeout := cmd.Timeout
+	if timeout == 0 {
+		timeout = r.DefaultTimeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	execCmd := exec.CommandContext(ctx, cmd.Name, cmd.Args...)
+	execCmd.Dir = cmd.Dir
+	if len(r.Env) > 0 || len(cmd.Env) > 0 {
+		execCmd.Env = append(append(os.Environ(), r.Env...), cmd.Env...)
+	}
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	combined := &lockedBuffer{}
+	execCmd.Stdout = io.MultiWriter(stdout, combined)
+	execCmd.Stderr = io.MultiWriter(stderr, combined)
+
+	err := execCmd.Run()
+	result := Result{Stdout: stdout.Bytes(), Stderr: stderr.Bytes(), Output: combined.Bytes()}
+	if execCmd.ProcessState != nil {
+		result.ExitCode = execCmd.ProcessState.ExitCode()
+	}
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return result, fmt.Errorf("%s after %v: %w", cmd, timeout, ErrTimeout)
+	}
+	return result, err
+}
+
+type lockedBuffer struct {
+	mux    sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buffer.Bytes()
+}
@@ -0,0 +1,70 @@
+package runner_test
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/app-signer/runner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecRunnerCapturesOutput(t *testing.T) {
+	r := runner.ExecRunner{Env: []string{"RUNNER_TEST=from-runner"}}
+	result, err := r.Run(context.Background(), runner.Command{
+		Name: "sh",
+		Args: []string{"-c", "echo $RUNNER_TEST; echo $COMMAND_TEST 1>&2"},
+		Env:  []string{"COMMAND_TEST=from-command"},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "from-runner\n", string(result.Stdout))
+		assert.Equal(t, "from-command\n", string(result.Stderr))
+		//stdout and stderr are separate pipes, so the order of the two lines is not guaranteed
+		assert.ElementsMatch(t, []string{"from-runner", "from-command", ""}, strings.Split(string(result.Output), "\n"))
+		assert.Equal(t, 0, result.ExitCode)
+	}
+}
+
+func TestExecRunnerExitCode(t *testing.T) {
+	result, err := runner.NewExecRunner().Run(context.Background(), runner.Command{Name: "sh", Args: []string{"-c", "echo failed; exit 3"}})
+	var exitError *exec.ExitError
+	assert.True(t, errors.As(err, &exitError))
+	assert.Equal(t, 3, result.ExitCode)
+	assert.Equal(t, "failed\n", string(result.Output))
+}
+
+func TestExecRunnerTimeout(t *testing.T) {
+	r := runner.ExecRunner{DefaultTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	_, err := r.Run(context.Background(), runner.Command{Name: "sleep", Args: []string{"5"}})
+	assert.True(t, errors.Is(err, runner.ErrTimeout))
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestFakeRunner(t *testing.T) {
+	fake := runner.NewFakeRunner()
+	fake.Respond(runner.Output("permanent"), nil, "/usr/bin/security", "list-keychain")
+	fake.RespondOnce(runner.Output("once"), nil, "/usr/bin/security", "list-keychain")
+	fake.Respond(runner.Result{ExitCode: 1}, errors.New("failed"), "/usr/bin/codesign")
+
+	ctx := context.Background()
+	result, _ := fake.Run(ctx, runner.Command{Name: "/usr/bin/security", Args: []string{"list-keychain"}})
+	assert.Equal(t, "once", string(result.Output))
+	result, _ = fake.Run(ctx, runner.Command{Name: "/usr/bin/security", Args: []string{"list-keychain", "-s", "a"}})
+	assert.Equal(t, "permanent", string(result.Output))
+	_, err := fake.Run(ctx, runner.Command{Name: "/usr/bin/codesign", Args: []string{"-vv"}})
+	assert.Error(t, err)
+	result, err = fake.Run(ctx, runner.Command{Name: "/usr/bin/lipo"})
+	assert.NoError(t, err)
+	assert.Empty(t, result.Output)
+
+	assert.Equal(t, []string{
+		"/usr/bin/security list-keychain",
+		"/usr/bin/security list-keychain -s a",
+		"/usr/bin/codesign -vv",
+		"/usr/bin/lipo",
+	}, fake.CommandLines())
+}
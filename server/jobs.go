@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/danielpaulus/app-signer/api"
+	"github.com/danielpaulus/app-signer/jobs"
+	log "github.com/sirupsen/logrus"
+)
+
+//Error codes of the job endpoints
+const (
+	CodeJobNotFound = "job_not_found"
+	CodeQueueFull   = "queue_full"
+	CodeNoArtifact  = "no_artifact"
+)
+
+//JobResponse is the JSON representation of a job. ErrorCode classifies the error of failed jobs
+//with the same codes the synchronous /sign endpoint uses.
+type JobResponse struct {
+	jobs.Status
+	ErrorCode string `json:"error_code,omitempty"`
+}
+
+//handleSubmitJob stores the upload and queues a signing job for it. It responds with 202 and the job,
+//clients poll GET /jobs/<id> until it succeeded and then download GET /jobs/<id>/artifact.
+func (s *Server) handleSubmitJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "use POST")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.options.MaxUploadSize)
+	requestDir, err := ioutil.TempDir(s.options.Workdir, "job-upload")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	ipaPath := path.Join(requestDir, "upload.ipa")
+	request, err := readSignRequest(r, ipaPath)
+	if err != nil {
+		os.RemoveAll(requestDir)
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+
+	id, err := s.options.Jobs.SubmitWithCleanup(func(ctx context.Context, logger *log.Entry, artifactPath string) error {
+		logger.WithFields(log.Fields{"udid": request.UDID, "bundleid": request.BundleID, "ipa": request.Filename}).Info("signing request")
+		options := s.resignOptions(request)
+		options.Logger = logger
+		options.Context = ctx
+		_, err := api.ResignIPAWithOptions(s.workspace, request.UDID, ipaPath, artifactPath, options)
+		return err
+	}, func() { os.RemoveAll(requestDir) })
+	if err != nil {
+		os.RemoveAll(requestDir)
+		if errors.Is(err, jobs.ErrQueueFull) {
+			writeError(w, http.StatusServiceUnavailable, CodeQueueFull, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	status, err := s.options.Jobs.Status(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+id)
+	writeJSON(w, http.StatusAccepted, jobResponse(status))
+}
+
+//handleJob serves GET /jobs/<id>, /jobs/<id>/logs and /jobs/<id>/artifact
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "use GET")
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	id := parts[0]
+	if len(parts) > 2 {
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("no such endpoint %s", r.URL.Path))
+		return
+	}
+	status, err := s.options.Jobs.Status(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, CodeJobNotFound, fmt.Sprintf("job '%s' does not exist or expired", id))
+		return
+	}
+	if len(parts) == 1 {
+		writeJSON(w, http.StatusOK, jobResponse(status))
+		return
+	}
+	switch parts[1] {
+	case "logs":
+		logs, err := s.options.Jobs.Logs(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, CodeJobNotFound, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(logs))
+	case "artifact":
+		artifact, err := s.options.Jobs.Artifact(id)
+		if err != nil {
+			writeError(w, http.StatusConflict, CodeNoArtifact, err.Error())
+			return
+		}
+		streamFile(w, artifact, id+"-signed.ipa")
+	default:
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("no such endpoint %s", r.URL.Path))
+	}
+}
+
+func jobResponse(status jobs.Status) JobResponse {
+	response := JobResponse{Status: status}
+	if status.Err != nil {
+		_, response.ErrorCode = classifyError(status.Err)
+	}
+	return response
+}
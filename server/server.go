@@ -0,0 +1,289 @@
+//Package server exposes the app signer as a long running HTTP service. The signing workspace with its
+//keychain and parsed profiles is prepared once and then used for every request.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/danielpaulus/app-signer/api"
+	"github.com/danielpaulus/app-signer/jobs"
+	log "github.com/sirupsen/logrus"
+)
+
+//DefaultMaxUploadSize limits the size of uploaded ipa files to 4GB
+const DefaultMaxUploadSize = 4 << 30
+
+//Error codes returned in ErrorResponse
+const (
+	CodeBadRequest           = "bad_request"
+	CodeMissingUDID          = "missing_udid"
+	CodeDeviceNotProvisioned = "device_not_provisioned"
+	CodeNoMatchingProfile    = "no_matching_profile"
+	CodeProfileExpiring      = "profile_expiring"
+	CodeInvalidIPA           = "invalid_ipa"
+	CodeSimulatorBuild       = "simulator_build"
+	CodeSigningFailed        = "signing_failed"
+	CodeVerificationFailed   = "verification_failed"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeNotFound             = "not_found"
+	CodeInternal             = "internal_error"
+)
+
+//WarningHeader is added to a successful /sign response once for every warning, like a profile expiring soon
+const WarningHeader = "X-Signing-Warning"
+
+//ErrorResponse is the JSON body of every failed request
+type ErrorResponse struct {
+	Error ErrorDetails `json:"error"`
+}
+
+//ErrorDetails contains a machine readable Code and a human readable Message
+type ErrorDetails struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+//Options configures the Server. Workdir is where uploads and signed ipas are stored temporarily,
+//it defaults to the systems temp dir. MaxUploadSize defaults to DefaultMaxUploadSize.
+//The asynchronous /jobs endpoints are only available if Jobs is set.
+//ExpiryWarning and StrictExpiry are passed on to api.ResignOptions for every request.
+type Options struct {
+	Workdir       string
+	MaxUploadSize int64
+	Jobs          *jobs.Queue
+	ExpiryWarning time.Duration
+	StrictExpiry  bool
+}
+
+//Server is a http.Handler for signing ipas with a prepared SigningWorkspace.
+//
+//	POST /sign    multipart form with the ipa in the 'ipa' field, the device in 'udid' and optionally a new
+//	              bundle identifier in 'bundleid' and the entitlements mode in 'entitlements'. Alternatively the
+//	              raw ipa can be sent as body with the other fields as query parameters. Responds with the signed ipa,
+//	              warnings are sent in X-Signing-Warning headers.
+//	GET  /health  responds with {"status":"ok"}
+//
+//If a job queue is configured, ipas can also be signed asynchronously:
+//
+//	POST /jobs                 same parameters as /sign, responds with 202 and the queued job
+//	GET  /jobs/<id>            the state of the job, one of queued, running, succeeded or failed
+//	GET  /jobs/<id>/logs       the log output of the job
+//	GET  /jobs/<id>/artifact   the signed ipa of a succeeded job
+type Server struct {
+	workspace api.SigningWorkspace
+	options   Options
+	mux       *http.ServeMux
+}
+
+//NewServer creates a Server signing with the given workspace
+func NewServer(workspace api.SigningWorkspace, options Options) *Server {
+	if options.Workdir == "" {
+		options.Workdir = os.TempDir()
+	}
+	if options.MaxUploadSize == 0 {
+		options.MaxUploadSize = DefaultMaxUploadSize
+	}
+	s := &Server{workspace: workspace, options: options, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/sign", s.handleSign)
+	s.mux.HandleFunc("/health", s.handleHealth)
+	if options.Jobs != nil {
+		s.mux.HandleFunc("/jobs", s.handleSubmitJob)
+		s.mux.HandleFunc("/jobs/", s.handleJob)
+	}
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("no such endpoint %s", r.URL.Path))
+	})
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "use GET")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleSign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "use POST")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.options.MaxUploadSize)
+	requestDir, err := ioutil.TempDir(s.options.Workdir, "sign-request")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	defer os.RemoveAll(requestDir)
+
+	ipaPath := path.Join(requestDir, "upload.ipa")
+	request, err := readSignRequest(r, ipaPath)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	log.WithFields(log.Fields{"udid": request.UDID, "bundleid": request.BundleID, "ipa": request.Filename}).Info("signing request")
+
+	outputPath := path.Join(requestDir, "signed.ipa")
+	result, err := api.ResignIPAWithResult(s.workspace, request.UDID, ipaPath, outputPath, s.resignOptions(request))
+	if err != nil {
+		status, code := classifyError(err)
+		log.WithFields(log.Fields{"udid": request.UDID, "err": err}).Warn("signing request failed")
+		writeError(w, status, code, err.Error())
+		return
+	}
+	for _, warning := range result.Warnings {
+		w.Header().Add(WarningHeader, warning)
+	}
+	streamFile(w, outputPath, signedFileName(request.Filename))
+}
+
+//signRequest contains the parameters of a /sign call
+type signRequest struct {
+	UDID         string
+	BundleID     string
+	Entitlements string
+	Filename     string
+}
+
+func (s *Server) resignOptions(r signRequest) api.ResignOptions {
+	return api.ResignOptions{BundleID: r.BundleID, Entitlements: r.Entitlements, ExpiryWarning: s.options.ExpiryWarning, StrictExpiry: s.options.StrictExpiry}
+}
+
+//readSignRequest stores the uploaded ipa at ipaPath and returns the parameters of the request
+func readSignRequest(r *http.Request, ipaPath string) (signRequest, error) {
+	query := r.URL.Query()
+	request := signRequest{UDID: query.Get("udid"), BundleID: query.Get("bundleid"), Entitlements: query.Get("entitlements"), Filename: "app.ipa"}
+	var upload io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			return request, err
+		}
+		upload = nil
+		for upload == nil {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return request, err
+			}
+			switch part.FormName() {
+			case "udid", "bundleid", "entitlements":
+				value, err := ioutil.ReadAll(io.LimitReader(part, 1024))
+				if err != nil {
+					return request, err
+				}
+				switch part.FormName() {
+				case "udid":
+					request.UDID = strings.TrimSpace(string(value))
+				case "bundleid":
+					request.BundleID = strings.TrimSpace(string(value))
+				default:
+					request.Entitlements = strings.TrimSpace(string(value))
+				}
+			case "ipa":
+				if part.FileName() != "" {
+					request.Filename = part.FileName()
+				}
+				upload = part
+			}
+		}
+		//the ipa has to be the last part, fields after it are not read
+		if upload == nil {
+			return request, fmt.Errorf("multipart form does not contain an 'ipa' file")
+		}
+	}
+	file, err := os.Create(ipaPath)
+	if err != nil {
+		return request, err
+	}
+	defer file.Close()
+	written, err := io.Copy(file, upload)
+	if err != nil {
+		return request, fmt.Errorf("failed receiving ipa: %w", err)
+	}
+	if written == 0 {
+		return request, fmt.Errorf("uploaded ipa is empty")
+	}
+	return request, nil
+}
+
+func classifyError(err error) (int, string) {
+	switch {
+	case errors.Is(err, api.ErrInvalidOptions):
+		return http.StatusBadRequest, CodeBadRequest
+	case errors.Is(err, api.ErrMissingUDID):
+		return http.StatusBadRequest, CodeMissingUDID
+	case errors.Is(err, api.ErrDeviceNotProvisioned):
+		return http.StatusUnprocessableEntity, CodeDeviceNotProvisioned
+	case errors.Is(err, api.ErrNoMatchingProfile):
+		return http.StatusUnprocessableEntity, CodeNoMatchingProfile
+	case errors.Is(err, api.ErrProfileExpiring):
+		return http.StatusUnprocessableEntity, CodeProfileExpiring
+	case errors.Is(err, api.ErrInvalidIPA):
+		return http.StatusUnprocessableEntity, CodeInvalidIPA
+	case errors.Is(err, api.ErrSimulatorBuild):
+		return http.StatusUnprocessableEntity, CodeSimulatorBuild
+	case errors.Is(err, api.ErrSigningFailed):
+		return http.StatusInternalServerError, CodeSigningFailed
+	case errors.Is(err, api.ErrVerificationFailed):
+		return http.StatusInternalServerError, CodeVerificationFailed
+	}
+	return http.StatusInternalServerError, CodeInternal
+}
+
+func streamFile(w http.ResponseWriter, filePath string, name string) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprint(info.Size()))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.WriteHeader(http.StatusOK)
+	_, err = io.Copy(w, file)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("failed sending signed ipa")
+	}
+}
+
+func signedFileName(uploadName string) string {
+	base := strings.TrimSuffix(path.Base(uploadName), ".ipa")
+	return base + "-signed.ipa"
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, ErrorResponse{Error: ErrorDetails{Code: code, Message: message}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("failed writing response")
+	}
+}
@@ -0,0 +1,131 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/app-signer/api"
+	"github.com/danielpaulus/app-signer/jobs"
+	"github.com/danielpaulus/app-signer/server"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	handler, cleanup := makeServer()
+	defer cleanup()
+
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, response.Body.String())
+}
+
+func TestSignErrors(t *testing.T) {
+	handler, cleanup := makeServer()
+	defer cleanup()
+
+	testCases := map[string]struct {
+		request *http.Request
+		status  int
+		code    string
+	}{
+		"wrong method":              {httptest.NewRequest(http.MethodGet, "/sign", nil), http.StatusMethodNotAllowed, server.CodeMethodNotAllowed},
+		"unknown endpoint":          {httptest.NewRequest(http.MethodGet, "/unknown", nil), http.StatusNotFound, server.CodeNotFound},
+		"empty upload":              {httptest.NewRequest(http.MethodPost, "/sign?udid=abc", nil), http.StatusBadRequest, server.CodeBadRequest},
+		"missing udid":              {multipartRequest(t, "", []byte("ipa")), http.StatusBadRequest, server.CodeMissingUDID},
+		"unknown device":            {multipartRequest(t, "abc", []byte("ipa")), http.StatusUnprocessableEntity, server.CodeDeviceNotProvisioned},
+		"unknown entitlements mode": {httptest.NewRequest(http.MethodPost, "/sign?udid=abc&entitlements=all", bytes.NewReader([]byte("ipa"))), http.StatusBadRequest, server.CodeBadRequest},
+		"raw body upload":           {httptest.NewRequest(http.MethodPost, "/sign?udid=abc", bytes.NewReader([]byte("ipa"))), http.StatusUnprocessableEntity, server.CodeDeviceNotProvisioned},
+	}
+	for name, testCase := range testCases {
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, testCase.request)
+		assert.Equal(t, testCase.status, response.Code, name)
+		assert.Equal(t, "application/json", response.Header().Get("Content-Type"), name)
+		var errorResponse server.ErrorResponse
+		if assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &errorResponse), name) {
+			assert.Equal(t, testCase.code, errorResponse.Error.Code, name)
+			assert.NotEmpty(t, errorResponse.Error.Message, name)
+		}
+	}
+}
+
+func multipartRequest(t *testing.T, udid string, ipa []byte) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	assert.NoError(t, writer.WriteField("udid", udid))
+	part, err := writer.CreateFormFile("ipa", "test.ipa")
+	assert.NoError(t, err)
+	part.Write(ipa)
+	assert.NoError(t, writer.Close())
+	request := httptest.NewRequest(http.MethodPost, "/sign", body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	return request
+}
+
+func makeServer() (http.Handler, func()) {
+	dir, err := ioutil.TempDir("", "server-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	workspace := api.NewSigningWorkspace(dir, "")
+	return server.NewServer(workspace, server.Options{Workdir: dir}), func() { os.RemoveAll(dir) }
+}
+
+func TestSignJob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queue, err := jobs.NewQueue(jobs.Options{Workdir: path.Join(dir, "jobs")})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer queue.Close()
+	handler := server.NewServer(api.NewSigningWorkspace(dir, ""), server.Options{Workdir: dir, Jobs: queue})
+
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, withPath(multipartRequest(t, "abc", []byte("ipa")), "/jobs"))
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	var job server.JobResponse
+	if !assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &job)) {
+		return
+	}
+	assert.Equal(t, "/jobs/"+job.ID, response.Header().Get("Location"))
+
+	assert.Eventually(t, func() bool {
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/jobs/"+job.ID, nil))
+		json.Unmarshal(response.Body.Bytes(), &job)
+		return job.State == jobs.StateFailed
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, server.CodeDeviceNotProvisioned, job.ErrorCode)
+
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/jobs/"+job.ID+"/logs", nil))
+	assert.Contains(t, response.Body.String(), "signing request")
+
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/jobs/"+job.ID+"/artifact", nil))
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/jobs/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	assert.Contains(t, response.Body.String(), server.CodeJobNotFound)
+}
+
+func withPath(request *http.Request, urlPath string) *http.Request {
+	request.URL.Path = urlPath
+	return request
+}